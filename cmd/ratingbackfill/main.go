@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/pkg/rate"
+	"hw11_shopql/pkg/sellerreview"
+	"log"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Recomputes the denormalized rating aggregates of items from the Rates collection.
+// Run it once after upgrading, or whenever the aggregates are suspected to drift.
+
+const (
+	mongoURI      = "mongodb://127.0.0.1:27017"
+	mongoAuthDB   = "admin"
+	mongoUsername = "root"
+	mongoPassword = "example"
+	databaseName  = "hz"
+)
+
+func connectMongoDB() (*mongo.Client, error) {
+	credential := options.Credential{
+		AuthSource: mongoAuthDB,
+		Username:   mongoUsername,
+		Password:   mongoPassword,
+	}
+
+	clientOpts := options.Client().
+		ApplyURI(mongoURI).
+		SetAuth(credential)
+
+	client, err := mongo.Connect(context.Background(), clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	err = client.Ping(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+
+	return client, nil
+}
+
+func main() {
+	client, err := connectMongoDB()
+	if err != nil {
+		log.Fatalf("MongoDB connection error: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(databaseName)
+	rateRepo := rate.CreateRateRepo(db.Collection("Rates"), db.Collection("Items"))
+	rated, err := rateRepo.BackfillItemAggregates(context.Background())
+	if err != nil {
+		log.Fatalf("backfill failed: %v", err)
+	}
+	log.Printf("rating aggregates updated, %d items have rates", rated)
+
+	reviewRepo := sellerreview.CreateSellerReviewRepo(db.Collection("SellerReviews"), db.Collection("Sellers"))
+	if err := reviewRepo.BackfillSellerAggregates(context.Background()); err != nil {
+		log.Fatalf("seller backfill failed: %v", err)
+	}
+	log.Println("seller rating aggregates updated")
+}
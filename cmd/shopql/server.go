@@ -6,23 +6,40 @@ import (
 	"fmt"
 	"hw11_shopql/graph"
 	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/address"
 	"hw11_shopql/pkg/cart"
 	"hw11_shopql/pkg/catalog"
 	"hw11_shopql/pkg/comment"
+	"hw11_shopql/pkg/guest"
+	"hw11_shopql/pkg/idempotency"
 	"hw11_shopql/pkg/item"
+	"hw11_shopql/pkg/notify"
 	"hw11_shopql/pkg/order"
+	"hw11_shopql/pkg/outbox"
+	"hw11_shopql/pkg/payment"
+	"hw11_shopql/pkg/payout"
+	"hw11_shopql/pkg/policy"
+	"hw11_shopql/pkg/pubsub"
 	"hw11_shopql/pkg/rate"
+	"hw11_shopql/pkg/rma"
 	"hw11_shopql/pkg/role"
 	"hw11_shopql/pkg/seller"
+	"hw11_shopql/pkg/sellerreview"
 	"hw11_shopql/pkg/session"
 	"hw11_shopql/pkg/user"
+	"hw11_shopql/pkg/utils/ownerutils"
 	"hw11_shopql/pkg/utils/roleutils"
 	"hw11_shopql/pkg/utils/sessionutils"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/go-chi/chi"
 	_ "github.com/lib/pq"
@@ -44,11 +61,17 @@ type Data struct {
 	Sellers []model.Seller `json:"sellers"`
 }
 
-func Middleware(sm session.SessionManager) func(http.Handler) http.Handler {
+func Middleware(sm session.SessionManager, guests *guest.Signer) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			session, err := sm.Check(r)
 			if err != nil {
+				// anonymous visitor, only a token the client presents again is honored
+				if guestID, err := guests.Verify(r.Header.Get(guest.HeaderName)); err == nil {
+					r = r.WithContext(context.WithValue(r.Context(), guest.ContextKey, guestID))
+				} else if token, err := guests.Issue(); err == nil {
+					w.Header().Set(guest.HeaderName, token)
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -85,6 +108,20 @@ func connectMongoDB() (*mongo.Client, error) {
 	return client, nil
 }
 
+// durationFromEnv reads a duration like "36h", falls back to def when unset or broken
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("bad %s %q, using %v", name, value, def)
+		return def
+	}
+	return d
+}
+
 const (
 	host     = "localhost"
 	port     = 5432
@@ -103,7 +140,7 @@ func main() {
 	collection := db.Collection("Catalogs")
 	item_collection := db.Collection("Items")
 	rateCollection := db.Collection("Rates")
-	rateRepos := *rate.CreateRateRepo(rateCollection)
+	rateRepos := *rate.CreateRateRepo(rateCollection, item_collection)
 	commentCollection := db.Collection("Comments")
 	commRepo := *comment.CreateCommentRepo(commentCollection)
 	itemHandler := item.CreateItemsHandler(item_collection, &rateRepos, &commRepo)
@@ -112,8 +149,49 @@ func main() {
 	cartRepos := *cart.CreateCartRepo(cartCollection, itemHandler)
 	seller_collection := db.Collection("Sellers")
 	sellerHandler := seller.CreateSellersHandler(seller_collection)
+	if err := sellerHandler.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create seller index:", err)
+	}
 	orderCollection := db.Collection("orders")
-	orderRepo := *order.CreateOrderRepo(orderCollection, &cartRepos, itemHandler)
+	orderRepo := *order.CreateOrderRepo(orderCollection, db.Collection("Counters"), &cartRepos, itemHandler)
+	sellerStats := seller.CreateSellerStatsRepo(db.Collection("SellerStats"), seller_collection, item_collection, orderCollection)
+	orderRepo.Stats = sellerStats
+	payoutRepo := payout.CreatePayoutRepo(db.Collection("Ledger"), db.Collection("CommissionRates"), catalogHandler)
+	orderRepo.Ledger = payoutRepo
+	bus := pubsub.CreateMemoryBus()
+	orderRepo.Events = bus
+	orderRepo.Sellers = sellerHandler
+	if err := orderRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create order indexes:", err)
+	}
+	if err := orderRepo.BackfillTotals(context.Background()); err != nil {
+		log.Println("failed to backfill order totals:", err)
+	}
+	if err := orderRepo.BackfillStatuses(context.Background()); err != nil {
+		log.Println("failed to backfill order statuses:", err)
+	}
+	if err := orderRepo.SeedCounter(context.Background()); err != nil {
+		log.Println("failed to seed order counter:", err)
+	}
+	reviewPolicy := policy.CreateReviewPolicy(&orderRepo, itemHandler, catalogHandler)
+	sellerReviewRepo := sellerreview.CreateSellerReviewRepo(db.Collection("SellerReviews"), seller_collection)
+	if err := sellerReviewRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create seller review index:", err)
+	}
+	addressRepo := address.CreateAddressRepo(db.Collection("Addresses"))
+	paymentSecret := []byte(os.Getenv("PAYMENT_SECRET"))
+	if len(paymentSecret) == 0 {
+		log.Println("PAYMENT_SECRET is not set, payment webhooks can't be verified after restart")
+		paymentSecret = guest.RandomSecret()
+	}
+	paymentProvider := payment.CreateFakeProvider(paymentSecret, "/payments/fake/confirm")
+	paymentRepo := payment.CreatePaymentRepo(db.Collection("Payments"), db.Collection("PaymentEvents"), paymentProvider, &orderRepo)
+	if err := paymentRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create payment indexes:", err)
+	}
+	orderRepo.Payments = paymentRepo
+	returnRepo := rma.CreateReturnRepo(db.Collection("Returns"), &orderRepo, itemHandler, paymentRepo)
+	returnRepo.Ledger = payoutRepo
 	psqlInfo := fmt.Sprintf("user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		username, password, dbname)
@@ -123,11 +201,21 @@ func main() {
 	}
 	defer postgre.Close()
 
+	roleRepo := role.CreateRoleRepo(postgre)
 	c := graph.Config{Resolvers: &graph.Resolver{CatalogRepo: catalogHandler,
-		CartRepo:   &cartRepos,
-		ItemRepo:   itemHandler,
-		SellerRepo: sellerHandler,
-		OrderRepo:  &orderRepo,
+		RoleRepo:     roleRepo,
+		CartRepo:     &cartRepos,
+		ItemRepo:     itemHandler,
+		SellerRepo:   sellerHandler,
+		SellerStats:  sellerStats,
+		SellerReview: sellerReviewRepo,
+		PayoutRepo:   payoutRepo,
+		OrderRepo:    &orderRepo,
+		AddressRepo:  addressRepo,
+		PaymentRepo:  paymentRepo,
+		ReturnRepo:   returnRepo,
+		ReviewPolicy: reviewPolicy,
+		Events:       bus,
 	}}
 	c.Directives.Authorized = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
 		if ctx.Value("tokens") == nil {
@@ -136,6 +224,13 @@ func main() {
 		}
 		return next(ctx)
 	}
+	c.Directives.AuthorizedOrGuest = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
+		if ctx.Value("tokens") == nil && ctx.Value(guest.ContextKey) == nil {
+			graphql.AddError(ctx, fmt.Errorf("User not authorized"))
+			return nil, nil
+		}
+		return next(ctx)
+	}
 	c.Directives.HasRole = func(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (res interface{}, err error) {
 		if id, err := sessionutils.IdFromContex(ctx); err == nil {
 			ok := roleutils.HasRole(postgre, id, role.String())
@@ -148,17 +243,89 @@ func main() {
 		}
 		return next(ctx)
 	}
-	srv := handler.NewDefaultServer(graph.NewExecutableSchema(c))
+	c.Directives.OwnsSeller = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
+		id, err := sessionutils.IdFromContex(ctx)
+		if err != nil {
+			graphql.AddError(ctx, fmt.Errorf("User not authorized"))
+			return nil, nil
+		}
+		if roleutils.HasRole(postgre, id, model.RoleAdmin.String()) {
+			return next(ctx)
+		}
+		sellerID, err := ownerutils.SellerIDFromArgs(ctx, itemHandler)
+		if err != nil {
+			return nil, err
+		}
+		owns, err := roleutils.OwnsSeller(postgre, id, sellerID)
+		if err != nil {
+			return nil, err
+		}
+		if !roleutils.HasRole(postgre, id, model.RoleSeller.String()) || !owns {
+			graphql.AddError(ctx, fmt.Errorf("Forbiden"))
+			return nil, nil
+		}
+		return next(ctx)
+	}
+	c.Directives.Idempotent = idempotency.Directive
 	sm := session.NewSessionsDB(postgre)
+	srv := handler.New(graph.NewExecutableSchema(c))
+	// subscriptions authenticate with the session token in the init payload
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		InitFunc:              sessionutils.WebsocketInit(sm),
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+	srv.SetQueryCache(lru.New(1000))
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{Cache: lru.New(100)})
+	idempotencyRepo := idempotency.CreateIdempotencyRepo(db.Collection("IdempotencyKeys"))
+	if err := idempotencyRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create idempotency key index:", err)
+	}
+	srv.Use(idempotency.CreateExtension(idempotencyRepo))
 	router := chi.NewRouter()
-	router.Use(Middleware(sm))
+	guestSecret := []byte(os.Getenv("GUEST_SECRET"))
+	if len(guestSecret) == 0 {
+		log.Println("GUEST_SECRET is not set, guest carts are lost on restart")
+		guestSecret = guest.RandomSecret()
+	}
+	router.Use(Middleware(sm, guest.CreateSigner(guestSecret)))
 	router.Handle("/", playground.Handler("GraphQL playground", "/query"))
 	router.Handle("/query", srv)
-	roleRepo := role.CreateRoleRepo(postgre)
 	ur := user.CreateUserRepo(postgre, roleRepo)
 	uh := user.CreateUserHandler(ur, sm)
+	uh.Carts = &cartRepos
+
+	var notifier notify.Notifier = &notify.LogNotifier{}
+	if path := os.Getenv("CART_NOTIFY_FILE"); path != "" {
+		notifier = notify.CreateFileNotifier(path)
+	}
+	cartJob := cart.CreateAbandonedCartJob(&cartRepos, notifier)
+	cartJob.IdleAfter = durationFromEnv("CART_IDLE_AFTER", cart.DefaultIdleAfter)
+	cartJob.ExpireAfter = durationFromEnv("CART_EXPIRE_AFTER", cart.DefaultExpireAfter)
+	go cartJob.Run(context.Background())
+	outboxRepo := outbox.CreateOutboxRepo(db.Collection("Outbox"), orderCollection, item_collection, commentCollection)
+	if err := outboxRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create outbox index:", err)
+	}
+	sinks := []outbox.Sink{}
+	if path := os.Getenv("OUTBOX_FILE"); path != "" {
+		sinks = append(sinks, outbox.CreateFileSink(path))
+	}
+	if url := os.Getenv("OUTBOX_WEBHOOK_URL"); url != "" {
+		sinks = append(sinks, outbox.CreateWebhookSink(url, []byte(os.Getenv("OUTBOX_WEBHOOK_SECRET"))))
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, &outbox.LogSink{})
+	}
+	go outbox.CreateDispatcher(outboxRepo, sinks...).Run(context.Background())
 	router.HandleFunc("/register", uh.Reg)
 	router.HandleFunc("/login", uh.Log)
+	router.Post("/payments/webhook", payment.CreateWebhookHandler(paymentRepo).Webhook)
+	router.Get("/admin/orders.csv", order.CreateExportHandler(&orderRepo, roleRepo).ExportCSV)
 	log.Printf("Connect to http://localhost:%v/ for GraphQL playground", port)
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
@@ -15,11 +15,18 @@ CREATE TABLE IF NOT EXISTS user_role(
     role_id INT REFERENCES roles(role_id)
 )
 
+CREATE TABLE IF NOT EXISTS seller_user(
+    seller_id INT NOT NULL,
+    user_id INT REFERENCES users(id),
+    PRIMARY KEY (seller_id, user_id)
+)
+
 
 INSERT INTO roles VALUES
 (1, 'user'),
 (2, 'admin')
-(3, 'superuser')
+(3, 'superuser'),
+(4, 'seller')
 
 INSERT INTO users VALUES
 (1, 'admin@example.com', 'admin', 'pass'),
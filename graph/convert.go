@@ -0,0 +1,241 @@
+package graph
+
+// Conversions from repository types to the generated GraphQL models.
+// Kept out of schema.resolvers.go so gqlgen doesn't move them on regeneration.
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/address"
+	"hw11_shopql/pkg/cart"
+	"hw11_shopql/pkg/payout"
+	"hw11_shopql/pkg/rma"
+	"hw11_shopql/pkg/sellerreview"
+	"time"
+)
+
+func sellerReviewToModel(review *sellerreview.SellerReview) *model.SellerReview {
+	return &model.SellerReview{
+		ID:        review.ID.Hex(),
+		UserID:    review.UserID,
+		SellerID:  review.SellerID,
+		OrderID:   review.OrderID,
+		Rate:      review.Rate,
+		Text:      review.Text,
+		CreatedAt: review.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func ledgerEntryToModel(entry *payout.Entry) *model.LedgerEntry {
+	res := &model.LedgerEntry{
+		EntryID:        entry.ID,
+		Kind:           entry.Kind,
+		SellerID:       entry.SellerID,
+		Gross:          entry.Gross,
+		CommissionRate: entry.CommissionRate,
+		Commission:     entry.Commission,
+		Net:            entry.Net,
+		CreatedAt:      entry.CreatedAt.Format(time.RFC3339),
+	}
+	if entry.Kind == payout.KindSale || entry.Kind == payout.KindReversal {
+		res.OrderID = &entry.OrderID
+		res.ItemID = &entry.ItemID
+		res.Quantity = &entry.Quantity
+	}
+	return res
+}
+
+func balanceToModel(balance *payout.Balance) *model.SellerBalance {
+	res := &model.SellerBalance{
+		SellerID:   balance.SellerID,
+		Gross:      balance.Gross,
+		Commission: balance.Commission,
+		Net:        balance.Net,
+		PaidOut:    balance.PaidOut,
+		Balance:    balance.Balance,
+		Entries:    []*model.LedgerEntry{},
+	}
+	if balance.From != nil {
+		from := balance.From.Format(time.RFC3339)
+		res.From = &from
+	}
+	if balance.To != nil {
+		to := balance.To.Format(time.RFC3339)
+		res.To = &to
+	}
+	for _, entry := range balance.Entries {
+		res.Entries = append(res.Entries, ledgerEntryToModel(entry))
+	}
+	return res
+}
+
+// parsePeriod reads the RFC3339 bounds of the period, missing bounds stay nil
+func parsePeriod(period *model.PeriodInput) (from, to *time.Time, err error) {
+	if period == nil {
+		return nil, nil, nil
+	}
+	parse := func(value *string) (*time.Time, error) {
+		if value == nil {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, *value)
+		if err != nil {
+			return nil, fmt.Errorf("period must be in RFC3339: %w", err)
+		}
+		return &t, nil
+	}
+	if from, err = parse(period.From); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parse(period.To); err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+func abandonedCartsToModel(idleSince time.Time, carts []*cart.AbandonedCart) *model.AbandonedCartReport {
+	report := &model.AbandonedCartReport{
+		IdleSince: idleSince.Format(time.RFC3339),
+		Count:     len(carts),
+		Carts:     []*model.AbandonedCart{},
+	}
+	for _, c := range carts {
+		res := &model.AbandonedCart{
+			Guest:     c.Owner.GuestID != "",
+			Lines:     c.Lines,
+			Quantity:  c.Quantity,
+			UpdatedAt: c.UpdatedAt.Format(time.RFC3339),
+		}
+		if !res.Guest {
+			userID := c.Owner.UserID
+			res.UserID = &userID
+		}
+		if c.RemindedAt != nil {
+			remindedAt := c.RemindedAt.Format(time.RFC3339)
+			res.RemindedAt = &remindedAt
+		}
+		report.Carts = append(report.Carts, res)
+	}
+	return report
+}
+
+func addressToModel(addr *address.Address) *model.Address {
+	res := &model.Address{
+		ID:     addr.ID.Hex(),
+		City:   addr.City,
+		Street: addr.Street,
+		House:  addr.House,
+	}
+	if addr.Apartment != "" {
+		res.Apartment = &addr.Apartment
+	}
+	if addr.PostalCode != "" {
+		res.PostalCode = &addr.PostalCode
+	}
+	return res
+}
+
+func addressFromInput(userID int, in *model.AddressInput) address.Address {
+	addr := address.Address{
+		UserID: userID,
+		City:   in.City,
+		Street: in.Street,
+		House:  in.House,
+	}
+	if in.Apartment != nil {
+		addr.Apartment = *in.Apartment
+	}
+	if in.PostalCode != nil {
+		addr.PostalCode = *in.PostalCode
+	}
+	return addr
+}
+
+// checkoutDelivery builds the order delivery from the checkout input,
+// the address is either inline or taken from the user's address book
+func (r *Resolver) checkoutDelivery(ctx context.Context, userID int, in model.CheckoutInput) (*model.Delivery, error) {
+	delivery := &model.Delivery{
+		Method:    in.DeliveryMethod,
+		Recipient: in.Recipient,
+		Phone:     in.Phone,
+		Note:      in.Note,
+	}
+	switch {
+	case in.Address != nil && in.AddressID != nil:
+		return nil, fmt.Errorf("give either address or addressID")
+	case in.AddressID != nil:
+		addr, err := r.AddressRepo.AddressByID(ctx, userID, *in.AddressID)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Address = addressToModel(addr)
+	case in.Address != nil:
+		addr := addressFromInput(userID, in.Address)
+		if err := address.Validate(addr); err != nil {
+			return nil, err
+		}
+		delivery.Address = addressToModel(&addr)
+		delivery.Address.ID = ""
+	}
+	return delivery, nil
+}
+
+func returnToModel(ret *rma.ReturnRequest) *model.ReturnRequest {
+	res := &model.ReturnRequest{
+		ID:           ret.ID.Hex(),
+		OrderID:      ret.OrderID,
+		UserID:       ret.UserID,
+		Lines:        make([]*model.ReturnLine, 0, len(ret.Lines)),
+		Reason:       ret.Reason,
+		Photos:       ret.Photos,
+		Status:       ret.Status,
+		Note:         ret.Note,
+		RefundAmount: ret.RefundAmount,
+		RefundID:     ret.RefundID,
+		CreatedAt:    ret.CreatedAt.Format(time.RFC3339),
+	}
+	if res.Photos == nil {
+		res.Photos = []string{}
+	}
+	for _, line := range ret.Lines {
+		res.Lines = append(res.Lines, &model.ReturnLine{
+			ItemID:   line.ItemID,
+			Quantity: line.Quantity,
+			Price:    line.Price,
+		})
+	}
+	return res
+}
+
+func returnsToModel(returns []*rma.ReturnRequest) []*model.ReturnRequest {
+	res := make([]*model.ReturnRequest, 0, len(returns))
+	for _, ret := range returns {
+		res = append(res, returnToModel(ret))
+	}
+	return res
+}
+
+// orderStream turns bus messages into the channel of a subscription, first is sent before any change.
+// stop ends the bus subscription when the stream is done
+func orderStream(ctx context.Context, stop context.CancelFunc, msgs <-chan interface{}, first *model.Order) <-chan *model.Order {
+	out := make(chan *model.Order, 1)
+	if first != nil {
+		out <- first
+	}
+	go func() {
+		defer close(out)
+		defer stop()
+		for msg := range msgs {
+			order, ok := msg.(*model.Order)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- order:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
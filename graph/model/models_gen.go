@@ -8,6 +8,38 @@ import (
 	"strconv"
 )
 
+type AbandonedCart struct {
+	UserID     *int    `json:"userID,omitempty"`
+	Guest      bool    `json:"guest"`
+	Lines      int     `json:"lines"`
+	Quantity   int     `json:"quantity"`
+	UpdatedAt  string  `json:"updatedAt"`
+	RemindedAt *string `json:"remindedAt,omitempty"`
+}
+
+type AbandonedCartReport struct {
+	IdleSince string           `json:"idleSince"`
+	Count     int              `json:"count"`
+	Carts     []*AbandonedCart `json:"carts"`
+}
+
+type Address struct {
+	ID         string  `json:"id"`
+	City       string  `json:"city"`
+	Street     string  `json:"street"`
+	House      string  `json:"house"`
+	Apartment  *string `json:"apartment,omitempty"`
+	PostalCode *string `json:"postalCode,omitempty"`
+}
+
+type AddressInput struct {
+	City       string  `json:"city"`
+	Street     string  `json:"street"`
+	House      string  `json:"house"`
+	Apartment  *string `json:"apartment,omitempty"`
+	PostalCode *string `json:"postalCode,omitempty"`
+}
+
 type CartInput struct {
 	ItemID   int `json:"itemID"`
 	Quantity int `json:"quantity"`
@@ -16,29 +48,51 @@ type CartInput struct {
 type CartItem struct {
 	Quantity int   `json:"quantity"`
 	Item     *Item `json:"item"`
+	Saved    bool  `json:"saved"`
+}
+
+type CartLine struct {
+	Item     *Item   `json:"item"`
+	Quantity int     `json:"quantity"`
+	Warning  *string `json:"warning,omitempty"`
+	Saved    bool    `json:"saved"`
 }
 
 type Catalog struct {
-	ID       int        `json:"id"`
-	Name     string     `json:"name"`
-	ParentID *int       `json:"parent_id,omitempty"`
-	Childs   []*Catalog `json:"childs"`
-	Items    []*Item    `json:"items"`
+	ID               int          `json:"id"`
+	Name             string       `json:"name"`
+	ParentID         *int         `json:"parent_id,omitempty"`
+	Childs           []*Catalog   `json:"childs"`
+	Items            []*Item      `json:"items"`
+	ReviewPolicy     ReviewPolicy `json:"reviewPolicy"`
+	RatingDimensions []string     `json:"ratingDimensions"`
 }
 
 type CatalogInput struct {
-	CatalogID int          `json:"catalogID"`
-	Name      string       `json:"name"`
-	ParentID  *int         `json:"parentID,omitempty"`
-	Items     []*ItemInput `json:"items,omitempty"`
+	CatalogID    int           `json:"catalogID"`
+	Name         string        `json:"name"`
+	ParentID     *int          `json:"parentID,omitempty"`
+	Items        []*ItemInput  `json:"items,omitempty"`
+	ReviewPolicy *ReviewPolicy `json:"reviewPolicy,omitempty"`
+}
+
+type CheckoutInput struct {
+	Address        *AddressInput  `json:"address,omitempty"`
+	AddressID      *string        `json:"addressID,omitempty"`
+	Recipient      string         `json:"recipient"`
+	Phone          string         `json:"phone"`
+	DeliveryMethod DeliveryMethod `json:"deliveryMethod"`
+	Note           *string        `json:"note,omitempty"`
+	Fingerprint    *string        `json:"fingerprint,omitempty"`
 }
 
 type Comment struct {
-	UserID      int     `json:"userID"`
-	ItemsID     int     `json:"itemsID"`
-	ParentID    *string `json:"parentID,omitempty"`
-	Rate        int     `json:"rate"`
-	CommentText string  `json:"commentText"`
+	UserID           int     `json:"userID"`
+	ItemsID          int     `json:"itemsID"`
+	ParentID         *string `json:"parentID,omitempty"`
+	Rate             int     `json:"rate"`
+	CommentText      string  `json:"commentText"`
+	VerifiedPurchase bool    `json:"verifiedPurchase"`
 }
 
 type CommentInput struct {
@@ -51,55 +105,306 @@ type CommentToCommentInput struct {
 	CommentText string `json:"commentText"`
 }
 
+type CommissionRate struct {
+	SellerID  *int    `json:"sellerID,omitempty"`
+	CatalogID *int    `json:"catalogID,omitempty"`
+	Rate      float64 `json:"rate"`
+}
+
+type CommissionRateInput struct {
+	SellerID  *int    `json:"sellerID,omitempty"`
+	CatalogID *int    `json:"catalogID,omitempty"`
+	Rate      float64 `json:"rate"`
+}
+
+type Delivery struct {
+	Method    DeliveryMethod `json:"method"`
+	Address   *Address       `json:"address,omitempty"`
+	Recipient string         `json:"recipient"`
+	Phone     string         `json:"phone"`
+	Note      *string        `json:"note,omitempty"`
+}
+
+type DimensionRate struct {
+	Name  string  `json:"name"`
+	Rate  float64 `json:"rate"`
+	Count int     `json:"count"`
+}
+
+type DimensionRateInput struct {
+	Name string `json:"name"`
+	Rate int    `json:"rate"`
+}
+
 type Item struct {
-	ID          int      `json:"id"`
-	Name        string   `json:"name"`
-	Seller      *Seller  `json:"seller"`
-	Parent      *Catalog `json:"parent,omitempty"`
-	InStock     int      `json:"in_stock"`
-	InStockText string   `json:"inStockText"`
-	Rate        float64  `json:"rate"`
-	SellerID    int      `json:"seller_id"`
-	InCart      int      `json:"inCart"`
-	CatalogID   int      `json:"catalog_id"`
+	ID                 int              `json:"id"`
+	Name               string           `json:"name"`
+	Seller             *Seller          `json:"seller"`
+	Parent             *Catalog         `json:"parent,omitempty"`
+	InStock            int              `json:"in_stock"`
+	InStockText        string           `json:"inStockText"`
+	Price              float64          `json:"price"`
+	Rate               float64          `json:"rate"`
+	RatingSum          int              `json:"ratingSum"`
+	RatingCount        int              `json:"ratingCount"`
+	BayesianRating     float64          `json:"bayesianRating"`
+	MyRating           *int             `json:"myRating,omitempty"`
+	RatingDistribution []*RatingBucket  `json:"ratingDistribution"`
+	DimensionRates     []*DimensionRate `json:"dimensionRates"`
+	Ratings            []*Rating        `json:"ratings"`
+	SellerID           int              `json:"seller_id"`
+	InCart             int              `json:"inCart"`
+	CatalogID          int              `json:"catalog_id"`
 }
 
 type ItemInput struct {
-	ItemID    int    `json:"itemID"`
-	CatalogID int    `json:"catalogID"`
-	Name      string `json:"name"`
-	SellerID  int    `json:"sellerID"`
-	InStock   int    `json:"inStock"`
+	ItemID    int      `json:"itemID"`
+	CatalogID int      `json:"catalogID"`
+	Name      string   `json:"name"`
+	SellerID  int      `json:"sellerID"`
+	InStock   int      `json:"inStock"`
+	Price     *float64 `json:"price,omitempty"`
+}
+
+type ItemUpdateInput struct {
+	ItemID    int      `json:"itemID"`
+	CatalogID *int     `json:"catalogID,omitempty"`
+	Name      *string  `json:"name,omitempty"`
+	InStock   *int     `json:"inStock,omitempty"`
+	Price     *float64 `json:"price,omitempty"`
+}
+
+type LedgerEntry struct {
+	EntryID        string  `json:"entryID"`
+	Kind           string  `json:"kind"`
+	SellerID       int     `json:"sellerID"`
+	OrderID        *int    `json:"orderID,omitempty"`
+	ItemID         *int    `json:"itemID,omitempty"`
+	Quantity       *int    `json:"quantity,omitempty"`
+	Gross          float64 `json:"gross"`
+	CommissionRate float64 `json:"commissionRate"`
+	Commission     float64 `json:"commission"`
+	Net            float64 `json:"net"`
+	CreatedAt      string  `json:"createdAt"`
 }
 
 type Mutation struct {
 }
 
 type MyCart struct {
-	Items    []*Item `json:"items"`
-	Quantity int     `json:"quantity"`
+	Items    []*Item     `json:"items"`
+	Quantity int         `json:"quantity"`
+	Lines    []*CartLine `json:"lines"`
+	Total    float64     `json:"total"`
 }
 
 type Order struct {
-	UserID  int         `json:"userID"`
-	OrderID int         `json:"orderID"`
-	Items   []*CartItem `json:"items"`
-	Status  string      `json:"status"`
+	UserID        int                  `json:"userID"`
+	OrderID       int                  `json:"orderID"`
+	Number        string               `json:"number"`
+	CreatedAt     string               `json:"createdAt"`
+	Items         []*CartItem          `json:"items"`
+	Total         float64              `json:"total"`
+	Status        OrderStatus          `json:"status"`
+	StatusHistory []*OrderStatusChange `json:"statusHistory"`
+	Shipments     []*Shipment          `json:"shipments"`
+	Delivery      *Delivery            `json:"delivery,omitempty"`
+}
+
+type OrderFilter struct {
+	Status      []OrderStatus `json:"status,omitempty"`
+	CreatedFrom *string       `json:"createdFrom,omitempty"`
+	CreatedTo   *string       `json:"createdTo,omitempty"`
+	UserID      *int          `json:"userID,omitempty"`
+	SellerID    *int          `json:"sellerID,omitempty"`
+	ItemID      *int          `json:"itemID,omitempty"`
+	MinTotal    *float64      `json:"minTotal,omitempty"`
+	MaxTotal    *float64      `json:"maxTotal,omitempty"`
+}
+
+type OrderPage struct {
+	Orders      []*Order `json:"orders"`
+	TotalCount  int      `json:"totalCount"`
+	EndCursor   *string  `json:"endCursor,omitempty"`
+	HasNextPage bool     `json:"hasNextPage"`
+}
+
+type OrderPreview struct {
+	Lines       []*PreviewLine `json:"lines"`
+	Quantity    int            `json:"quantity"`
+	Total       float64        `json:"total"`
+	Fingerprint string         `json:"fingerprint"`
+}
+
+type OrderStatusChange struct {
+	Status OrderStatus `json:"status"`
+	At     string      `json:"at"`
+	Actor  string      `json:"actor"`
+	Note   *string     `json:"note,omitempty"`
+}
+
+type PaymentSession struct {
+	PaymentID       string  `json:"paymentID"`
+	Provider        string  `json:"provider"`
+	Amount          float64 `json:"amount"`
+	ConfirmationURL string  `json:"confirmationURL"`
+}
+
+type PeriodInput struct {
+	From *string `json:"from,omitempty"`
+	To   *string `json:"to,omitempty"`
+}
+
+type PreviewLine struct {
+	ItemID    int               `json:"itemID"`
+	Item      *Item             `json:"item,omitempty"`
+	Status    PreviewLineStatus `json:"status"`
+	Requested int               `json:"requested"`
+	Available int               `json:"available"`
+	CartPrice float64           `json:"cartPrice"`
+	Price     float64           `json:"price"`
+	Total     float64           `json:"total"`
 }
 
 type Query struct {
 }
 
 type RateInput struct {
-	ItemID int `json:"itemID"`
-	Rate   int `json:"rate"`
+	ItemID     int                   `json:"itemID"`
+	Rate       int                   `json:"rate"`
+	Dimensions []*DimensionRateInput `json:"dimensions,omitempty"`
+}
+
+type Rating struct {
+	UserID           int  `json:"userID"`
+	ItemID           int  `json:"itemID"`
+	Rate             int  `json:"rate"`
+	VerifiedPurchase bool `json:"verifiedPurchase"`
+}
+
+type RatingBucket struct {
+	Rate  int `json:"rate"`
+	Count int `json:"count"`
+}
+
+type ReturnInput struct {
+	OrderID int                `json:"orderID"`
+	Lines   []*ReturnLineInput `json:"lines"`
+	Reason  string             `json:"reason"`
+	Photos  []string           `json:"photos,omitempty"`
+}
+
+type ReturnLine struct {
+	ItemID   int     `json:"itemID"`
+	Quantity int     `json:"quantity"`
+	Price    float64 `json:"price"`
+}
+
+type ReturnLineInput struct {
+	ItemID   int `json:"itemID"`
+	Quantity int `json:"quantity"`
+}
+
+type ReturnRequest struct {
+	ID           string        `json:"id"`
+	OrderID      int           `json:"orderID"`
+	UserID       int           `json:"userID"`
+	Lines        []*ReturnLine `json:"lines"`
+	Reason       string        `json:"reason"`
+	Photos       []string      `json:"photos"`
+	Status       ReturnStatus  `json:"status"`
+	Note         *string       `json:"note,omitempty"`
+	RefundAmount float64       `json:"refundAmount"`
+	RefundID     *string       `json:"refundID,omitempty"`
+	CreatedAt    string        `json:"createdAt"`
 }
 
 type Seller struct {
-	ID      int     `json:"id"`
-	Name    string  `json:"name"`
-	ItemIds []int   `json:"item_ids"`
-	Items   []*Item `json:"items"`
+	ID          int             `json:"id"`
+	Name        string          `json:"name"`
+	Deals       int             `json:"deals"`
+	ItemIds     []int           `json:"item_ids"`
+	Items       []*Item         `json:"items"`
+	Deactivated bool            `json:"deactivated"`
+	Stats       *SellerStats    `json:"stats"`
+	Rating      float64         `json:"rating"`
+	Reviews     []*SellerReview `json:"reviews"`
+}
+
+type SellerBalance struct {
+	SellerID   int            `json:"sellerID"`
+	From       *string        `json:"from,omitempty"`
+	To         *string        `json:"to,omitempty"`
+	Gross      float64        `json:"gross"`
+	Commission float64        `json:"commission"`
+	Net        float64        `json:"net"`
+	PaidOut    float64        `json:"paidOut"`
+	Balance    float64        `json:"balance"`
+	Entries    []*LedgerEntry `json:"entries"`
+}
+
+type SellerFilter struct {
+	Name        *string `json:"name,omitempty"`
+	Deactivated *bool   `json:"deactivated,omitempty"`
+}
+
+type SellerInput struct {
+	SellerID int    `json:"sellerID"`
+	Name     string `json:"name"`
+}
+
+type SellerReview struct {
+	ID        string `json:"id"`
+	UserID    int    `json:"userID"`
+	SellerID  int    `json:"sellerID"`
+	OrderID   int    `json:"orderID"`
+	Rate      int    `json:"rate"`
+	Text      string `json:"text"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type SellerReviewInput struct {
+	SellerID int     `json:"sellerID"`
+	OrderID  int     `json:"orderID"`
+	Rate     int     `json:"rate"`
+	Text     *string `json:"text,omitempty"`
+}
+
+type SellerStats struct {
+	ItemCount      int     `json:"itemCount"`
+	UnitsInStock   int     `json:"unitsInStock"`
+	CompletedDeals int     `json:"completedDeals"`
+	Revenue        float64 `json:"revenue"`
+	AverageRating  float64 `json:"averageRating"`
+}
+
+type SellerUser struct {
+	UserID   int `json:"userID"`
+	SellerID int `json:"sellerID"`
+}
+
+type SellerUserInput struct {
+	UserID   int `json:"userID"`
+	SellerID int `json:"sellerID"`
+}
+
+type Shipment struct {
+	ShipmentID     string      `json:"shipmentID"`
+	OrderID        int         `json:"orderID"`
+	SellerID       int         `json:"sellerID"`
+	Items          []*CartItem `json:"items"`
+	Status         string      `json:"status"`
+	TrackingNumber *string     `json:"trackingNumber,omitempty"`
+}
+
+type ShipmentInput struct {
+	OrderID        int     `json:"orderID"`
+	SellerID       int     `json:"sellerID"`
+	Status         *string `json:"status,omitempty"`
+	TrackingNumber *string `json:"trackingNumber,omitempty"`
+}
+
+type Subscription struct {
 }
 
 type UserInfo struct {
@@ -112,23 +417,340 @@ type UserRole struct {
 	RoleID int `json:"roleID"`
 }
 
+type DeliveryMethod string
+
+const (
+	DeliveryMethodCourier DeliveryMethod = "courier"
+	DeliveryMethodPost    DeliveryMethod = "post"
+	DeliveryMethodPickup  DeliveryMethod = "pickup"
+)
+
+var AllDeliveryMethod = []DeliveryMethod{
+	DeliveryMethodCourier,
+	DeliveryMethodPost,
+	DeliveryMethodPickup,
+}
+
+func (e DeliveryMethod) IsValid() bool {
+	switch e {
+	case DeliveryMethodCourier, DeliveryMethodPost, DeliveryMethodPickup:
+		return true
+	}
+	return false
+}
+
+func (e DeliveryMethod) String() string {
+	return string(e)
+}
+
+func (e *DeliveryMethod) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = DeliveryMethod(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid DeliveryMethod", str)
+	}
+	return nil
+}
+
+func (e DeliveryMethod) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ItemSort string
+
+const (
+	ItemSortDefault  ItemSort = "default"
+	ItemSortTopRated ItemSort = "topRated"
+)
+
+var AllItemSort = []ItemSort{
+	ItemSortDefault,
+	ItemSortTopRated,
+}
+
+func (e ItemSort) IsValid() bool {
+	switch e {
+	case ItemSortDefault, ItemSortTopRated:
+		return true
+	}
+	return false
+}
+
+func (e ItemSort) String() string {
+	return string(e)
+}
+
+func (e *ItemSort) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ItemSort(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ItemSort", str)
+	}
+	return nil
+}
+
+func (e ItemSort) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type OrderSort string
+
+const (
+	OrderSortNewest    OrderSort = "newest"
+	OrderSortOldest    OrderSort = "oldest"
+	OrderSortTotalAsc  OrderSort = "totalAsc"
+	OrderSortTotalDesc OrderSort = "totalDesc"
+)
+
+var AllOrderSort = []OrderSort{
+	OrderSortNewest,
+	OrderSortOldest,
+	OrderSortTotalAsc,
+	OrderSortTotalDesc,
+}
+
+func (e OrderSort) IsValid() bool {
+	switch e {
+	case OrderSortNewest, OrderSortOldest, OrderSortTotalAsc, OrderSortTotalDesc:
+		return true
+	}
+	return false
+}
+
+func (e OrderSort) String() string {
+	return string(e)
+}
+
+func (e *OrderSort) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrderSort(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrderSort", str)
+	}
+	return nil
+}
+
+func (e OrderSort) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type OrderStatus string
+
+const (
+	OrderStatusCreated       OrderStatus = "created"
+	OrderStatusPaymentFailed OrderStatus = "payment_failed"
+	OrderStatusPaid          OrderStatus = "paid"
+	OrderStatusAssembling    OrderStatus = "assembling"
+	OrderStatusShipped       OrderStatus = "shipped"
+	OrderStatusDelivered     OrderStatus = "delivered"
+	OrderStatusCancelled     OrderStatus = "cancelled"
+	OrderStatusReturned      OrderStatus = "returned"
+)
+
+var AllOrderStatus = []OrderStatus{
+	OrderStatusCreated,
+	OrderStatusPaymentFailed,
+	OrderStatusPaid,
+	OrderStatusAssembling,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+	OrderStatusReturned,
+}
+
+func (e OrderStatus) IsValid() bool {
+	switch e {
+	case OrderStatusCreated, OrderStatusPaymentFailed, OrderStatusPaid, OrderStatusAssembling, OrderStatusShipped, OrderStatusDelivered, OrderStatusCancelled, OrderStatusReturned:
+		return true
+	}
+	return false
+}
+
+func (e OrderStatus) String() string {
+	return string(e)
+}
+
+func (e *OrderStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrderStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrderStatus", str)
+	}
+	return nil
+}
+
+func (e OrderStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type PreviewLineStatus string
+
+const (
+	PreviewLineStatusOk              PreviewLineStatus = "ok"
+	PreviewLineStatusQuantityReduced PreviewLineStatus = "quantityReduced"
+	PreviewLineStatusUnavailable     PreviewLineStatus = "unavailable"
+	PreviewLineStatusPriceChanged    PreviewLineStatus = "priceChanged"
+)
+
+var AllPreviewLineStatus = []PreviewLineStatus{
+	PreviewLineStatusOk,
+	PreviewLineStatusQuantityReduced,
+	PreviewLineStatusUnavailable,
+	PreviewLineStatusPriceChanged,
+}
+
+func (e PreviewLineStatus) IsValid() bool {
+	switch e {
+	case PreviewLineStatusOk, PreviewLineStatusQuantityReduced, PreviewLineStatusUnavailable, PreviewLineStatusPriceChanged:
+		return true
+	}
+	return false
+}
+
+func (e PreviewLineStatus) String() string {
+	return string(e)
+}
+
+func (e *PreviewLineStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = PreviewLineStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid PreviewLineStatus", str)
+	}
+	return nil
+}
+
+func (e PreviewLineStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ReturnStatus string
+
+const (
+	ReturnStatusRequested ReturnStatus = "requested"
+	ReturnStatusApproved  ReturnStatus = "approved"
+	ReturnStatusRejected  ReturnStatus = "rejected"
+	ReturnStatusReceived  ReturnStatus = "received"
+	ReturnStatusRefunded  ReturnStatus = "refunded"
+)
+
+var AllReturnStatus = []ReturnStatus{
+	ReturnStatusRequested,
+	ReturnStatusApproved,
+	ReturnStatusRejected,
+	ReturnStatusReceived,
+	ReturnStatusRefunded,
+}
+
+func (e ReturnStatus) IsValid() bool {
+	switch e {
+	case ReturnStatusRequested, ReturnStatusApproved, ReturnStatusRejected, ReturnStatusReceived, ReturnStatusRefunded:
+		return true
+	}
+	return false
+}
+
+func (e ReturnStatus) String() string {
+	return string(e)
+}
+
+func (e *ReturnStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ReturnStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ReturnStatus", str)
+	}
+	return nil
+}
+
+func (e ReturnStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ReviewPolicy string
+
+const (
+	ReviewPolicyOpen   ReviewPolicy = "open"
+	ReviewPolicyStrict ReviewPolicy = "strict"
+)
+
+var AllReviewPolicy = []ReviewPolicy{
+	ReviewPolicyOpen,
+	ReviewPolicyStrict,
+}
+
+func (e ReviewPolicy) IsValid() bool {
+	switch e {
+	case ReviewPolicyOpen, ReviewPolicyStrict:
+		return true
+	}
+	return false
+}
+
+func (e ReviewPolicy) String() string {
+	return string(e)
+}
+
+func (e *ReviewPolicy) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ReviewPolicy(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ReviewPolicy", str)
+	}
+	return nil
+}
+
+func (e ReviewPolicy) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
 type Role string
 
 const (
 	RoleAdmin     Role = "admin"
 	RoleUser      Role = "user"
 	RoleSuperuser Role = "superuser"
+	RoleSeller    Role = "seller"
 )
 
 var AllRole = []Role{
 	RoleAdmin,
 	RoleUser,
 	RoleSuperuser,
+	RoleSeller,
 }
 
 func (e Role) IsValid() bool {
 	switch e {
-	case RoleAdmin, RoleUser, RoleSuperuser:
+	case RoleAdmin, RoleUser, RoleSuperuser, RoleSeller:
 		return true
 	}
 	return false
@@ -0,0 +1,20 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/pkg/cart"
+	"hw11_shopql/pkg/guest"
+	"hw11_shopql/pkg/utils/sessionutils"
+)
+
+// cartOwner picks the cart of the logged in user, otherwise the guest cart
+func cartOwner(ctx context.Context) (cart.Owner, error) {
+	if userID, err := sessionutils.IdFromContex(ctx); err == nil {
+		return cart.UserOwner(userID), nil
+	}
+	if guestID, ok := guest.IdFromContext(ctx); ok {
+		return cart.GuestOwner(guestID), nil
+	}
+	return cart.Owner{}, fmt.Errorf("User not authorized")
+}
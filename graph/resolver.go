@@ -4,19 +4,34 @@ package graph
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 import (
+	"hw11_shopql/pkg/address"
 	"hw11_shopql/pkg/cart"
 	"hw11_shopql/pkg/catalog"
 	"hw11_shopql/pkg/item"
 	"hw11_shopql/pkg/order"
+	"hw11_shopql/pkg/payment"
+	"hw11_shopql/pkg/payout"
+	"hw11_shopql/pkg/policy"
+	"hw11_shopql/pkg/pubsub"
+	"hw11_shopql/pkg/rma"
 	"hw11_shopql/pkg/role"
 	"hw11_shopql/pkg/seller"
+	"hw11_shopql/pkg/sellerreview"
 )
 
 type Resolver struct {
-	RoleRepo    role.RoleRepoI
-	CatalogRepo catalog.CataloRepoInrerface
-	ItemRepo    item.ItemRepoInterface
-	SellerRepo  seller.SellerRepoInterface
-	CartRepo    cart.CartRepoInterface
-	OrderRepo   order.OrderRepoInterface
+	RoleRepo     role.RoleRepoI
+	CatalogRepo  catalog.CataloRepoInrerface
+	ItemRepo     item.ItemRepoInterface
+	SellerRepo   seller.SellerRepoInterface
+	SellerStats  seller.SellerStatsRepoInterface
+	SellerReview sellerreview.SellerReviewRepoInterface
+	PayoutRepo   payout.PayoutRepoInterface
+	CartRepo     cart.CartRepoInterface
+	OrderRepo    order.OrderRepoInterface
+	AddressRepo  address.AddressRepoInterface
+	PaymentRepo  payment.PaymentRepoInterface
+	ReturnRepo   rma.ReturnRepoInterface
+	Events       pubsub.Bus
+	ReviewPolicy policy.ReviewPolicyInterface
 }
@@ -8,13 +8,20 @@ import (
 	"context"
 	"fmt"
 	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/cart"
+	"hw11_shopql/pkg/order"
+	"hw11_shopql/pkg/payout"
+	"hw11_shopql/pkg/rate"
+	"hw11_shopql/pkg/sellerreview"
 	"hw11_shopql/pkg/session"
 	"hw11_shopql/pkg/utils/sessionutils"
+	"sort"
 	"strconv"
+	"time"
 )
 
 // Items is the resolver for the items field.
-func (r *catalogResolver) Items(ctx context.Context, obj *model.Catalog, limit *int, offset *int) ([]*model.Item, error) {
+func (r *catalogResolver) Items(ctx context.Context, obj *model.Catalog, limit *int, offset *int, sort *model.ItemSort) ([]*model.Item, error) {
 	if limit == nil {
 		x := 3
 		limit = &x
@@ -23,13 +30,38 @@ func (r *catalogResolver) Items(ctx context.Context, obj *model.Catalog, limit *
 		y := 0
 		offset = &y
 	}
-	items, err := r.ItemRepo.GetItemsByCatalogID(context.Background(), obj.ID, *limit, *offset)
+	if sort == nil {
+		s := model.ItemSortDefault
+		sort = &s
+	}
+	hiddenSellers, err := r.SellerRepo.DeactivatedSellerIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := r.ItemRepo.GetItemsByCatalogID(context.Background(), obj.ID, *limit, *offset, *sort, hiddenSellers)
 	if err != nil {
 		return nil, err
 	}
 	return items, err
 }
 
+// ReviewPolicy is the resolver for the reviewPolicy field.
+func (r *catalogResolver) ReviewPolicy(ctx context.Context, obj *model.Catalog) (model.ReviewPolicy, error) {
+	if !obj.ReviewPolicy.IsValid() {
+		return model.ReviewPolicyOpen, nil
+	}
+	return obj.ReviewPolicy, nil
+}
+
+// RatingDimensions is the resolver for the ratingDimensions field.
+func (r *catalogResolver) RatingDimensions(ctx context.Context, obj *model.Catalog) ([]string, error) {
+	dimensions, err := r.CatalogRepo.RatingDimensions(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	return dimensions, nil
+}
+
 // Seller is the resolver for the seller field.
 func (r *itemResolver) Seller(ctx context.Context, obj *model.Item) (*model.Seller, error) {
 	seller, err := r.SellerRepo.LookupSellerById(ctx, obj.SellerID)
@@ -56,19 +88,91 @@ func (r *itemResolver) Parent(ctx context.Context, obj *model.Item) (*model.Cata
 
 // Rate is the resolver for the rate field.
 func (r *itemResolver) Rate(ctx context.Context, obj *model.Item) (float64, error) {
-	rate, err := r.ItemRepo.ItemsRate(ctx, obj.ID)
+	if obj.RatingCount == 0 {
+		return 0, nil
+	}
+	return float64(obj.RatingSum) / float64(obj.RatingCount), nil
+}
+
+// MyRating is the resolver for the myRating field.
+func (r *itemResolver) MyRating(ctx context.Context, obj *model.Item) (*int, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
 	if err != nil {
-		fmt.Println(err)
-		return 0, err
+		return nil, nil
+	}
+	rate, err := r.ItemRepo.UserRate(ctx, userID, obj.ID)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println(rate)
 	return rate, nil
 }
 
+// RatingDistribution is the resolver for the ratingDistribution field.
+func (r *itemResolver) RatingDistribution(ctx context.Context, obj *model.Item) ([]*model.RatingBucket, error) {
+	stats, err := r.ItemRepo.ItemsRateStats(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	distribution := make([]*model.RatingBucket, 0, len(stats.Distribution))
+	for rate, count := range stats.Distribution {
+		distribution = append(distribution, &model.RatingBucket{Rate: rate, Count: count})
+	}
+	sort.Slice(distribution, func(i, j int) bool {
+		return distribution[i].Rate < distribution[j].Rate
+	})
+	return distribution, nil
+}
+
+// DimensionRates is the resolver for the dimensionRates field.
+func (r *itemResolver) DimensionRates(ctx context.Context, obj *model.Item) ([]*model.DimensionRate, error) {
+	stats, err := r.ItemRepo.ItemsDimensionRates(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	dimensionRates := make([]*model.DimensionRate, 0, len(stats))
+	for _, dimension := range stats {
+		dimensionRates = append(dimensionRates, &model.DimensionRate{
+			Name:  dimension.Name,
+			Rate:  dimension.Avg,
+			Count: dimension.Count,
+		})
+	}
+	return dimensionRates, nil
+}
+
+// Ratings is the resolver for the ratings field.
+func (r *itemResolver) Ratings(ctx context.Context, obj *model.Item, limit *int, offset *int) ([]*model.Rating, error) {
+	if limit == nil {
+		x := 3
+		limit = &x
+	}
+	if offset == nil {
+		y := 0
+		offset = &y
+	}
+	rates, err := r.ItemRepo.ItemRates(ctx, obj.ID, *limit, *offset)
+	if err != nil {
+		return nil, err
+	}
+	ratings := make([]*model.Rating, 0, len(rates))
+	for _, rate := range rates {
+		ratings = append(ratings, &model.Rating{
+			UserID:           rate.UserID,
+			ItemID:           rate.ItemID,
+			Rate:             rate.Rate,
+			VerifiedPurchase: rate.Verified,
+		})
+	}
+	return ratings, nil
+}
+
 // InCart is the resolver for the inCart field.
 func (r *itemResolver) InCart(ctx context.Context, obj *model.Item) (int, error) {
-	session := ctx.Value("tokens").(*session.Session)
-	cart, err := r.CartRepo.GetCartsItem(ctx, int(session.UserID), obj.ID)
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return 0, nil
+	}
+	cart, err := r.CartRepo.GetCartsItem(ctx, owner, obj.ID)
 	if err != nil {
 		return 0, nil
 	}
@@ -78,7 +182,28 @@ func (r *itemResolver) InCart(ctx context.Context, obj *model.Item) (int, error)
 // RateItem is the resolver for the RateItem field.
 func (r *mutationResolver) RateItem(ctx context.Context, in *model.RateInput) (*model.Item, error) {
 	session := ctx.Value("tokens").(*session.Session)
-	item, err := r.ItemRepo.RateItem(ctx, int(session.UserID), in.ItemID, in.Rate)
+	verified, err := r.ReviewPolicy.CheckReview(ctx, int(session.UserID), in.ItemID)
+	if err != nil {
+		return nil, err
+	}
+	var dimensions []rate.DimensionRate
+	if len(in.Dimensions) > 0 {
+		item, err := r.ItemRepo.GetItemByID(ctx, in.ItemID)
+		if err != nil {
+			return nil, err
+		}
+		allowed, err := r.CatalogRepo.RatingDimensions(ctx, item.CatalogID)
+		if err != nil {
+			return nil, err
+		}
+		for _, dimension := range in.Dimensions {
+			dimensions = append(dimensions, rate.DimensionRate{Name: dimension.Name, Rate: dimension.Rate})
+		}
+		if err := rate.CheckDimensions(allowed, dimensions); err != nil {
+			return nil, err
+		}
+	}
+	item, err := r.ItemRepo.RateItem(ctx, int(session.UserID), in.ItemID, in.Rate, verified, dimensions)
 	if err != nil {
 		return nil, err
 	}
@@ -87,12 +212,15 @@ func (r *mutationResolver) RateItem(ctx context.Context, in *model.RateInput) (*
 
 // AddToCart is the resolver for the AddToCart field.
 func (r *mutationResolver) AddToCart(ctx context.Context, in *model.CartInput) ([]*model.CartItem, error) {
-	session := ctx.Value("tokens").(*session.Session)
-	err := r.CartRepo.AddItem(ctx, in, int(session.UserID))
+	owner, err := cartOwner(ctx)
 	if err != nil {
 		return nil, err
 	}
-	cartItems, err := r.CartRepo.GetCartItems(ctx, int(session.UserID))
+	err = r.CartRepo.AddItem(ctx, in, owner)
+	if err != nil {
+		return nil, err
+	}
+	cartItems, err := r.CartRepo.CartItems(ctx, owner)
 	if err != nil {
 		panic(err)
 	}
@@ -101,22 +229,94 @@ func (r *mutationResolver) AddToCart(ctx context.Context, in *model.CartInput) (
 
 // RemoveFromCart is the resolver for the RemoveFromCart field.
 func (r *mutationResolver) RemoveFromCart(ctx context.Context, in *model.CartInput) ([]*model.CartItem, error) {
-	session := ctx.Value("tokens").(*session.Session)
-	err := r.CartRepo.RemoveFromCartItem(ctx, in, int(session.UserID))
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.RemoveFromCartItem(ctx, in, owner)
 	if err != nil {
 		return nil, err
 	}
-	cartItems, err := r.CartRepo.GetCartItems(ctx, int(session.UserID))
+	cartItems, err := r.CartRepo.CartItems(ctx, owner)
 	if err != nil {
 		panic(err)
 	}
 	return cartItems, err
 }
 
+// SetCartItemQuantity is the resolver for the SetCartItemQuantity field.
+func (r *mutationResolver) SetCartItemQuantity(ctx context.Context, in model.CartInput) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.SetCartItemQuantity(ctx, &in, owner)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
+// UpdateCart is the resolver for the UpdateCart field.
+func (r *mutationResolver) UpdateCart(ctx context.Context, in []*model.CartInput) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.UpdateCart(ctx, in, owner)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
+// ClearCart is the resolver for the ClearCart field.
+func (r *mutationResolver) ClearCart(ctx context.Context) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.ClearCart(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
+// MoveToSaved is the resolver for the MoveToSaved field.
+func (r *mutationResolver) MoveToSaved(ctx context.Context, itemID int) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.MoveToSaved(ctx, owner, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
+// MoveToCart is the resolver for the MoveToCart field.
+func (r *mutationResolver) MoveToCart(ctx context.Context, itemID int) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.CartRepo.MoveToCart(ctx, owner, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
 // AddCommentToItem is the resolver for the AddCommentToItem field.
 func (r *mutationResolver) AddCommentToItem(ctx context.Context, in *model.CommentInput) (*model.Comment, error) {
 	userID := ctx.Value("tokens").(*session.Session).UserID
-	comment, err := r.ItemRepo.AddComment(ctx, int(userID), in.ItemID, in.CommentText)
+	verified, err := r.ReviewPolicy.CheckReview(ctx, int(userID), in.ItemID)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := r.ItemRepo.AddComment(ctx, int(userID), in.ItemID, in.CommentText, verified)
 	if err != nil {
 		return nil, err
 	}
@@ -126,26 +326,174 @@ func (r *mutationResolver) AddCommentToItem(ctx context.Context, in *model.Comme
 // AddCommentToComment is the resolver for the AddCommentToComment field.
 func (r *mutationResolver) AddCommentToComment(ctx context.Context, in *model.CommentToCommentInput) (*model.Comment, error) {
 	userID := ctx.Value("tokens").(*session.Session).UserID
-	comment, err := r.ItemRepo.AddCommentToCommnet(ctx, int(userID), in.CommentID, in.CommentText)
+	itemID, err := r.ItemRepo.CommentItemID(ctx, in.CommentID)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := r.ReviewPolicy.CheckReview(ctx, int(userID), itemID)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := r.ItemRepo.AddCommentToCommnet(ctx, int(userID), in.CommentID, in.CommentText, verified)
 	if err != nil {
 		return nil, err
 	}
 	return comment, nil
 }
 
+// ReviewSeller is the resolver for the ReviewSeller field.
+func (r *mutationResolver) ReviewSeller(ctx context.Context, in model.SellerReviewInput) (*model.SellerReview, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userOrder, err := r.OrderRepo.OrderByID(ctx, in.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if userOrder.UserID != userID || !order.CompletedForSeller(userOrder, in.SellerID) {
+		return nil, fmt.Errorf("seller can be reviewed only after a completed order")
+	}
+	review := sellerreview.SellerReview{
+		UserID:   userID,
+		SellerID: in.SellerID,
+		OrderID:  in.OrderID,
+		Rate:     in.Rate,
+	}
+	if in.Text != nil {
+		review.Text = *in.Text
+	}
+	saved, err := r.SellerReview.ReviewSeller(ctx, review)
+	if err != nil {
+		return nil, err
+	}
+	return sellerReviewToModel(saved), nil
+}
+
+// UpdateShipment is the resolver for the UpdateShipment field.
+func (r *mutationResolver) UpdateShipment(ctx context.Context, in model.ShipmentInput) (*model.Shipment, error) {
+	shipment, err := r.OrderRepo.UpdateShipment(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return shipment, nil
+}
+
 // CreateAnOrder is the resolver for the CreateAnOrder field.
-func (r *mutationResolver) CreateAnOrder(ctx context.Context, in *string) (*model.Order, error) {
+func (r *mutationResolver) CreateAnOrder(ctx context.Context, in model.CheckoutInput) (*model.Order, error) {
 	userID, err := sessionutils.IdFromContex(ctx)
 	if err != nil {
 		return nil, err
 	}
-	order, err := r.OrderRepo.CreateOrder(ctx, userID)
+	delivery, err := r.checkoutDelivery(ctx, userID, in)
+	if err != nil {
+		return nil, err
+	}
+	expected := ""
+	if in.Fingerprint != nil {
+		expected = *in.Fingerprint
+	}
+	order, err := r.OrderRepo.CreateOrder(ctx, userID, delivery, expected)
 	if err != nil {
 		return nil, err
 	}
 	return order, nil
 }
 
+// AddAddress is the resolver for the AddAddress field.
+func (r *mutationResolver) AddAddress(ctx context.Context, in model.AddressInput) (*model.Address, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := r.AddressRepo.AddAddress(ctx, addressFromInput(userID, &in))
+	if err != nil {
+		return nil, err
+	}
+	return addressToModel(addr), nil
+}
+
+// UpdateOrderStatus is the resolver for the UpdateOrderStatus field.
+func (r *mutationResolver) UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, note *string) (*model.Order, error) {
+	adminID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.OrderRepo.UpdateOrderStatus(ctx, orderID, status, order.AdminActor(adminID), note)
+}
+
+// CancelOrder is the resolver for the CancelOrder field.
+func (r *mutationResolver) CancelOrder(ctx context.Context, orderID int, reason *string) (*model.Order, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admin := r.RoleRepo.HasRole(userID, model.RoleAdmin.String())
+	return r.OrderRepo.CancelOrder(ctx, orderID, userID, admin, reason)
+}
+
+// StartPayment is the resolver for the StartPayment field.
+func (r *mutationResolver) StartPayment(ctx context.Context, orderID int) (*model.PaymentSession, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := r.PaymentRepo.StartPayment(ctx, orderID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.PaymentSession{
+		PaymentID:       session.PaymentID,
+		Provider:        session.Provider,
+		Amount:          session.Amount,
+		ConfirmationURL: session.ConfirmationURL,
+	}, nil
+}
+
+// OpenReturn is the resolver for the OpenReturn field.
+func (r *mutationResolver) OpenReturn(ctx context.Context, in model.ReturnInput) (*model.ReturnRequest, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := r.ReturnRepo.OpenReturn(ctx, userID, in)
+	if err != nil {
+		return nil, err
+	}
+	return returnToModel(ret), nil
+}
+
+// ApproveReturn is the resolver for the ApproveReturn field.
+func (r *mutationResolver) ApproveReturn(ctx context.Context, id string, note *string) (*model.ReturnRequest, error) {
+	ret, err := r.ReturnRepo.ApproveReturn(ctx, id, note)
+	if err != nil {
+		return nil, err
+	}
+	return returnToModel(ret), nil
+}
+
+// RejectReturn is the resolver for the RejectReturn field.
+func (r *mutationResolver) RejectReturn(ctx context.Context, id string, note *string) (*model.ReturnRequest, error) {
+	ret, err := r.ReturnRepo.RejectReturn(ctx, id, note)
+	if err != nil {
+		return nil, err
+	}
+	return returnToModel(ret), nil
+}
+
+// ReceiveReturn is the resolver for the ReceiveReturn field.
+func (r *mutationResolver) ReceiveReturn(ctx context.Context, id string) (*model.ReturnRequest, error) {
+	adminID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := r.ReturnRepo.ReceiveReturn(ctx, id, order.AdminActor(adminID))
+	if err != nil {
+		return nil, err
+	}
+	return returnToModel(ret), nil
+}
+
 // AddItem is the resolver for the AddItem field.
 func (r *mutationResolver) AddItem(ctx context.Context, in model.ItemInput) (*model.Item, error) {
 	item, err := r.ItemRepo.AddItem(ctx, in)
@@ -155,6 +503,24 @@ func (r *mutationResolver) AddItem(ctx context.Context, in model.ItemInput) (*mo
 	return item, nil
 }
 
+// UpdateItem is the resolver for the UpdateItem field.
+func (r *mutationResolver) UpdateItem(ctx context.Context, in model.ItemUpdateInput) (*model.Item, error) {
+	item, err := r.ItemRepo.UpdateItem(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// RestockItem is the resolver for the RestockItem field.
+func (r *mutationResolver) RestockItem(ctx context.Context, itemID int, quantity int) (*model.Item, error) {
+	item, err := r.ItemRepo.RestockItem(ctx, itemID, quantity)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
 // AddCatalog is the resolver for the AddCatalog field.
 func (r *mutationResolver) AddCatalog(ctx context.Context, in model.CatalogInput) (*model.Catalog, error) {
 	catalog, err := r.CatalogRepo.AddCatalogWithItems(ctx, in)
@@ -164,13 +530,100 @@ func (r *mutationResolver) AddCatalog(ctx context.Context, in model.CatalogInput
 	return catalog, nil
 }
 
+// SetCatalogReviewPolicy is the resolver for the SetCatalogReviewPolicy field.
+func (r *mutationResolver) SetCatalogReviewPolicy(ctx context.Context, catalogID int, policy model.ReviewPolicy) (*model.Catalog, error) {
+	catalog, err := r.CatalogRepo.SetReviewPolicy(ctx, catalogID, policy)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// SetCatalogRatingDimensions is the resolver for the SetCatalogRatingDimensions field.
+func (r *mutationResolver) SetCatalogRatingDimensions(ctx context.Context, catalogID int, dimensions []string) (*model.Catalog, error) {
+	catalog, err := r.CatalogRepo.SetRatingDimensions(ctx, catalogID, dimensions)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// AddSeller is the resolver for the AddSeller field.
+func (r *mutationResolver) AddSeller(ctx context.Context, in model.SellerInput) (*model.Seller, error) {
+	seller := model.Seller{
+		ID:   in.SellerID,
+		Name: in.Name,
+	}
+	err := r.SellerRepo.InsertSeller(ctx, seller)
+	if err != nil {
+		return nil, err
+	}
+	return &seller, nil
+}
+
+// UpdateSeller is the resolver for the UpdateSeller field.
+func (r *mutationResolver) UpdateSeller(ctx context.Context, in model.SellerInput) (*model.Seller, error) {
+	seller, err := r.SellerRepo.UpdateSeller(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return seller, nil
+}
+
+// DeactivateSeller is the resolver for the DeactivateSeller field.
+func (r *mutationResolver) DeactivateSeller(ctx context.Context, id int) (*model.Seller, error) {
+	seller, err := r.SellerRepo.DeactivateSeller(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return seller, nil
+}
+
+// AddSellerForUser is the resolver for the AddSellerForUser field.
+func (r *mutationResolver) AddSellerForUser(ctx context.Context, in model.SellerUserInput) (*model.SellerUser, error) {
+	exist, err := r.SellerRepo.SellerExists(ctx, in.SellerID)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("seller not exist")
+	}
+	err = r.RoleRepo.AddSellerForUser(in.UserID, in.SellerID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.SellerUser{UserID: in.UserID, SellerID: in.SellerID}, nil
+}
+
+// SetCommissionRate is the resolver for the SetCommissionRate field.
+func (r *mutationResolver) SetCommissionRate(ctx context.Context, in model.CommissionRateInput) (*model.CommissionRate, error) {
+	rate, err := r.PayoutRepo.SetCommissionRate(ctx, payout.CommissionRate{
+		SellerID:  in.SellerID,
+		CatalogID: in.CatalogID,
+		Rate:      in.Rate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &model.CommissionRate{SellerID: rate.SellerID, CatalogID: rate.CatalogID, Rate: rate.Rate}, nil
+}
+
+// CreatePayout is the resolver for the CreatePayout field.
+func (r *mutationResolver) CreatePayout(ctx context.Context, sellerID int) (*model.LedgerEntry, error) {
+	entry, err := r.PayoutRepo.CreatePayout(ctx, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	return ledgerEntryToModel(entry), nil
+}
+
 // AddRoleForUser is the resolver for the AddRoleForUser field.
 func (r *mutationResolver) AddRoleForUser(ctx context.Context, in *model.UserRole) (*model.UserInfo, error) {
 	err := r.RoleRepo.AddRoleForUser(in.UserID, in.RoleID)
 	if err != nil {
 		return nil, err
 	}
-	return &model.UserInfo{in.RoleID, in.UserID}, nil
+	return &model.UserInfo{UserID: in.UserID, RoleID: in.RoleID}, nil
 }
 
 // Catalog is the resolver for the Catalog field.
@@ -196,16 +649,45 @@ func (r *queryResolver) Seller(ctx context.Context, id string) (*model.Seller, e
 	return seller, err
 }
 
+// Sellers is the resolver for the Sellers field.
+func (r *queryResolver) Sellers(ctx context.Context, filter *model.SellerFilter, limit *int, offset *int) ([]*model.Seller, error) {
+	if limit == nil {
+		x := 3
+		limit = &x
+	}
+	if offset == nil {
+		y := 0
+		offset = &y
+	}
+	sellers, err := r.SellerRepo.Sellers(ctx, filter, *limit, *offset)
+	if err != nil {
+		return nil, err
+	}
+	return sellers, nil
+}
+
 // MyCart is the resolver for the MyCart field.
 func (r *queryResolver) MyCart(ctx context.Context) ([]*model.CartItem, error) {
-	session := ctx.Value("tokens").(*session.Session)
-	cartItems, err := r.CartRepo.GetCartItems(ctx, int(session.UserID))
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cartItems, err := r.CartRepo.CartItems(ctx, owner)
 	if err != nil {
 		return nil, err
 	}
 	return cartItems, err
 }
 
+// MyCartSummary is the resolver for the MyCartSummary field.
+func (r *queryResolver) MyCartSummary(ctx context.Context) (*model.MyCart, error) {
+	owner, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.CartRepo.CartSummary(ctx, owner)
+}
+
 // MyOrders is the resolver for the MyOrders field.
 func (r *queryResolver) MyOrders(ctx context.Context) ([]*model.Order, error) {
 	UserID, err := sessionutils.IdFromContex(ctx)
@@ -219,6 +701,87 @@ func (r *queryResolver) MyOrders(ctx context.Context) ([]*model.Order, error) {
 	return userOders, nil
 }
 
+// Order is the resolver for the Order field.
+func (r *queryResolver) Order(ctx context.Context, number string) (*model.Order, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := r.OrderRepo.OrderByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID && !r.RoleRepo.HasRole(userID, model.RoleAdmin.String()) {
+		return nil, fmt.Errorf("order not exist")
+	}
+	return order, nil
+}
+
+// PreviewOrder is the resolver for the PreviewOrder field.
+func (r *queryResolver) PreviewOrder(ctx context.Context) (*model.OrderPreview, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.OrderRepo.PreviewOrder(ctx, userID)
+}
+
+// MyAddresses is the resolver for the MyAddresses field.
+func (r *queryResolver) MyAddresses(ctx context.Context) ([]*model.Address, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := r.AddressRepo.UserAddresses(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*model.Address, 0, len(addresses))
+	for _, addr := range addresses {
+		res = append(res, addressToModel(addr))
+	}
+	return res, nil
+}
+
+// MyReturns is the resolver for the MyReturns field.
+func (r *queryResolver) MyReturns(ctx context.Context) ([]*model.ReturnRequest, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	returns, err := r.ReturnRepo.UserReturns(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return returnsToModel(returns), nil
+}
+
+// Returns is the resolver for the Returns field.
+func (r *queryResolver) Returns(ctx context.Context, status *model.ReturnStatus) ([]*model.ReturnRequest, error) {
+	returns, err := r.ReturnRepo.Returns(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	return returnsToModel(returns), nil
+}
+
+// MyShipments is the resolver for the MyShipments field.
+func (r *queryResolver) MyShipments(ctx context.Context) ([]*model.Shipment, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sellerIDs, err := r.RoleRepo.UserSellers(userID)
+	if err != nil {
+		return nil, err
+	}
+	shipments, err := r.OrderRepo.SellerShipments(ctx, sellerIDs)
+	if err != nil {
+		return nil, err
+	}
+	return shipments, nil
+}
+
 // UserOrders is the resolver for the UserOrders field.
 func (r *queryResolver) UserOrders(ctx context.Context, id int) ([]*model.Order, error) {
 	userOders, err := r.OrderRepo.UsersOrders(ctx, id)
@@ -228,15 +791,71 @@ func (r *queryResolver) UserOrders(ctx context.Context, id int) ([]*model.Order,
 	return userOders, nil
 }
 
+// Orders is the resolver for the Orders field.
+func (r *queryResolver) Orders(ctx context.Context, filter *model.OrderFilter, sort *model.OrderSort, first *int, after *string) (*model.OrderPage, error) {
+	orderSort := model.OrderSortNewest
+	if sort != nil {
+		orderSort = *sort
+	}
+	limit := 0
+	if first != nil {
+		limit = *first
+	}
+	cursor := ""
+	if after != nil {
+		cursor = *after
+	}
+	return r.OrderRepo.SearchOrders(ctx, filter, orderSort, limit, cursor)
+}
+
 // UserCards is the resolver for the UserCards field.
 func (r *queryResolver) UserCards(ctx context.Context, id int) ([]*model.CartItem, error) {
-	userCart, err := r.CartRepo.GetCartItems(ctx, id)
+	userCart, err := r.CartRepo.CartItems(ctx, cart.UserOwner(id))
 	if err != nil {
 		return nil, err
 	}
 	return userCart, nil
 }
 
+// AbandonedCarts is the resolver for the AbandonedCarts field.
+func (r *queryResolver) AbandonedCarts(ctx context.Context, idleHours *int) (*model.AbandonedCartReport, error) {
+	idleAfter := cart.DefaultIdleAfter
+	if idleHours != nil {
+		if *idleHours < 0 {
+			return nil, fmt.Errorf("idleHours must not be negative")
+		}
+		idleAfter = time.Duration(*idleHours) * time.Hour
+	}
+	idleSince := time.Now().UTC().Add(-idleAfter)
+	carts, err := r.CartRepo.AbandonedCarts(ctx, idleSince)
+	if err != nil {
+		return nil, err
+	}
+	return abandonedCartsToModel(idleSince, carts), nil
+}
+
+// SellerBalance is the resolver for the sellerBalance field.
+func (r *queryResolver) SellerBalance(ctx context.Context, sellerID int, period *model.PeriodInput) (*model.SellerBalance, error) {
+	from, to, err := parsePeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := r.PayoutRepo.SellerBalance(ctx, sellerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return balanceToModel(balance), nil
+}
+
+// ItemIds is the resolver for the item_ids field.
+func (r *sellerResolver) ItemIds(ctx context.Context, obj *model.Seller) ([]int, error) {
+	ids, err := r.ItemRepo.GetItemIDsBySellerID(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 // Items is the resolver for the items field.
 func (r *sellerResolver) Items(ctx context.Context, obj *model.Seller, limit *int, offset *int) ([]*model.Item, error) {
 	if limit == nil {
@@ -260,6 +879,86 @@ func (r *sellerResolver) Items(ctx context.Context, obj *model.Seller, limit *in
 	return items, err
 }
 
+// Stats is the resolver for the stats field.
+func (r *sellerResolver) Stats(ctx context.Context, obj *model.Seller) (*model.SellerStats, error) {
+	stats, err := r.SellerStats.SellerStats(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.SellerStats{
+		ItemCount:      stats.ItemCount,
+		UnitsInStock:   stats.UnitsInStock,
+		CompletedDeals: stats.CompletedDeals,
+		Revenue:        stats.Revenue,
+		AverageRating:  stats.AverageRating(),
+	}, nil
+}
+
+// Rating is the resolver for the rating field.
+func (r *sellerResolver) Rating(ctx context.Context, obj *model.Seller) (float64, error) {
+	rating, err := r.SellerReview.SellerRate(ctx, obj.ID)
+	if err != nil {
+		return 0, err
+	}
+	return rating, nil
+}
+
+// Reviews is the resolver for the reviews field.
+func (r *sellerResolver) Reviews(ctx context.Context, obj *model.Seller, first *int, after *string) ([]*model.SellerReview, error) {
+	if first == nil {
+		x := 3
+		first = &x
+	}
+	if after == nil {
+		y := ""
+		after = &y
+	}
+	reviews, err := r.SellerReview.SellerReviews(ctx, obj.ID, *first, *after)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*model.SellerReview, 0, len(reviews))
+	for _, review := range reviews {
+		result = append(result, sellerReviewToModel(review))
+	}
+	return result, nil
+}
+
+// OrderUpdated is the resolver for the orderUpdated field.
+func (r *subscriptionResolver) OrderUpdated(ctx context.Context, orderID int) (<-chan *model.Order, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("User not authorized")
+	}
+	// subscribe before reading, so no change falls between the two
+	subCtx, cancel := context.WithCancel(ctx)
+	msgs := r.Events.Subscribe(subCtx, order.OrderTopic(orderID))
+	current, err := r.OrderRepo.OrderByID(ctx, orderID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if current.UserID != userID && !r.RoleRepo.HasRole(userID, model.RoleAdmin.String()) {
+		cancel()
+		return nil, fmt.Errorf("order not exist")
+	}
+	return orderStream(subCtx, cancel, msgs, current), nil
+}
+
+// OrdersFeed is the resolver for the ordersFeed field.
+func (r *subscriptionResolver) OrdersFeed(ctx context.Context) (<-chan *model.Order, error) {
+	userID, err := sessionutils.IdFromContex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("User not authorized")
+	}
+	if !r.RoleRepo.HasRole(userID, model.RoleAdmin.String()) {
+		return nil, fmt.Errorf("Forbiden")
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	msgs := r.Events.Subscribe(subCtx, order.OrdersFeedTopic)
+	return orderStream(subCtx, cancel, msgs, nil), nil
+}
+
 // Catalog returns CatalogResolver implementation.
 func (r *Resolver) Catalog() CatalogResolver { return &catalogResolver{r} }
 
@@ -275,8 +974,12 @@ func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 // Seller returns SellerResolver implementation.
 func (r *Resolver) Seller() SellerResolver { return &sellerResolver{r} }
 
+// Subscription returns SubscriptionResolver implementation.
+func (r *Resolver) Subscription() SubscriptionResolver { return &subscriptionResolver{r} }
+
 type catalogResolver struct{ *Resolver }
 type itemResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
 type sellerResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
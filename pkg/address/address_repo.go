@@ -0,0 +1,85 @@
+package address
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Address is an entry of the user's address book
+type Address struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     int
+	City       string
+	Street     string
+	House      string
+	Apartment  string
+	PostalCode string
+}
+
+type AddressRepoInterface interface {
+	AddAddress(ctx context.Context, address Address) (*Address, error)
+	UserAddresses(ctx context.Context, userID int) ([]*Address, error)
+	AddressByID(ctx context.Context, userID int, id string) (*Address, error)
+}
+
+type AddressRepo struct {
+	StMongoDB *mongo.Collection
+}
+
+func Validate(address Address) error {
+	if address.City == "" || address.Street == "" || address.House == "" {
+		return fmt.Errorf("address needs city, street and house")
+	}
+	return nil
+}
+
+func (AR *AddressRepo) AddAddress(ctx context.Context, address Address) (*Address, error) {
+	if err := Validate(address); err != nil {
+		return nil, err
+	}
+	address.ID = primitive.NewObjectID()
+	_, err := AR.StMongoDB.InsertOne(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+func (AR *AddressRepo) UserAddresses(ctx context.Context, userID int) ([]*Address, error) {
+	cur, err := AR.StMongoDB.Find(ctx, bson.M{"userid": userID})
+	if err != nil {
+		return nil, err
+	}
+	addresses := []*Address{}
+	if err := cur.All(ctx, &addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// AddressByID finds an address of the user, addresses of other users are reported as missing
+func (AR *AddressRepo) AddressByID(ctx context.Context, userID int, id string) (*Address, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("address not exist")
+	}
+	var address *Address
+	err = AR.StMongoDB.FindOne(ctx, bson.M{"_id": objectID, "userid": userID}).Decode(&address)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("address not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+func CreateAddressRepo(St *mongo.Collection) *AddressRepo {
+	return &AddressRepo{
+		StMongoDB: St,
+	}
+}
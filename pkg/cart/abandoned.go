@@ -0,0 +1,186 @@
+package cart
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/pkg/notify"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DefaultIdleAfter   = 24 * time.Hour
+	DefaultExpireAfter = 30 * 24 * time.Hour
+	DefaultJobInterval = time.Hour
+)
+
+// AbandonedCart is a cart nobody touched since UpdatedAt
+type AbandonedCart struct {
+	Owner      Owner
+	Lines      int
+	Quantity   int
+	UpdatedAt  time.Time
+	RemindedAt *time.Time
+}
+
+// Reminded reports whether the owner was already reminded after the last change
+func (ac *AbandonedCart) Reminded() bool {
+	return ac.RemindedAt != nil && !ac.RemindedAt.Before(ac.UpdatedAt)
+}
+
+// AbandonedCarts returns the carts whose lines all were last changed before idleSince, oldest first
+func (CR *CartRepo) AbandonedCarts(ctx context.Context, idleSince time.Time) ([]*AbandonedCart, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"order_id": notReserved}},
+		{"$group": bson.M{
+			"_id": bson.D{
+				{Key: "user", Value: "$user_id"},
+				{Key: "guest", Value: "$guest_id"},
+			},
+			"lines":      bson.M{"$sum": 1},
+			"quantity":   bson.M{"$sum": "$quantity"},
+			"updatedat":  bson.M{"$max": "$updated_at"},
+			"remindedat": bson.M{"$max": "$reminded_at"},
+		}},
+		{"$match": bson.M{"updatedat": bson.M{"$lt": idleSince}}},
+		{"$sort": bson.M{"updatedat": 1}},
+	}
+	cur, err := CR.St.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID struct {
+			User  int    `bson:"user"`
+			Guest string `bson:"guest"`
+		} `bson:"_id"`
+		Lines      int        `bson:"lines"`
+		Quantity   int        `bson:"quantity"`
+		UpdatedAt  time.Time  `bson:"updatedat"`
+		RemindedAt *time.Time `bson:"remindedat"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	carts := make([]*AbandonedCart, 0, len(rows))
+	for _, row := range rows {
+		carts = append(carts, &AbandonedCart{
+			Owner:      Owner{UserID: row.ID.User, GuestID: row.ID.Guest},
+			Lines:      row.Lines,
+			Quantity:   row.Quantity,
+			UpdatedAt:  row.UpdatedAt,
+			RemindedAt: row.RemindedAt,
+		})
+	}
+	return carts, nil
+}
+
+func (CR *CartRepo) MarkReminded(ctx context.Context, owner Owner, at time.Time) error {
+	_, err := CR.St.UpdateMany(ctx, owner.filter(), bson.M{"$set": bson.M{"reminded_at": at}})
+	return err
+}
+
+// ExpireCarts deletes whole carts not changed since before, returns the number of deleted lines
+func (CR *CartRepo) ExpireCarts(ctx context.Context, before time.Time) (int64, error) {
+	carts, err := CR.AbandonedCarts(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, cart := range carts {
+		filter := cart.Owner.filter()
+		filter["updated_at"] = bson.M{"$lt": before}
+		res, err := CR.St.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += res.DeletedCount
+	}
+	return deleted, nil
+}
+
+// stampLegacyLines gives lines created before timestamps existed the current time,
+// so they start aging now instead of being expired at once
+func (CR *CartRepo) stampLegacyLines(ctx context.Context, now time.Time) error {
+	_, err := CR.St.UpdateMany(ctx,
+		bson.M{"updated_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"updated_at": now}},
+	)
+	return err
+}
+
+// AbandonedCartJob reminds users about idle carts and expires very old ones.
+// Guests have no contact, their carts only expire
+type AbandonedCartJob struct {
+	Carts       *CartRepo
+	Notifier    notify.Notifier
+	IdleAfter   time.Duration
+	ExpireAfter time.Duration
+	Interval    time.Duration
+}
+
+func (AJ *AbandonedCartJob) RunOnce(ctx context.Context) (reminded int, expired int64, err error) {
+	now := time.Now().UTC()
+	if err := AJ.Carts.stampLegacyLines(ctx, now); err != nil {
+		return 0, 0, err
+	}
+	expired, err = AJ.Carts.ExpireCarts(ctx, now.Add(-AJ.ExpireAfter))
+	if err != nil {
+		return 0, 0, err
+	}
+	carts, err := AJ.Carts.AbandonedCarts(ctx, now.Add(-AJ.IdleAfter))
+	if err != nil {
+		return 0, expired, err
+	}
+	for _, cart := range carts {
+		if cart.Owner.GuestID != "" || cart.Reminded() {
+			continue
+		}
+		err := AJ.Notifier.Notify(ctx, notify.Notification{
+			UserID:    cart.Owner.UserID,
+			Kind:      notify.KindCartReminder,
+			Text:      fmt.Sprintf("You left %d items in your cart", cart.Quantity),
+			CreatedAt: now,
+		})
+		if err != nil {
+			return reminded, expired, err
+		}
+		if err := AJ.Carts.MarkReminded(ctx, cart.Owner, now); err != nil {
+			return reminded, expired, err
+		}
+		reminded++
+	}
+	return reminded, expired, nil
+}
+
+// Run repeats RunOnce every Interval until ctx is done
+func (AJ *AbandonedCartJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(AJ.Interval)
+	defer ticker.Stop()
+	for {
+		reminded, expired, err := AJ.RunOnce(ctx)
+		if err != nil {
+			log.Println("abandoned cart job failed:", err)
+		} else if reminded > 0 || expired > 0 {
+			log.Printf("abandoned cart job: %d reminded, %d lines expired", reminded, expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func CreateAbandonedCartJob(carts *CartRepo, notifier notify.Notifier) *AbandonedCartJob {
+	return &AbandonedCartJob{
+		Carts:       carts,
+		Notifier:    notifier,
+		IdleAfter:   DefaultIdleAfter,
+		ExpireAfter: DefaultExpireAfter,
+		Interval:    DefaultJobInterval,
+	}
+}
@@ -3,11 +3,13 @@ package cart
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"hw11_shopql/graph/model"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type ItemRepoInterface interface {
@@ -17,16 +19,74 @@ type ItemRepoInterface interface {
 
 type Cart struct {
 	User_id  int
+	Guest_id string `bson:",omitempty"`
 	Item_id  int
 	Quantity int
+	// Saved lines are kept for later and left out of totals and orders
+	Saved bool
+	// Updated_at is bumped on every change of the line, idle carts are found by it
+	Updated_at time.Time
+	// Price of the item when it was put into the cart
+	Price float64
+	// Order_id reserves the line for an order being placed, reserved lines are out of the cart
+	Order_id int `bson:",omitempty"`
+	// Reserved_at is when the line was reserved, a reservation without an order expires
+	Reserved_at *time.Time `bson:",omitempty"`
+	// Taken is the quantity the order took from stock for the line
+	Taken int `bson:",omitempty"`
+}
+
+// Owner is either a registered user or a guest with a signed token
+type Owner struct {
+	UserID  int
+	GuestID string
+}
+
+func UserOwner(UserID int) Owner {
+	return Owner{UserID: UserID}
+}
+
+func GuestOwner(GuestID string) Owner {
+	return Owner{GuestID: GuestID}
+}
+
+func (o Owner) filter() bson.M {
+	if o.GuestID != "" {
+		return bson.M{"guest_id": o.GuestID, "order_id": notReserved}
+	}
+	return bson.M{"user_id": o.UserID, "order_id": notReserved}
+}
+
+// notReserved matches the lines no order holds
+var notReserved = bson.M{"$exists": false}
+
+func (o Owner) itemFilter(ItemID int) bson.M {
+	filter := o.filter()
+	filter["item_id"] = ItemID
+	return filter
 }
 
 type CartRepoInterface interface {
-	CartExist(ctx context.Context, UserID int, ItemID int) (bool, error)
-	GetCartsItem(ctx context.Context, UserID int, ItemID int) (*Cart, error)
-	AddItem(ctx context.Context, cart *model.CartInput, UserID int) error
-	RemoveFromCartItem(ctx context.Context, cart *model.CartInput, UserID int) error
+	CartExist(ctx context.Context, owner Owner, ItemID int) (bool, error)
+	GetCartsItem(ctx context.Context, owner Owner, ItemID int) (*Cart, error)
+	AddItem(ctx context.Context, cart *model.CartInput, owner Owner) error
+	RemoveFromCartItem(ctx context.Context, cart *model.CartInput, owner Owner) error
+	CartItems(ctx context.Context, owner Owner) ([]*model.CartItem, error)
 	GetCartItems(ctx context.Context, UserID int) ([]*model.CartItem, error)
+	CartLines(ctx context.Context, UserID int) ([]Cart, error)
+	MergeGuestCart(ctx context.Context, GuestID string, UserID int) error
+	SetCartItemQuantity(ctx context.Context, cart *model.CartInput, owner Owner) error
+	UpdateCart(ctx context.Context, carts []*model.CartInput, owner Owner) error
+	ClearCart(ctx context.Context, owner Owner) error
+	ReserveLines(ctx context.Context, UserID, OrderID int, ItemIDs []int) (int, error)
+	MarkTaken(ctx context.Context, OrderID, ItemID, quantity int) error
+	ReleaseLine(ctx context.Context, OrderID, ItemID int) (int, error)
+	RemoveReservedLines(ctx context.Context, OrderID int) error
+	ReservedLines(ctx context.Context, UserID int) ([]Cart, error)
+	CartSummary(ctx context.Context, owner Owner) (*model.MyCart, error)
+	MoveToSaved(ctx context.Context, owner Owner, ItemID int) error
+	MoveToCart(ctx context.Context, owner Owner, ItemID int) error
+	AbandonedCarts(ctx context.Context, idleSince time.Time) ([]*AbandonedCart, error)
 }
 
 type CartRepo struct {
@@ -34,8 +94,8 @@ type CartRepo struct {
 	ItemStorage ItemRepoInterface
 }
 
-func (CR *CartRepo) CartExist(ctx context.Context, UserID int, ItemID int) (bool, error) {
-	filter := bson.M{"user_id": UserID, "item_id": ItemID}
+func (CR *CartRepo) CartExist(ctx context.Context, owner Owner, ItemID int) (bool, error) {
+	filter := owner.itemFilter(ItemID)
 	count, err := CR.St.CountDocuments(ctx, filter)
 	if err != nil {
 		return false, err
@@ -43,8 +103,8 @@ func (CR *CartRepo) CartExist(ctx context.Context, UserID int, ItemID int) (bool
 	return count > 0, nil
 }
 
-func (CR *CartRepo) GetCartsItem(ctx context.Context, UserID int, ItemID int) (*Cart, error) {
-	filter := bson.M{"user_id": UserID, "item_id": ItemID}
+func (CR *CartRepo) GetCartsItem(ctx context.Context, owner Owner, ItemID int) (*Cart, error) {
+	filter := owner.itemFilter(ItemID)
 	cart := &Cart{}
 	err := CR.St.FindOne(ctx, filter).Decode(&cart)
 	if err != nil {
@@ -54,8 +114,8 @@ func (CR *CartRepo) GetCartsItem(ctx context.Context, UserID int, ItemID int) (*
 
 }
 
-func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, UserID int) error {
-	exist, err := CR.CartExist(ctx, UserID, cart.ItemID)
+func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, owner Owner) error {
+	exist, err := CR.CartExist(ctx, owner, cart.ItemID)
 	if err != nil {
 		return err
 	}
@@ -68,9 +128,12 @@ func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, UserID i
 			return fmt.Errorf("not enough quantity")
 		}
 		cart := Cart{
-			User_id:  UserID,
-			Item_id:  cart.ItemID,
-			Quantity: cart.Quantity,
+			User_id:    owner.UserID,
+			Guest_id:   owner.GuestID,
+			Item_id:    cart.ItemID,
+			Quantity:   cart.Quantity,
+			Updated_at: time.Now().UTC(),
+			Price:      item.Price,
 		}
 		_, err = CR.St.InsertOne(ctx, cart)
 		if err != nil {
@@ -78,7 +141,7 @@ func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, UserID i
 		}
 		return nil
 	} else {
-		CartItem, err := CR.GetCartsItem(ctx, UserID, cart.ItemID)
+		CartItem, err := CR.GetCartsItem(ctx, owner, cart.ItemID)
 		if err != nil {
 			return err
 		}
@@ -87,13 +150,12 @@ func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, UserID i
 		}
 
 		newQuantity := CartItem.Quantity + cart.Quantity
-		filter := bson.M{
-			"user_id": UserID,
-			"item_id": cart.ItemID,
-		}
+		filter := owner.itemFilter(cart.ItemID)
 		update := bson.M{
 			"$set": bson.M{
-				"quantity": newQuantity,
+				"quantity":   newQuantity,
+				"saved":      false,
+				"updated_at": time.Now().UTC(),
 			},
 		}
 		_, err = CR.St.UpdateOne(ctx, filter, update)
@@ -104,58 +166,48 @@ func (CR *CartRepo) AddItem(ctx context.Context, cart *model.CartInput, UserID i
 	return nil
 }
 
-func (CR *CartRepo) RemoveFromCartItem(ctx context.Context, cart *model.CartInput, UserID int) error {
-	exist, err := CR.CartExist(ctx, UserID, cart.ItemID)
+func (CR *CartRepo) RemoveFromCartItem(ctx context.Context, cart *model.CartInput, owner Owner) error {
+	exist, err := CR.CartExist(ctx, owner, cart.ItemID)
 	if err != nil {
 		return err
 	}
 	if !exist {
 		return fmt.Errorf("cart in no exist")
 	}
-	item, err := CR.ItemStorage.GetItemByID(ctx, cart.ItemID)
-	if err != nil {
-		return err
-	}
-	CartItem, err := CR.GetCartsItem(ctx, UserID, cart.ItemID)
+	CartItem, err := CR.GetCartsItem(ctx, owner, cart.ItemID)
 	if err != nil {
 		return err
 	}
 	if CartItem.Quantity-cart.Quantity <= 0 {
-		filter := bson.M{
-			"user_id": UserID,
-			"item_id": cart.ItemID,
-		}
+		filter := owner.itemFilter(cart.ItemID)
 		_, err = CR.St.DeleteOne(ctx, filter)
 		if err != nil {
 			return err
 		}
 		return nil
 	} else {
-		CartItem, err := CR.GetCartsItem(ctx, UserID, cart.ItemID)
-		if err != nil {
-			return err
-		}
-		if cart.Quantity+CartItem.Quantity > item.InStock {
-			return fmt.Errorf("not enough quantity")
-		}
-
 		newQuantity := CartItem.Quantity - cart.Quantity
-		filter := bson.M{
-			"user_id": UserID,
-			"item_id": cart.ItemID,
-		}
+		filter := owner.itemFilter(cart.ItemID)
 		update := bson.M{
 			"$set": bson.M{
-				"quantity": newQuantity,
+				"quantity":   newQuantity,
+				"updated_at": time.Now().UTC(),
 			},
 		}
-		CR.St.UpdateOne(ctx, filter, update)
+		_, err = CR.St.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (CR *CartRepo) GetCartItems(ctx context.Context, UserID int) ([]*model.CartItem, error) {
-	filter := bson.M{"user_id": UserID}
+// CartItems returns all lines of the cart, saved for later included
+func (CR *CartRepo) CartItems(ctx context.Context, owner Owner) ([]*model.CartItem, error) {
+	return CR.cartItems(ctx, owner.filter())
+}
+
+func (CR *CartRepo) cartItems(ctx context.Context, filter bson.M) ([]*model.CartItem, error) {
 	cur, err := CR.St.Find(ctx, filter)
 	if err != nil {
 		return nil, err
@@ -170,7 +222,7 @@ func (CR *CartRepo) GetCartItems(ctx context.Context, UserID int) ([]*model.Cart
 		}
 		item, _ := CR.ItemStorage.GetItemByID(ctx, cart.Item_id)
 		item.InStockText = CR.ItemStorage.InStockByQuantity(item.InStock - cart.Quantity)
-		cartItems = append(cartItems, &model.CartItem{Quantity: cart.Quantity, Item: item})
+		cartItems = append(cartItems, &model.CartItem{Quantity: cart.Quantity, Item: item, Saved: cart.Saved})
 	}
 
 	if err := cur.Err(); err != nil {
@@ -180,6 +232,269 @@ func (CR *CartRepo) GetCartItems(ctx context.Context, UserID int) ([]*model.Cart
 	return cartItems, nil
 }
 
+func activeFilter(UserID int) bson.M {
+	filter := UserOwner(UserID).filter()
+	filter["saved"] = bson.M{"$ne": true}
+	return filter
+}
+
+// GetCartItems returns the active lines of the user cart, the ones that go to an order
+func (CR *CartRepo) GetCartItems(ctx context.Context, UserID int) ([]*model.CartItem, error) {
+	return CR.cartItems(ctx, activeFilter(UserID))
+}
+
+// CartLines returns the stored active lines of the user cart without looking up the items
+func (CR *CartRepo) CartLines(ctx context.Context, UserID int) ([]Cart, error) {
+	cur, err := CR.St.Find(ctx, activeFilter(UserID), options.Find().SetSort(bson.M{"item_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	lines := []Cart{}
+	if err := cur.All(ctx, &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// MergeGuestCart moves the guest cart to the user, quantities of the same item
+// are summed and capped at stock. Lines of items that no longer exist are dropped
+func (CR *CartRepo) MergeGuestCart(ctx context.Context, GuestID string, UserID int) error {
+	guest := GuestOwner(GuestID)
+	user := UserOwner(UserID)
+	cur, err := CR.St.Find(ctx, guest.filter())
+	if err != nil {
+		return err
+	}
+	var lines []Cart
+	if err := cur.All(ctx, &lines); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		item, err := CR.ItemStorage.GetItemByID(ctx, line.Item_id)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if item != nil {
+			quantity := line.Quantity
+			existing, err := CR.GetCartsItem(ctx, user, line.Item_id)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			if existing != nil {
+				quantity += existing.Quantity
+			}
+			if quantity > item.InStock {
+				quantity = item.InStock
+			}
+			if err := CR.mergeLine(ctx, user, line, quantity, existing != nil); err != nil {
+				return err
+			}
+		}
+		_, err = CR.St.DeleteOne(ctx, guest.itemFilter(line.Item_id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (CR *CartRepo) SetCartItemQuantity(ctx context.Context, cart *model.CartInput, owner Owner) error {
+	return CR.UpdateCart(ctx, []*model.CartInput{cart}, owner)
+}
+
+// UpdateCart sets absolute quantities, zero removes the line.
+// All lines are checked before anything is written, so a bad line changes nothing.
+// The ordered bulk write itself is not a transaction, Mongo runs without a replica set:
+// if storage fails midway the lines before the failure stay written.
+// Quantities are absolute, so repeating the call finishes the update
+func (CR *CartRepo) UpdateCart(ctx context.Context, carts []*model.CartInput, owner Owner) error {
+	seen := make(map[int]bool, len(carts))
+	writes := make([]mongo.WriteModel, 0, len(carts))
+	for _, cart := range carts {
+		if seen[cart.ItemID] {
+			return fmt.Errorf("item %d listed twice", cart.ItemID)
+		}
+		seen[cart.ItemID] = true
+		if cart.Quantity < 0 {
+			return fmt.Errorf("quantity must not be negative")
+		}
+		filter := owner.itemFilter(cart.ItemID)
+		if cart.Quantity == 0 {
+			writes = append(writes, mongo.NewDeleteOneModel().SetFilter(filter))
+			continue
+		}
+		item, err := CR.ItemStorage.GetItemByID(ctx, cart.ItemID)
+		if err != nil {
+			return err
+		}
+		if cart.Quantity > item.InStock {
+			return fmt.Errorf("not enough quantity")
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{
+				"$set":         bson.M{"quantity": cart.Quantity, "updated_at": time.Now().UTC()},
+				"$setOnInsert": bson.M{"price": item.Price},
+			}).
+			SetUpsert(true))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err := CR.St.BulkWrite(ctx, writes)
+	return err
+}
+
+func (CR *CartRepo) ClearCart(ctx context.Context, owner Owner) error {
+	_, err := CR.St.DeleteMany(ctx, owner.filter())
+	return err
+}
+
+// ReserveLines marks the active lines of the ordered items with the order id,
+// from then on they are out of the cart and no other order can take them.
+// Returns the number of reserved lines
+func (CR *CartRepo) ReserveLines(ctx context.Context, UserID, OrderID int, ItemIDs []int) (int, error) {
+	filter := activeFilter(UserID)
+	filter["item_id"] = bson.M{"$in": ItemIDs}
+	now := time.Now().UTC()
+	res, err := CR.St.UpdateMany(ctx, filter, bson.M{
+		"$set": bson.M{"order_id": OrderID, "reserved_at": now},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// MarkTaken records the quantity the order took from stock for the reserved line
+func (CR *CartRepo) MarkTaken(ctx context.Context, OrderID, ItemID, quantity int) error {
+	_, err := CR.St.UpdateOne(ctx,
+		bson.M{"order_id": OrderID, "item_id": ItemID},
+		bson.M{"$set": bson.M{"taken": quantity}},
+	)
+	return err
+}
+
+// ReleaseLine puts a line of an order that wasn't placed back into the cart
+// and returns the quantity it had taken from stock. Only one caller gets the quantity,
+// a line released already gives zero
+func (CR *CartRepo) ReleaseLine(ctx context.Context, OrderID, ItemID int) (int, error) {
+	line := Cart{}
+	err := CR.St.FindOneAndUpdate(ctx,
+		bson.M{"order_id": OrderID, "item_id": ItemID},
+		bson.M{"$unset": bson.M{"order_id": "", "reserved_at": "", "taken": ""}},
+	).Decode(&line)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return line.Taken, nil
+}
+
+// RemoveReservedLines deletes the lines of a placed order, saved lines were never reserved and stay
+func (CR *CartRepo) RemoveReservedLines(ctx context.Context, OrderID int) error {
+	_, err := CR.St.DeleteMany(ctx, bson.M{"order_id": OrderID})
+	return err
+}
+
+// ReservedLines returns the lines of the user held by orders
+func (CR *CartRepo) ReservedLines(ctx context.Context, UserID int) ([]Cart, error) {
+	cur, err := CR.St.Find(ctx, bson.M{"user_id": UserID, "order_id": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	lines := []Cart{}
+	if err := cur.All(ctx, &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// lineWarning tells the buyer that the stock went below the cart quantity
+func lineWarning(item *model.Item, quantity int) *string {
+	if item.InStock >= quantity {
+		return nil
+	}
+	warning := fmt.Sprintf("only %d left", item.InStock)
+	if item.InStock <= 0 {
+		warning = "out of stock"
+	}
+	return &warning
+}
+
+func (CR *CartRepo) CartSummary(ctx context.Context, owner Owner) (*model.MyCart, error) {
+	cartItems, err := CR.CartItems(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	summary := &model.MyCart{
+		Items: []*model.Item{},
+		Lines: []*model.CartLine{},
+	}
+	for _, cartItem := range cartItems {
+		summary.Items = append(summary.Items, cartItem.Item)
+		summary.Lines = append(summary.Lines, &model.CartLine{
+			Item:     cartItem.Item,
+			Quantity: cartItem.Quantity,
+			Warning:  lineWarning(cartItem.Item, cartItem.Quantity),
+			Saved:    cartItem.Saved,
+		})
+		if cartItem.Saved {
+			continue
+		}
+		summary.Quantity += cartItem.Quantity
+		summary.Total += cartItem.Item.Price * float64(cartItem.Quantity)
+	}
+	return summary, nil
+}
+
+func (CR *CartRepo) setSaved(ctx context.Context, owner Owner, ItemID int, saved bool) error {
+	res, err := CR.St.UpdateOne(ctx, owner.itemFilter(ItemID), bson.M{
+		"$set": bson.M{"saved": saved, "updated_at": time.Now().UTC()},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("cart in no exist")
+	}
+	return nil
+}
+
+func (CR *CartRepo) MoveToSaved(ctx context.Context, owner Owner, ItemID int) error {
+	return CR.setSaved(ctx, owner, ItemID, true)
+}
+
+func (CR *CartRepo) MoveToCart(ctx context.Context, owner Owner, ItemID int) error {
+	return CR.setSaved(ctx, owner, ItemID, false)
+}
+
+// mergeLine updates the quantity of an existing line, a new line keeps the saved flag and price of the guest line
+func (CR *CartRepo) mergeLine(ctx context.Context, owner Owner, line Cart, quantity int, exist bool) error {
+	if exist {
+		_, err := CR.St.UpdateOne(ctx, owner.itemFilter(line.Item_id), bson.M{
+			"$set": bson.M{"quantity": quantity, "updated_at": time.Now().UTC()},
+		})
+		return err
+	}
+	if quantity <= 0 {
+		return nil
+	}
+	_, err := CR.St.InsertOne(ctx, Cart{
+		User_id:    owner.UserID,
+		Guest_id:   owner.GuestID,
+		Item_id:    line.Item_id,
+		Quantity:   quantity,
+		Saved:      line.Saved,
+		Updated_at: time.Now().UTC(),
+		Price:      line.Price,
+	})
+	return err
+}
+
 func CreateCartRepo(St *mongo.Collection, itemRepo ItemRepoInterface) *CartRepo {
 	return &CartRepo{
 		St:          St,
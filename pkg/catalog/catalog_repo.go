@@ -15,6 +15,10 @@ type CataloRepoInrerface interface {
 	CatalogExists(ctx context.Context, id int) (bool, error)
 	AddNewCatalog(ctx context.Context, catalog model.Catalog) error
 	LookupCatalog(ctx context.Context, ID int) (model.Catalog, error)
+	LookupCatalogChain(ctx context.Context, ID int) ([]model.Catalog, error)
+	SetReviewPolicy(ctx context.Context, ID int, policy model.ReviewPolicy) (*model.Catalog, error)
+	SetRatingDimensions(ctx context.Context, ID int, dimensions []string) (*model.Catalog, error)
+	RatingDimensions(ctx context.Context, ID int) ([]string, error)
 	GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int) ([]*model.Item, error)
 }
 
@@ -43,6 +47,9 @@ func (CH *CatalogRepo) AddCatalogWithItems(ctx context.Context, catalog model.Ca
 		ParentID: catalog.ParentID,
 		Items:    catalogItems,
 	}
+	if catalog.ReviewPolicy != nil {
+		newCatalog.ReviewPolicy = *catalog.ReviewPolicy
+	}
 	err := CH.AddNewCatalog(ctx, *newCatalog)
 	if err != nil {
 		return nil, err
@@ -121,6 +128,98 @@ func (CH *CatalogRepo) LookupCatalog(ctx context.Context, ID int) (model.Catalog
 	return category, nil
 }
 
+// LookupCatalogChain returns the catalog followed by all its parents up to the root
+func (CH *CatalogRepo) LookupCatalogChain(ctx context.Context, ID int) ([]model.Catalog, error) {
+	var chain []model.Catalog
+	visited := make(map[int]bool)
+	for !visited[ID] {
+		visited[ID] = true
+		catalog, err := CH.LookupCatalog(ctx, ID)
+		if err != nil {
+			return nil, err
+		}
+		if catalog.ID == 0 {
+			break
+		}
+		chain = append(chain, catalog)
+		if catalog.ParentID == nil {
+			break
+		}
+		ID = *catalog.ParentID
+	}
+	return chain, nil
+}
+
+func (CH *CatalogRepo) SetReviewPolicy(ctx context.Context, ID int, policy model.ReviewPolicy) (*model.Catalog, error) {
+	filter := bson.M{
+		"id": ID,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"reviewpolicy": policy,
+		},
+	}
+	res, err := CH.StMongoDB.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("catalog not exist")
+	}
+	catalog, err := CH.LookupCatalog(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+func (CH *CatalogRepo) SetRatingDimensions(ctx context.Context, ID int, dimensions []string) (*model.Catalog, error) {
+	seen := make(map[string]bool, len(dimensions))
+	for _, dimension := range dimensions {
+		if dimension == "" {
+			return nil, fmt.Errorf("rating dimension name can't be empty")
+		}
+		if seen[dimension] {
+			return nil, fmt.Errorf("rating dimension %q defined twice", dimension)
+		}
+		seen[dimension] = true
+	}
+	filter := bson.M{
+		"id": ID,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"ratingdimensions": dimensions,
+		},
+	}
+	res, err := CH.StMongoDB.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("catalog not exist")
+	}
+	catalog, err := CH.LookupCatalog(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// RatingDimensions returns the criteria of the closest catalog in the chain that defines them
+func (CH *CatalogRepo) RatingDimensions(ctx context.Context, ID int) ([]string, error) {
+	chain, err := CH.LookupCatalogChain(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, catalog := range chain {
+		if len(catalog.RatingDimensions) > 0 {
+			return catalog.RatingDimensions, nil
+		}
+	}
+	return []string{}, nil
+}
+
 func (CH *CatalogRepo) GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int) ([]*model.Item, error) {
 	if limit <= 0 {
 		limit = 3 // Default limit
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/outbox"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,19 +16,37 @@ type CommentRepo struct {
 }
 
 type CommentRepoInterface interface {
-	AddCommentToItem(ctx context.Context, userID int, itemID int, commentText string) (*model.Comment, error)
-	AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string) (*model.Comment, error)
+	AddCommentToItem(ctx context.Context, userID int, itemID int, commentText string, verified bool) (*model.Comment, error)
+	AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string, verified bool) (*model.Comment, error)
+	FindComment(ctx context.Context, commentID string) (*model.Comment, error)
 }
 
-func (CR *CommentRepo) AddCommentToItem(ctx context.Context, userID int, itemID int, commentText string) (*model.Comment, error) {
+// insert stores the comment together with its comment.posted event
+func (CR *CommentRepo) insert(ctx context.Context, comment *model.Comment) error {
+	id := primitive.NewObjectID()
+	doc, err := outbox.Attach(comment, outbox.NewEvent(outbox.CommentPosted, id.Hex(), bson.M{
+		"commentID": id.Hex(),
+		"itemID":    comment.ItemsID,
+		"userID":    comment.UserID,
+		"parentID":  comment.ParentID,
+		"verified":  comment.VerifiedPurchase,
+	}))
+	if err != nil {
+		return err
+	}
+	_, err = CR.StMongoDB.InsertOne(ctx, append(bson.D{{Key: "_id", Value: id}}, doc...))
+	return err
+}
+
+func (CR *CommentRepo) AddCommentToItem(ctx context.Context, userID int, itemID int, commentText string, verified bool) (*model.Comment, error) {
 	comment := &model.Comment{
-		UserID:      userID,
-		ItemsID:     itemID,
-		CommentText: commentText,
-		Rate:        0,
+		UserID:           userID,
+		ItemsID:          itemID,
+		CommentText:      commentText,
+		Rate:             0,
+		VerifiedPurchase: verified,
 	}
-	_, err := CR.StMongoDB.InsertOne(ctx, comment)
-	if err != nil {
+	if err := CR.insert(ctx, comment); err != nil {
 		return nil, err
 	}
 	return comment, nil
@@ -58,7 +77,7 @@ func (CR *CommentRepo) FindComment(ctx context.Context, commentID string) (*mode
 	return comment, nil
 }
 
-func (CR *CommentRepo) AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string) (*model.Comment, error) {
+func (CR *CommentRepo) AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string, verified bool) (*model.Comment, error) {
 	exist, err := CR.CommentExist(ctx, commentID)
 	if err != nil {
 		return nil, err
@@ -71,14 +90,14 @@ func (CR *CommentRepo) AddCommentToCommnet(ctx context.Context, userID int, comm
 		return nil, err
 	}
 	comment := &model.Comment{
-		UserID:      userID,
-		ParentID:    &commentID,
-		ItemsID:     comm.ItemsID,
-		CommentText: commentText,
-		Rate:        0,
+		UserID:           userID,
+		ParentID:         &commentID,
+		ItemsID:          comm.ItemsID,
+		CommentText:      commentText,
+		Rate:             0,
+		VerifiedPurchase: verified,
 	}
-	_, err = CR.StMongoDB.InsertOne(ctx, comment)
-	if err != nil {
+	if err := CR.insert(ctx, comment); err != nil {
 		return nil, err
 	}
 	return comment, nil
@@ -0,0 +1,69 @@
+package guest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// HeaderName carries the guest token in both directions
+	HeaderName = "X-Guest-Token"
+	// ContextKey holds the guest ID of a verified token
+	ContextKey = "guest"
+)
+
+// Signer issues guest tokens "<id>.<hmac of id>" so a guest can't pick
+// somebody else's cart by changing the ID
+type Signer struct {
+	Secret []byte
+}
+
+func (GS *Signer) sign(id string) string {
+	mac := hmac.New(sha256.New, GS.Secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (GS *Signer) Issue() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+	return id + "." + GS.sign(id), nil
+}
+
+// Verify returns the guest ID of a token issued by this signer
+func (GS *Signer) Verify(token string) (string, error) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return "", fmt.Errorf("bad guest token")
+	}
+	if !hmac.Equal([]byte(sig), []byte(GS.sign(id))) {
+		return "", fmt.Errorf("bad guest token")
+	}
+	return id, nil
+}
+
+// RandomSecret is used when no secret is configured, tokens die with the process
+func RandomSecret() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+func IdFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ContextKey).(string)
+	return id, ok && id != ""
+}
+
+func CreateSigner(secret []byte) *Signer {
+	return &Signer{
+		Secret: secret,
+	}
+}
@@ -0,0 +1,157 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hw11_shopql/pkg/guest"
+	"hw11_shopql/pkg/utils/sessionutils"
+	"log"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	HeaderName    = "Idempotency-Key"
+	DirectiveName = "idempotent"
+)
+
+// Extension replays the stored response of a mutation sent again with the same key.
+// The key comes from the Idempotency-Key header or the @idempotent(key:) directive of the mutation
+type Extension struct {
+	Repo IdempotencyRepoInterface
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+} = &Extension{}
+
+func (e *Extension) ExtensionName() string {
+	return "Idempotency"
+}
+
+func (e *Extension) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// Directive only declares the key, Extension does the work
+func Directive(ctx context.Context, obj interface{}, next graphql.Resolver, key string) (interface{}, error) {
+	return next(ctx)
+}
+
+func requestKey(opCtx *graphql.OperationContext) string {
+	if d := opCtx.Operation.Directives.ForName(DirectiveName); d != nil {
+		if key, ok := d.ArgumentMap(opCtx.Variables)["key"].(string); ok && key != "" {
+			return key
+		}
+	}
+	return opCtx.Headers.Get(HeaderName)
+}
+
+// requestHash identifies the payload the key was sent with
+func requestHash(opCtx *graphql.OperationContext) (string, error) {
+	vars, err := json.Marshal(opCtx.Variables)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\x00%s\x00", opCtx.OperationName, opCtx.RawQuery)
+	sum.Write(vars)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// keyOwner scopes keys to the caller, two users can't see each other's responses
+func keyOwner(ctx context.Context) string {
+	if userID, err := sessionutils.IdFromContex(ctx); err == nil {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	if guestID, ok := guest.IdFromContext(ctx); ok {
+		return "guest:" + guestID
+	}
+	return "anonymous"
+}
+
+func conflict(message string) *graphql.Response {
+	return &graphql.Response{
+		Errors: gqlerror.List{{
+			Message:    message,
+			Extensions: map[string]interface{}{"code": "CONFLICT"},
+		}},
+	}
+}
+
+func (e *Extension) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	opCtx := graphql.GetOperationContext(ctx)
+	if opCtx.Operation == nil || opCtx.Operation.Operation != ast.Mutation {
+		return next(ctx)
+	}
+	key := requestKey(opCtx)
+	if key == "" {
+		return next(ctx)
+	}
+	hash, err := requestHash(opCtx)
+	if err != nil {
+		return graphql.ErrorResponse(ctx, "failed to hash request: %v", err)
+	}
+
+	id := keyOwner(ctx) + ":" + key
+	record, fresh, err := e.Repo.Reserve(ctx, id, hash)
+	if err != nil {
+		return graphql.ErrorResponse(ctx, "%v", err)
+	}
+	if !fresh {
+		if record.Hash != hash {
+			return conflict("idempotency key was used with another request")
+		}
+		switch {
+		case record.Status == StatusUnknown,
+			record.Status == StatusPending && !record.LeaseUntil.After(time.Now().UTC()):
+			// the handler ran or may have run, running it again could repeat the mutation
+			return conflict("outcome of the request with this idempotency key is unknown")
+		case record.Status != StatusDone:
+			return conflict("request with this idempotency key is in progress")
+		}
+		resp := &graphql.Response{}
+		if err := json.Unmarshal(record.Response, resp); err != nil {
+			return graphql.ErrorResponse(ctx, "failed to read stored response: %v", err)
+		}
+		return resp
+	}
+
+	started, err := e.Repo.Start(ctx, id, hash)
+	if err != nil {
+		if err := e.Repo.Release(ctx, id); err != nil {
+			log.Printf("failed to release idempotency key %s: %v", id, err)
+		}
+		return graphql.ErrorResponse(ctx, "%v", err)
+	}
+	if !started {
+		return conflict("request with this idempotency key is in progress")
+	}
+
+	resp := next(ctx)
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = e.Repo.Complete(ctx, id, data)
+	}
+	if err != nil {
+		// the mutation ran, the key stays taken so a retry can't run it again
+		log.Printf("failed to store response for idempotency key %s: %v", id, err)
+		if err := e.Repo.Fail(ctx, id); err != nil {
+			log.Printf("failed to mark idempotency key %s: %v", id, err)
+		}
+	}
+	return resp
+}
+
+func CreateExtension(repo IdempotencyRepoInterface) *Extension {
+	return &Extension{
+		Repo: repo,
+	}
+}
@@ -0,0 +1,146 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// StatusReserved is a key taken for a request whose handler hasn't started
+	StatusReserved = "reserved"
+	// StatusPending is a key whose handler started, it is never taken over or released
+	StatusPending = "pending"
+	StatusDone    = "done"
+	// StatusUnknown is a key whose handler ran but whose response couldn't be stored
+	StatusUnknown = "unknown"
+	// DefaultRetention is how long a key and its response are kept
+	DefaultRetention = 24 * time.Hour
+	// DefaultLease is how long a key is held, a request that died before its handler
+	// started frees its key when the lease runs out, a started one turns unknown
+	DefaultLease = time.Minute
+)
+
+// Record is a request made with an idempotency key. Response is the JSON
+// of the first response and is empty while the request runs
+type Record struct {
+	ID         string `bson:"_id"`
+	Hash       string
+	Status     string
+	Response   []byte
+	CreatedAt  time.Time
+	LeaseUntil time.Time
+}
+
+type IdempotencyRepoInterface interface {
+	Reserve(ctx context.Context, id, hash string) (*Record, bool, error)
+	Start(ctx context.Context, id, hash string) (bool, error)
+	Complete(ctx context.Context, id string, response []byte) error
+	Fail(ctx context.Context, id string) error
+	Release(ctx context.Context, id string) error
+}
+
+type IdempotencyRepo struct {
+	StMongoDB *mongo.Collection
+	Retention time.Duration
+	Lease     time.Duration
+}
+
+// Reserve takes the key for a new request. If the key was taken before
+// it returns the existing record and false, unless it is a reserved one whose lease ran out.
+// A key whose handler started is never taken over, it may have run already
+func (IR *IdempotencyRepo) Reserve(ctx context.Context, id, hash string) (*Record, bool, error) {
+	now := time.Now().UTC()
+	record := &Record{
+		ID:         id,
+		Hash:       hash,
+		Status:     StatusReserved,
+		CreatedAt:  now,
+		LeaseUntil: now.Add(IR.Lease),
+	}
+	_, err := IR.StMongoDB.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, false, err
+	}
+	res, err := IR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusReserved, "leaseuntil": bson.M{"$not": bson.M{"$gt": now}}},
+		bson.M{"$set": bson.M{"hash": hash, "createdat": now, "leaseuntil": record.LeaseUntil}},
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if res.MatchedCount == 1 {
+		return record, true, nil
+	}
+	var existing *Record
+	err = IR.StMongoDB.FindOne(ctx, bson.M{"_id": id}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		// expired between the insert and the lookup
+		return nil, false, fmt.Errorf("idempotency key expired, retry the request")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return existing, false, nil
+}
+
+// Start marks the handler of the reserved key as started. It reports false
+// if the lease ran out and another request took the key over, then the handler must not run
+func (IR *IdempotencyRepo) Start(ctx context.Context, id, hash string) (bool, error) {
+	res, err := IR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": id, "hash": hash, "status": StatusReserved},
+		bson.M{"$set": bson.M{"status": StatusPending, "leaseuntil": time.Now().UTC().Add(IR.Lease)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (IR *IdempotencyRepo) Complete(ctx context.Context, id string, response []byte) error {
+	_, err := IR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": StatusDone, "response": response}},
+	)
+	return err
+}
+
+// Fail marks the key of a request that ran without a stored response,
+// retries get a conflict instead of running the mutation again
+func (IR *IdempotencyRepo) Fail(ctx context.Context, id string) error {
+	_, err := IR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusPending},
+		bson.M{"$set": bson.M{"status": StatusUnknown}},
+	)
+	return err
+}
+
+// Release frees the key of a request whose handler didn't start, so it can be retried
+func (IR *IdempotencyRepo) Release(ctx context.Context, id string) error {
+	_, err := IR.StMongoDB.DeleteOne(ctx, bson.M{"_id": id, "status": StatusReserved})
+	return err
+}
+
+// EnsureIndexes lets Mongo drop keys after the retention window
+func (IR *IdempotencyRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := IR.StMongoDB.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"createdat": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(IR.Retention.Seconds())),
+	})
+	return err
+}
+
+func CreateIdempotencyRepo(St *mongo.Collection) *IdempotencyRepo {
+	return &IdempotencyRepo{
+		StMongoDB: St,
+		Retention: DefaultRetention,
+		Lease:     DefaultLease,
+	}
+}
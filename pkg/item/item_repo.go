@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"hw11_shopql/graph/model"
 	"hw11_shopql/pkg/comment"
+	"hw11_shopql/pkg/outbox"
 	"hw11_shopql/pkg/rate"
+	"strconv"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -15,16 +17,25 @@ import (
 type ItemRepoInterface interface {
 	AddItem(ctx context.Context, itemInput model.ItemInput) (*model.Item, error)
 	UpdateItemQuantity(ctx context.Context, itemID, newQuantity int) error
-	AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string) (*model.Comment, error)
-	AddComment(ctx context.Context, userID, itemID int, commentText string) (*model.Comment, error)
+	UpdateItem(ctx context.Context, in model.ItemUpdateInput) (*model.Item, error)
+	RestockItem(ctx context.Context, itemID, quantity int) (*model.Item, error)
+	TakeStock(ctx context.Context, itemID, quantity int) error
+	AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string, verified bool) (*model.Comment, error)
+	CommentItemID(ctx context.Context, commentID string) (int, error)
+	AddComment(ctx context.Context, userID, itemID int, commentText string, verified bool) (*model.Comment, error)
 	ItemsRate(ctx context.Context, itemID int) (float64, error)
-	RateItem(ctx context.Context, userID, itemID, rate int) (*model.Item, error)
+	ItemsRateStats(ctx context.Context, itemID int) (*rate.RateStats, error)
+	UserRate(ctx context.Context, userID, itemID int) (*int, error)
+	ItemRates(ctx context.Context, itemID int, limit int, offset int) ([]*rate.Rate, error)
+	ItemsDimensionRates(ctx context.Context, itemID int) ([]*rate.DimensionStats, error)
+	RateItem(ctx context.Context, userID, itemID, rate int, verified bool, dimensions []rate.DimensionRate) (*model.Item, error)
 	GetItemByID(ctx context.Context, id int) (*model.Item, error)
 	InStockByQuantity(quantity int) string
 	InsertCatalogsItems(ctx context.Context, catalog model.Catalog) error
 	ItemExists(ctx context.Context, id int) (bool, error)
-	GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int) ([]*model.Item, error)
+	GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int, sort model.ItemSort, hiddenSellers []int) ([]*model.Item, error)
 	GetItemsBySellerID(ctx context.Context, seller_id int, limit *int, offset *int) ([]*model.Item, error)
+	GetItemIDsBySellerID(ctx context.Context, seller_id int) ([]int, error)
 }
 
 type ItemRepo struct {
@@ -37,17 +48,24 @@ func (IH *ItemRepo) AddItem(ctx context.Context, itemInput model.ItemInput) (*mo
 	if itemInput.InStock < 0 {
 		return nil, fmt.Errorf("instock can't be less then 0")
 	}
+	if itemInput.Price != nil && *itemInput.Price < 0 {
+		return nil, fmt.Errorf("price can't be less then 0")
+	}
 	if ok, _ := IH.ItemExists(ctx, itemInput.ItemID); ok {
 		return nil, fmt.Errorf("item already exist")
 	}
 	item := &model.Item{
-		ID:          itemInput.ItemID,
-		Name:        itemInput.Name,
-		SellerID:    itemInput.SellerID,
-		InStock:     itemInput.InStock,
-		Rate:        0,
-		InStockText: IH.InStockByQuantity(itemInput.InStock),
-		CatalogID:   itemInput.CatalogID,
+		ID:             itemInput.ItemID,
+		Name:           itemInput.Name,
+		SellerID:       itemInput.SellerID,
+		InStock:        itemInput.InStock,
+		Rate:           0,
+		BayesianRating: IH.RateRepo.Bayesian(0, 0),
+		InStockText:    IH.InStockByQuantity(itemInput.InStock),
+		CatalogID:      itemInput.CatalogID,
+	}
+	if itemInput.Price != nil {
+		item.Price = *itemInput.Price
 	}
 	_, err := IH.StMongoDB.InsertOne(ctx, item)
 	if err != nil {
@@ -56,32 +74,154 @@ func (IH *ItemRepo) AddItem(ctx context.Context, itemInput model.ItemInput) (*mo
 	return item, nil
 }
 
+// stockEvent goes into the outbox with a stock change, it carries the new inStock and the delta
+func stockEvent(itemID int, inStock, delta interface{}) outbox.Event {
+	return outbox.NewEvent(outbox.StockChanged, strconv.Itoa(itemID), bson.M{
+		"itemID":  itemID,
+		"inStock": inStock,
+		"delta":   delta,
+	})
+}
+
+// stockText is InStockByQuantity as an expression over the new stock
+func stockText(inStock interface{}) bson.M {
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$lte": bson.A{inStock, 1}}, "then": "мало"},
+			bson.M{"case": bson.M{"$lte": bson.A{inStock, 3}}, "then": "хватает"},
+		},
+		"default": "много",
+	}}
+}
+
+// stockUpdate sets the stock to inStock, a number or an expression over the current stock, with the fields of set.
+// It is a pipeline update, so the stock text and the event with the new stock and the delta come from the same single write
+func stockUpdate(itemID int, inStock interface{}, set bson.M) mongo.Pipeline {
+	event := stockEvent(itemID, inStock, bson.M{"$subtract": bson.A{inStock, "$instock"}})
+	fields := bson.M{
+		"instock":     inStock,
+		"instocktext": stockText(inStock),
+		outbox.Field: bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$" + outbox.Field, bson.A{}}},
+			bson.A{event},
+		}},
+	}
+	for key, value := range set {
+		fields[key] = bson.M{"$literal": value}
+	}
+	return mongo.Pipeline{{{Key: "$set", Value: fields}}}
+}
+
+// changeStock applies stockUpdate to the item matching filter and returns the updated item.
+// It returns mongo.ErrNoDocuments if no item matched
+func (IH *ItemRepo) changeStock(ctx context.Context, filter bson.M, itemID int, inStock interface{}, set bson.M) (*model.Item, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var item *model.Item
+	err := IH.StMongoDB.FindOneAndUpdate(ctx, filter, stockUpdate(itemID, inStock, set), opts).Decode(&item)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
 func (IH *ItemRepo) UpdateItemQuantity(ctx context.Context, itemID, newQuantity int) error {
-	filter := bson.M{
-		"id": itemID,
+	_, err := IH.changeStock(ctx, bson.M{"id": itemID}, itemID, newQuantity, nil)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("item not exist")
 	}
-	update := bson.M{
-		"$set": bson.M{
-			"in_stock": newQuantity,
-		},
+	return err
+}
+
+func (IH *ItemRepo) UpdateItem(ctx context.Context, in model.ItemUpdateInput) (*model.Item, error) {
+	set := bson.M{}
+	if in.Name != nil {
+		set["name"] = *in.Name
+	}
+	if in.CatalogID != nil {
+		set["catalogid"] = *in.CatalogID
+	}
+	if in.Price != nil {
+		if *in.Price < 0 {
+			return nil, fmt.Errorf("price can't be less then 0")
+		}
+		set["price"] = *in.Price
 	}
-	_, err := IH.StMongoDB.UpdateOne(ctx, filter, update)
+	if in.InStock != nil {
+		if *in.InStock < 0 {
+			return nil, fmt.Errorf("instock can't be less then 0")
+		}
+		item, err := IH.changeStock(ctx, bson.M{"id": in.ItemID}, in.ItemID, *in.InStock, set)
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("item not exist")
+		}
+		return item, err
+	}
+	if len(set) == 0 {
+		return IH.GetItemByID(ctx, in.ItemID)
+	}
+	filter := bson.M{
+		"id": in.ItemID,
+	}
+	res, err := IH.StMongoDB.UpdateOne(ctx, filter, bson.M{"$set": set})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("item not exist")
+	}
+	return IH.GetItemByID(ctx, in.ItemID)
+}
+
+func (IH *ItemRepo) RestockItem(ctx context.Context, itemID, quantity int) (*model.Item, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("quantity must be positive")
+	}
+	item, err := IH.changeStock(ctx, bson.M{"id": itemID}, itemID, bson.M{"$add": bson.A{"$instock", quantity}}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("item not exist")
+	}
+	return item, err
+}
+
+// TakeStock decrements the stock by quantity only if that much is left.
+// The check and the decrement are one update, so concurrent orders can't oversell
+func (IH *ItemRepo) TakeStock(ctx context.Context, itemID, quantity int) error {
+	if quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+	filter := bson.M{
+		"id":      itemID,
+		"instock": bson.M{"$gte": quantity},
+	}
+	_, err := IH.changeStock(ctx, filter, itemID, bson.M{"$subtract": bson.A{"$instock", quantity}}, nil)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("not enough quantity")
 	}
 	return err
 }
 
-func (IH *ItemRepo) AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string) (*model.Comment, error) {
-	comment, err := IH.CommentRepo.AddCommentToCommnet(ctx, userID, commentID, commentText)
+func (IH *ItemRepo) AddCommentToCommnet(ctx context.Context, userID int, commentID string, commentText string, verified bool) (*model.Comment, error) {
+	comment, err := IH.CommentRepo.AddCommentToCommnet(ctx, userID, commentID, commentText, verified)
 	if err != nil {
 		return nil, err
 	}
 	return comment, nil
 }
 
-func (IH *ItemRepo) AddComment(ctx context.Context, userID, itemID int, commentText string) (*model.Comment, error) {
-	comment, err := IH.CommentRepo.AddCommentToItem(ctx, userID, itemID, commentText)
+// CommentItemID returns the item the comment was left on
+func (IH *ItemRepo) CommentItemID(ctx context.Context, commentID string) (int, error) {
+	comment, err := IH.CommentRepo.FindComment(ctx, commentID)
+	if err == mongo.ErrNoDocuments {
+		return 0, fmt.Errorf("comment not exist")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return comment.ItemsID, nil
+}
+
+func (IH *ItemRepo) AddComment(ctx context.Context, userID, itemID int, commentText string, verified bool) (*model.Comment, error) {
+	comment, err := IH.CommentRepo.AddCommentToItem(ctx, userID, itemID, commentText, verified)
 	if err != nil {
 		return nil, err
 	}
@@ -96,8 +236,40 @@ func (IH *ItemRepo) ItemsRate(ctx context.Context, itemID int) (float64, error)
 	return rate, nil
 }
 
-func (IH *ItemRepo) RateItem(ctx context.Context, userID, itemID, rate int) (*model.Item, error) {
-	err := IH.RateRepo.RateItem(ctx, userID, itemID, rate)
+func (IH *ItemRepo) ItemsRateStats(ctx context.Context, itemID int) (*rate.RateStats, error) {
+	stats, err := IH.RateRepo.ItemsRateStats(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (IH *ItemRepo) UserRate(ctx context.Context, userID, itemID int) (*int, error) {
+	rate, err := IH.RateRepo.UserRate(ctx, userID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return rate, nil
+}
+
+func (IH *ItemRepo) ItemRates(ctx context.Context, itemID int, limit int, offset int) ([]*rate.Rate, error) {
+	rates, err := IH.RateRepo.ItemRates(ctx, itemID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+func (IH *ItemRepo) ItemsDimensionRates(ctx context.Context, itemID int) ([]*rate.DimensionStats, error) {
+	stats, err := IH.RateRepo.ItemsDimensionRates(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (IH *ItemRepo) RateItem(ctx context.Context, userID, itemID, rate int, verified bool, dimensions []rate.DimensionRate) (*model.Item, error) {
+	err := IH.RateRepo.RateItem(ctx, userID, itemID, rate, verified, dimensions)
 	if err != nil {
 		return nil, err
 	}
@@ -138,6 +310,7 @@ func (IH *ItemRepo) InsertCatalogsItems(ctx context.Context, catalog model.Catal
 		} else {
 			item.InStockText = "много"
 		}
+		item.BayesianRating = IH.RateRepo.Bayesian(item.RatingSum, item.RatingCount)
 		if ok, _ := IH.ItemExists(ctx, item.ID); !ok {
 			_, err := IH.StMongoDB.InsertOne(ctx, item)
 			if err != nil {
@@ -165,7 +338,7 @@ func (IH *ItemRepo) ItemExists(ctx context.Context, id int) (bool, error) {
 
 }
 
-func (CH *ItemRepo) GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int) ([]*model.Item, error) {
+func (CH *ItemRepo) GetItemsByCatalogID(ctx context.Context, catalogID int, limit int, offset int, sort model.ItemSort, hiddenSellers []int) ([]*model.Item, error) {
 	if limit <= 0 {
 		limit = 3 // Default limit
 	}
@@ -176,10 +349,16 @@ func (CH *ItemRepo) GetItemsByCatalogID(ctx context.Context, catalogID int, limi
 	filter := bson.M{
 		"catalogid": catalogID, // Assuming items have a catalog_id field
 	}
+	if len(hiddenSellers) > 0 {
+		filter["sellerid"] = bson.M{"$nin": hiddenSellers}
+	}
 
 	findOptions := options.Find().
 		SetLimit(int64(limit)).
 		SetSkip(int64(offset))
+	if sort == model.ItemSortTopRated {
+		findOptions.SetSort(bson.D{{Key: "bayesianrating", Value: -1}, {Key: "id", Value: 1}})
+	}
 
 	cursor, err := CH.StMongoDB.Find(ctx, filter, findOptions)
 	if err != nil {
@@ -212,6 +391,32 @@ func (CH *ItemRepo) GetItemsBySellerID(ctx context.Context, seller_id int, limit
 	return items, nil
 }
 
+func (CH *ItemRepo) GetItemIDsBySellerID(ctx context.Context, seller_id int) ([]int, error) {
+	filter := bson.M{
+		"sellerid": seller_id,
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetProjection(bson.M{"id": 1})
+	cursor, err := CH.StMongoDB.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find items: %w", err)
+	}
+	defer cursor.Close(ctx)
+	ids := []int{}
+	for cursor.Next(ctx) {
+		var item model.Item
+		if err := cursor.Decode(&item); err != nil {
+			return nil, fmt.Errorf("failed to decode items: %w", err)
+		}
+		ids = append(ids, item.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func CreateItemsHandler(collection *mongo.Collection, rateRepoI rate.RateRepoInterface, commentRepoI comment.CommentRepoInterface) *ItemRepo {
 	return &ItemRepo{
 		StMongoDB:   collection,
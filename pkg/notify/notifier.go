@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const KindCartReminder = "cart_reminder"
+
+type Notification struct {
+	UserID    int       `json:"userID"`
+	Kind      string    `json:"kind"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Notifier delivers notifications to users, email or push senders plug in here
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogNotifier only writes notifications to the log, for local runs
+type LogNotifier struct{}
+
+func (LN *LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("notify user %d [%s]: %s", n.UserID, n.Kind, n.Text)
+	return nil
+}
+
+// FileNotifier appends notifications to a file, one JSON per line
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (FN *FileNotifier) Notify(ctx context.Context, n Notification) error {
+	FN.mu.Lock()
+	defer FN.mu.Unlock()
+	file, err := os.OpenFile(FN.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(n)
+}
+
+func CreateFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{
+		Path: path,
+	}
+}
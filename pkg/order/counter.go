@@ -0,0 +1,66 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ordersSequence = "orders"
+
+// Counters keeps named sequences in Mongo, so IDs survive restarts
+// and stay unique between replicas
+type Counters struct {
+	St *mongo.Collection
+}
+
+func (C *Counters) Next(ctx context.Context, name string) (int, error) {
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	err := C.St.FindOneAndUpdate(ctx, bson.M{"_id": name}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+// Seed moves the sequence up to at least floor, a higher sequence is left as is
+func (C *Counters) Seed(ctx context.Context, name string, floor int) error {
+	_, err := C.St.UpdateOne(ctx,
+		bson.M{"_id": name},
+		bson.M{"$max": bson.M{"seq": floor}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// SeedCounter seeds the order sequence from the highest stored order ID,
+// so a lost or fresh counters collection doesn't hand out IDs already taken
+func (OR *OrderRepo) SeedCounter(ctx context.Context) error {
+	var last struct {
+		OrderID int `bson:"orderid"`
+	}
+	err := OR.St.FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.M{"orderid": -1}).SetProjection(bson.M{"orderid": 1}),
+	).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return OR.Counters.Seed(ctx, ordersSequence, last.OrderID)
+}
+
+// OrderNumber is the number shown to buyers, e.g. SQ-2026-000123
+func OrderNumber(orderID int, createdAt time.Time) string {
+	return fmt.Sprintf("SQ-%d-%06d", createdAt.Year(), orderID)
+}
@@ -0,0 +1,30 @@
+package order
+
+import (
+	"fmt"
+	"hw11_shopql/graph/model"
+	"regexp"
+	"strings"
+)
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{5,18}[0-9]$`)
+
+// ValidateDelivery checks the checkout details, pickup orders need no address
+func ValidateDelivery(delivery *model.Delivery) error {
+	if delivery == nil {
+		return fmt.Errorf("delivery details are required")
+	}
+	if !delivery.Method.IsValid() {
+		return fmt.Errorf("unknown delivery method %q", delivery.Method)
+	}
+	if strings.TrimSpace(delivery.Recipient) == "" {
+		return fmt.Errorf("recipient is required")
+	}
+	if !phonePattern.MatchString(delivery.Phone) {
+		return fmt.Errorf("bad phone number %q", delivery.Phone)
+	}
+	if delivery.Method != model.DeliveryMethodPickup && delivery.Address == nil {
+		return fmt.Errorf("address is required for %s delivery", delivery.Method)
+	}
+	return nil
+}
@@ -2,7 +2,13 @@ package order
 
 import (
 	"context"
+	"fmt"
 	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/cart"
+	"hw11_shopql/pkg/outbox"
+	"log"
+	"strconv"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -10,49 +16,453 @@ import (
 
 type CartRepoInterface interface {
 	GetCartItems(ctx context.Context, UserID int) ([]*model.CartItem, error)
+	CartLines(ctx context.Context, UserID int) ([]cart.Cart, error)
+	ReserveLines(ctx context.Context, UserID, OrderID int, ItemIDs []int) (int, error)
+	MarkTaken(ctx context.Context, OrderID, ItemID, quantity int) error
+	ReleaseLine(ctx context.Context, OrderID, ItemID int) (int, error)
+	RemoveReservedLines(ctx context.Context, OrderID int) error
+	ReservedLines(ctx context.Context, UserID int) ([]cart.Cart, error)
 }
 
+// ReservationLease is how long cart lines stay reserved for an order that wasn't stored,
+// after it the next CreateOrder of the user puts them back into the cart
+const ReservationLease = 10 * time.Minute
+
 type ItemRepoInterface interface {
-	UpdateItemQuantity(ctx context.Context, itemID, newQuantity int) error
+	TakeStock(ctx context.Context, itemID, quantity int) error
+	GetItemByID(ctx context.Context, id int) (*model.Item, error)
+	RestockItem(ctx context.Context, itemID, quantity int) (*model.Item, error)
+}
+
+type StatsRefresherInterface interface {
+	MarkStale(ctx context.Context) error
+}
+
+type PublisherInterface interface {
+	Publish(topic string, msg interface{})
+}
+
+type LedgerInterface interface {
+	RecordDelivery(ctx context.Context, shipment *model.Shipment) error
+	ReverseSale(ctx context.Context, ref string, orderID, itemID, quantity int) error
+}
+
+type RefunderInterface interface {
+	RefundPayments(ctx context.Context, orderID int) error
+}
+
+type SellerRepoInterface interface {
+	DeactivatedSellerIDs(ctx context.Context) ([]int, error)
 }
 
 type OrderRepo struct {
 	St        *mongo.Collection
 	CartRepoI CartRepoInterface
 	ItemRepoI ItemRepoInterface
-	count     int
+	// Stats is marked stale after every change of orders, may be nil
+	Stats StatsRefresherInterface
+	// Ledger books the lines of delivered orders and reverses them on cancel, may be nil
+	Ledger   LedgerInterface
+	Counters *Counters
+	// Events gets the order after every status change, may be nil
+	Events PublisherInterface
+	// Sellers tells whose items are no longer sold, may be nil
+	Sellers SellerRepoInterface
+	// Payments refunds what a cancelled order was paid, may be nil
+	Payments RefunderInterface
+}
+
+// hiddenSellers returns the deactivated sellers, their items can't be ordered
+func (OR *OrderRepo) hiddenSellers(ctx context.Context) (map[int]bool, error) {
+	hidden := make(map[int]bool)
+	if OR.Sellers == nil {
+		return hidden, nil
+	}
+	ids, err := OR.Sellers.DeactivatedSellerIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		hidden[id] = true
+	}
+	return hidden, nil
 }
 
 type OrderRepoInterface interface {
-	CreateOrder(ctx context.Context, userID int) (*model.Order, error)
+	CreateOrder(ctx context.Context, userID int, delivery *model.Delivery, fingerprint string) (*model.Order, error)
+	PreviewOrder(ctx context.Context, userID int) (*model.OrderPreview, error)
+	UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, actor string, note *string) (*model.Order, error)
+	ReturnOrder(ctx context.Context, orderID int, actor string) (*model.Order, error)
+	AcceptReturn(ctx context.Context, orderID int, returnID string) error
+	CancelOrder(ctx context.Context, orderID, userID int, admin bool, reason *string) (*model.Order, error)
 	UsersOrders(ctx context.Context, userID int) ([]*model.Order, error)
+	OrderByID(ctx context.Context, orderID int) (*model.Order, error)
+	OrderByNumber(ctx context.Context, number string) (*model.Order, error)
+	SellerShipments(ctx context.Context, sellerIDs []int) ([]*model.Shipment, error)
+	UpdateShipment(ctx context.Context, in model.ShipmentInput) (*model.Shipment, error)
+	SearchOrders(ctx context.Context, filter *model.OrderFilter, sort model.OrderSort, first int, after string) (*model.OrderPage, error)
 }
 
-func (OR *OrderRepo) CreateOrder(ctx context.Context, userID int) (*model.Order, error) {
-	items, err := OR.CartRepoI.GetCartItems(ctx, userID)
-	order := &model.Order{}
-	order.UserID = userID
-	order.OrderID = OR.count
-	OR.count++
+const (
+	ShipmentCreated    = "created"
+	ShipmentAssembling = "assembling"
+	ShipmentShipped    = "shipped"
+	ShipmentDelivered  = "delivered"
+)
 
+// ShipmentTransitions lists the statuses a shipment may move to from each status, delivered is final
+var ShipmentTransitions = map[string][]string{
+	ShipmentCreated:    {ShipmentAssembling, ShipmentShipped},
+	ShipmentAssembling: {ShipmentShipped},
+	ShipmentShipped:    {ShipmentDelivered},
+}
+
+// shippable lists the order statuses its shipments may change in,
+// nothing is sent before the payment or after the order is closed
+var shippable = []model.OrderStatus{
+	model.OrderStatusPaid,
+	model.OrderStatusAssembling,
+	model.OrderStatusShipped,
+}
+
+func knownShipmentStatus(status string) bool {
+	_, ok := ShipmentTransitions[status]
+	return ok || status == ShipmentDelivered
+}
+
+// shipmentFrom returns the statuses a shipment may have to move to status
+func shipmentFrom(status string) []string {
+	var from []string
+	for prev, next := range ShipmentTransitions {
+		for _, to := range next {
+			if to == status {
+				from = append(from, prev)
+			}
+		}
+	}
+	return from
+}
+
+// CreateOrder places the cart as an order. A non empty fingerprint must match
+// the current PreviewOrder, otherwise the cart changed after the buyer looked at it.
+// With a fingerprint the order takes the quantities of the preview.
+// The ordered lines are reserved with the order id before stock is taken, so they
+// can't be ordered twice. Once the order is stored they are deleted, if that fails
+// they stay reserved and the next call of the user deletes them
+func (OR *OrderRepo) CreateOrder(ctx context.Context, userID int, delivery *model.Delivery, fingerprint string) (*model.Order, error) {
+	if err := ValidateDelivery(delivery); err != nil {
+		return nil, err
+	}
+	if err := OR.settleReservations(ctx, userID); err != nil {
+		return nil, err
+	}
+	var items []*model.CartItem
+	var err error
+	if fingerprint != "" {
+		items, err = OR.previewedItems(ctx, userID, fingerprint)
+	} else {
+		items, err = OR.CartRepoI.GetCartItems(ctx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("cart is empty")
+	}
+	hidden, err := OR.hiddenSellers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Item != nil && hidden[item.Item.SellerID] {
+			return nil, fmt.Errorf("item %d is no longer sold", item.Item.ID)
+		}
+	}
+	orderID, err := OR.Counters.Next(ctx, ordersSequence)
 	if err != nil {
 		return nil, err
 	}
+	itemIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.Item.ID)
+	}
+	reserved, err := OR.CartRepoI.ReserveLines(ctx, userID, orderID, itemIDs)
+	if err != nil {
+		OR.release(ctx, orderID, itemIDs)
+		return nil, err
+	}
+	if reserved != len(itemIDs) {
+		OR.release(ctx, orderID, itemIDs)
+		return nil, fmt.Errorf("cart changed while placing the order")
+	}
+
+	createdAt := time.Now().UTC()
+	order := &model.Order{}
+	order.UserID = userID
+	order.OrderID = orderID
+	order.Number = OrderNumber(orderID, createdAt)
+	order.CreatedAt = createdAt.Format(time.RFC3339)
+	order.Delivery = delivery
 
 	for _, item := range items {
-		err = OR.ItemRepoI.UpdateItemQuantity(ctx, item.Item.ID, item.Item.InStock-item.Quantity)
+		if err := OR.ItemRepoI.TakeStock(ctx, item.Item.ID, item.Quantity); err != nil {
+			OR.release(ctx, orderID, itemIDs)
+			return nil, fmt.Errorf("item %d: %w", item.Item.ID, err)
+		}
+		if err := OR.CartRepoI.MarkTaken(ctx, orderID, item.Item.ID, item.Quantity); err != nil {
+			OR.restock(ctx, item.Item.ID, item.Quantity)
+			OR.release(ctx, orderID, itemIDs)
+			return nil, err
+		}
 		order.Items = append(order.Items, item)
+		order.Total += item.Item.Price * float64(item.Quantity)
+	}
+
+	order.Shipments = splitShipments(order)
+	order.Status = model.OrderStatusCreated
+	order.StatusHistory = []*model.OrderStatusChange{statusChange(model.OrderStatusCreated, UserActor(userID), nil)}
+	doc, err := outbox.Attach(order, createdEvent(order))
+	if err != nil {
+		OR.release(ctx, orderID, itemIDs)
+		return nil, err
+	}
+	if _, err := OR.St.InsertOne(ctx, doc); err != nil {
+		// the insert may have been written before the error, then the order stands
+		stored, lookupErr := OR.orderStored(ctx, orderID)
+		if lookupErr != nil {
+			return nil, err
+		}
+		if !stored {
+			OR.release(ctx, orderID, itemIDs)
+			return nil, err
+		}
+	}
+
+	if err := OR.CartRepoI.RemoveReservedLines(ctx, orderID); err != nil {
+		log.Printf("failed to remove the lines of order %d from the cart: %v", orderID, err)
+	}
+	OR.ordersChanged(ctx)
+	OR.publish(order)
+	return order, nil
+}
+
+func createdEvent(order *model.Order) outbox.Event {
+	lines := make([]bson.M, 0, len(order.Items))
+	for _, line := range order.Items {
+		lines = append(lines, bson.M{"itemID": line.Item.ID, "quantity": line.Quantity, "price": line.Item.Price})
+	}
+	return outbox.NewEvent(outbox.OrderCreated, strconv.Itoa(order.OrderID), bson.M{
+		"orderID": order.OrderID,
+		"number":  order.Number,
+		"userID":  order.UserID,
+		"total":   order.Total,
+		"items":   lines,
+	})
+}
+
+// orderStored reports whether the order with the id was inserted
+func (OR *OrderRepo) orderStored(ctx context.Context, orderID int) (bool, error) {
+	count, err := OR.St.CountDocuments(ctx, bson.M{"orderid": orderID})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// release puts the reserved lines of an order that wasn't stored back into the cart
+// and returns what they had taken to stock. A line that can't be released
+// stays reserved until settleReservations picks it up
+func (OR *OrderRepo) release(ctx context.Context, orderID int, itemIDs []int) {
+	for _, itemID := range itemIDs {
+		taken, err := OR.CartRepoI.ReleaseLine(ctx, orderID, itemID)
+		if err != nil {
+			log.Printf("failed to release item %d of order %d: %v", itemID, orderID, err)
+			continue
+		}
+		OR.restock(ctx, itemID, taken)
+	}
+}
+
+// restock returns a taken quantity to stock
+func (OR *OrderRepo) restock(ctx context.Context, itemID, quantity int) {
+	if quantity <= 0 {
+		return
+	}
+	if _, err := OR.ItemRepoI.RestockItem(ctx, itemID, quantity); err != nil {
+		log.Printf("failed to return %d of item %d to stock: %v", quantity, itemID, err)
+	}
+}
+
+// settleReservations finishes the orders of the user that stopped after reserving cart lines.
+// Lines of a stored order leave the cart, lines reserved longer than ReservationLease
+// by an order that was never stored go back to the cart
+func (OR *OrderRepo) settleReservations(ctx context.Context, userID int) error {
+	lines, err := OR.CartRepoI.ReservedLines(ctx, userID)
+	if err != nil {
+		return err
+	}
+	byOrder := make(map[int][]cart.Cart)
+	for _, line := range lines {
+		byOrder[line.Order_id] = append(byOrder[line.Order_id], line)
+	}
+	expired := time.Now().UTC().Add(-ReservationLease)
+	for orderID, lines := range byOrder {
+		stored, err := OR.orderStored(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if stored {
+			if err := OR.CartRepoI.RemoveReservedLines(ctx, orderID); err != nil {
+				return err
+			}
+			continue
+		}
+		var itemIDs []int
+		for _, line := range lines {
+			if line.Reserved_at == nil || line.Reserved_at.Before(expired) {
+				itemIDs = append(itemIDs, line.Item_id)
+			}
+		}
+		OR.release(ctx, orderID, itemIDs)
+	}
+	return nil
+}
+
+// splitShipments groups the order lines by seller, one shipment per seller
+func splitShipments(order *model.Order) []*model.Shipment {
+	var shipments []*model.Shipment
+	bySeller := make(map[int]*model.Shipment)
+	for _, line := range order.Items {
+		shipment, ok := bySeller[line.Item.SellerID]
+		if !ok {
+			shipment = &model.Shipment{
+				ShipmentID: fmt.Sprintf("%d-%d", order.OrderID, line.Item.SellerID),
+				OrderID:    order.OrderID,
+				SellerID:   line.Item.SellerID,
+				Status:     ShipmentCreated,
+			}
+			bySeller[line.Item.SellerID] = shipment
+			shipments = append(shipments, shipment)
+		}
+		shipment.Items = append(shipment.Items, line)
+	}
+	return shipments
+}
+
+func (OR *OrderRepo) SellerShipments(ctx context.Context, sellerIDs []int) ([]*model.Shipment, error) {
+	shipments := []*model.Shipment{}
+	if len(sellerIDs) == 0 {
+		return shipments, nil
+	}
+	own := make(map[int]bool, len(sellerIDs))
+	for _, id := range sellerIDs {
+		own[id] = true
+	}
+	filter := bson.M{"shipments.sellerid": bson.M{"$in": sellerIDs}}
+	cur, err := OR.St.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var order *model.Order
+		if err := cur.Decode(&order); err != nil {
+			return nil, err
+		}
+		for _, shipment := range order.Shipments {
+			if own[shipment.SellerID] {
+				shipments = append(shipments, shipment)
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	return shipments, nil
+}
+
+// UpdateShipment moves the seller's shipment along ShipmentTransitions while the order is shippable.
+// The checks and the change are one update, like for order statuses.
+// A delivered shipment books nothing, sales are booked when the whole order is delivered
+func (OR *OrderRepo) UpdateShipment(ctx context.Context, in model.ShipmentInput) (*model.Shipment, error) {
+	set := bson.M{}
+	match := bson.M{"sellerid": in.SellerID}
+	if in.Status != nil {
+		if !knownShipmentStatus(*in.Status) {
+			return nil, fmt.Errorf("unknown shipment status %q", *in.Status)
+		}
+		match["status"] = bson.M{"$in": shipmentFrom(*in.Status)}
+		set["shipments.$.status"] = *in.Status
+	}
+	if in.TrackingNumber != nil {
+		set["shipments.$.trackingnumber"] = *in.TrackingNumber
+	}
+	filter := bson.M{
+		"orderid":   in.OrderID,
+		"status":    bson.M{"$in": shippable},
+		"shipments": bson.M{"$elemMatch": match},
+	}
+	if len(set) > 0 {
+		res, err := OR.St.UpdateOne(ctx, filter, bson.M{"$set": set})
 		if err != nil {
 			return nil, err
 		}
+		if res.MatchedCount == 0 {
+			return nil, OR.shipmentError(ctx, in)
+		}
+		OR.ordersChanged(ctx)
 	}
 
-	order.Status = "Order created"
-	_, err = OR.St.InsertOne(ctx, order)
+	order, err := OR.OrderByID(ctx, in.OrderID)
 	if err != nil {
 		return nil, err
 	}
-	return order, nil
+	for _, shipment := range order.Shipments {
+		if shipment.SellerID == in.SellerID {
+			return shipment, nil
+		}
+	}
+	return nil, fmt.Errorf("shipment not exist")
+}
+
+// shipmentError explains why UpdateShipment matched nothing
+func (OR *OrderRepo) shipmentError(ctx context.Context, in model.ShipmentInput) error {
+	order, err := OR.OrderByID(ctx, in.OrderID)
+	if err != nil {
+		return err
+	}
+	for _, shipment := range order.Shipments {
+		if shipment.SellerID != in.SellerID {
+			continue
+		}
+		if !containsStatus(shippable, order.Status) {
+			return fmt.Errorf("cannot change shipment of %s order", order.Status)
+		}
+		if in.Status != nil {
+			return fmt.Errorf("cannot change shipment status from %s to %s", shipment.Status, *in.Status)
+		}
+	}
+	return fmt.Errorf("shipment not exist")
+}
+
+func containsStatus(statuses []model.OrderStatus, status model.OrderStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ordersChanged marks the seller stats stale, a failure is only logged since the TTL catches up
+func (OR *OrderRepo) ordersChanged(ctx context.Context) {
+	if OR.Stats == nil {
+		return
+	}
+	if err := OR.Stats.MarkStale(ctx); err != nil {
+		log.Printf("failed to mark seller stats stale: %v", err)
+	}
 }
 
 func (OR *OrderRepo) UsersOrders(ctx context.Context, userID int) ([]*model.Order, error) {
@@ -77,11 +487,49 @@ func (OR *OrderRepo) UsersOrders(ctx context.Context, userID int) ([]*model.Orde
 	}
 	return UsersOrders, nil
 }
-func CreateOrderRepo(St *mongo.Collection, cartRepoI CartRepoInterface, itemRepoI ItemRepoInterface) *OrderRepo {
+func (OR *OrderRepo) OrderByID(ctx context.Context, orderID int) (*model.Order, error) {
+	filter := bson.M{"orderid": orderID}
+	var order *model.Order
+	err := OR.St.FindOne(ctx, filter).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("order not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (OR *OrderRepo) OrderByNumber(ctx context.Context, number string) (*model.Order, error) {
+	filter := bson.M{"number": number}
+	var order *model.Order
+	err := OR.St.FindOne(ctx, filter).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("order not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// CompletedForSeller reports whether the buyer got the items of the seller,
+// either the whole order is delivered or the seller's shipment is
+func CompletedForSeller(order *model.Order, sellerID int) bool {
+	for _, shipment := range order.Shipments {
+		if shipment.SellerID != sellerID {
+			continue
+		}
+		return order.Status == model.OrderStatusDelivered || shipment.Status == ShipmentDelivered
+	}
+	return false
+}
+
+func CreateOrderRepo(St *mongo.Collection, countersSt *mongo.Collection, cartRepoI CartRepoInterface, itemRepoI ItemRepoInterface) *OrderRepo {
 	return &OrderRepo{
 		St:        St,
 		CartRepoI: cartRepoI,
 		ItemRepoI: itemRepoI,
-		count:     1,
+		Counters:  &Counters{St: countersSt},
 	}
 }
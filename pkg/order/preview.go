@@ -0,0 +1,92 @@
+package order
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PreviewOrder checks every active cart line against the current item.
+// A line gets the first matching status of unavailable, quantityReduced, priceChanged, ok.
+// Items of deactivated sellers are unavailable
+func (OR *OrderRepo) PreviewOrder(ctx context.Context, userID int) (*model.OrderPreview, error) {
+	lines, err := OR.CartRepoI.CartLines(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := OR.hiddenSellers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	preview := &model.OrderPreview{Lines: []*model.PreviewLine{}}
+	for _, line := range lines {
+		item, err := OR.ItemRepoI.GetItemByID(ctx, line.Item_id)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		previewLine := &model.PreviewLine{
+			ItemID:    line.Item_id,
+			Item:      item,
+			Requested: line.Quantity,
+			CartPrice: line.Price,
+		}
+		switch {
+		case item == nil || item.InStock <= 0 || hidden[item.SellerID]:
+			previewLine.Status = model.PreviewLineStatusUnavailable
+		case item.InStock < line.Quantity:
+			previewLine.Status = model.PreviewLineStatusQuantityReduced
+			previewLine.Available = item.InStock
+		case item.Price != line.Price:
+			previewLine.Status = model.PreviewLineStatusPriceChanged
+			previewLine.Available = line.Quantity
+		default:
+			previewLine.Status = model.PreviewLineStatusOk
+			previewLine.Available = line.Quantity
+		}
+		if item != nil {
+			previewLine.Price = item.Price
+		}
+		previewLine.Total = previewLine.Price * float64(previewLine.Available)
+		preview.Lines = append(preview.Lines, previewLine)
+		preview.Quantity += previewLine.Available
+		preview.Total += previewLine.Total
+	}
+	preview.Fingerprint = fingerprint(preview.Lines)
+	return preview, nil
+}
+
+// fingerprint hashes what the buyer saw in the preview,
+// any change of the cart, stock or prices gives another fingerprint
+func fingerprint(lines []*model.PreviewLine) string {
+	var b strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&b, "%d:%d:%d:%s:%g;", line.ItemID, line.Requested, line.Available, line.Status, line.Price)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (OR *OrderRepo) previewedItems(ctx context.Context, userID int, expected string) ([]*model.CartItem, error) {
+	preview, err := OR.PreviewOrder(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if preview.Fingerprint != expected {
+		return nil, fmt.Errorf("cart changed since preview")
+	}
+	var items []*model.CartItem
+	for _, line := range preview.Lines {
+		if line.Available > 0 {
+			items = append(items, &model.CartItem{Quantity: line.Available, Item: line.Item})
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("nothing to order")
+	}
+	return items, nil
+}
@@ -0,0 +1,286 @@
+package order
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// cursor points at the last order of a page, Value is the total when sorting by total
+type cursor struct {
+	Value   float64 `json:"v,omitempty"`
+	OrderID int     `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("bad cursor")
+	}
+	return c, nil
+}
+
+func statusValues(statuses []model.OrderStatus) []model.OrderStatus {
+	values := append([]model.OrderStatus{}, statuses...)
+	for _, status := range statuses {
+		if status == model.OrderStatusCreated {
+			values = append(values, legacyCreated)
+		}
+	}
+	return values
+}
+
+func normalizeTime(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("date must be in RFC3339: %w", err)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// SearchFilter turns the filter into a query on the orders collection.
+// The date range includes createdFrom and excludes createdTo
+func SearchFilter(filter *model.OrderFilter) (bson.M, error) {
+	query := bson.M{}
+	if filter == nil {
+		return query, nil
+	}
+	if len(filter.Status) > 0 {
+		for _, status := range filter.Status {
+			if !status.IsValid() {
+				return nil, fmt.Errorf("unknown order status %q", status)
+			}
+		}
+		query["status"] = bson.M{"$in": statusValues(filter.Status)}
+	}
+	created := bson.M{}
+	if filter.CreatedFrom != nil {
+		from, err := normalizeTime(*filter.CreatedFrom)
+		if err != nil {
+			return nil, err
+		}
+		created["$gte"] = from
+	}
+	if filter.CreatedTo != nil {
+		to, err := normalizeTime(*filter.CreatedTo)
+		if err != nil {
+			return nil, err
+		}
+		created["$lt"] = to
+	}
+	if len(created) > 0 {
+		query["createdat"] = created
+	}
+	if filter.UserID != nil {
+		query["userid"] = *filter.UserID
+	}
+	if filter.SellerID != nil {
+		query["items.item.sellerid"] = *filter.SellerID
+	}
+	if filter.ItemID != nil {
+		query["items.item.id"] = *filter.ItemID
+	}
+	total := bson.M{}
+	if filter.MinTotal != nil {
+		total["$gte"] = *filter.MinTotal
+	}
+	if filter.MaxTotal != nil {
+		total["$lte"] = *filter.MaxTotal
+	}
+	if len(total) > 0 {
+		query["total"] = total
+	}
+	return query, nil
+}
+
+// sortSpec returns the sort order and the field compared besides orderid.
+// Order IDs come from a counter, so they follow the creation time
+func sortSpec(sort model.OrderSort) (bson.D, string, int) {
+	switch sort {
+	case model.OrderSortOldest:
+		return bson.D{{Key: "orderid", Value: 1}}, "", 1
+	case model.OrderSortTotalAsc:
+		return bson.D{{Key: "total", Value: 1}, {Key: "orderid", Value: 1}}, "total", 1
+	case model.OrderSortTotalDesc:
+		return bson.D{{Key: "total", Value: -1}, {Key: "orderid", Value: -1}}, "total", -1
+	default:
+		return bson.D{{Key: "orderid", Value: -1}}, "", -1
+	}
+}
+
+// afterCursor limits the query to orders behind the cursor in the sort order
+func afterCursor(c cursor, field string, dir int) bson.M {
+	op := "$gt"
+	if dir < 0 {
+		op = "$lt"
+	}
+	if field == "" {
+		return bson.M{"orderid": bson.M{op: c.OrderID}}
+	}
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{op: c.Value}},
+		{field: c.Value, "orderid": bson.M{op: c.OrderID}},
+	}}
+}
+
+// FindOrders calls fn for every order matching the filter in the sort order
+func (OR *OrderRepo) FindOrders(ctx context.Context, query bson.M, sort model.OrderSort, limit int, fn func(*model.Order) error) error {
+	sortDoc, _, _ := sortSpec(sort)
+	opts := options.Find().SetSort(sortDoc)
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := OR.St.Find(ctx, query, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var order *model.Order
+		if err := cur.Decode(&order); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// SearchOrders returns a page of the orders matching the filter, after is the endCursor of the previous page
+func (OR *OrderRepo) SearchOrders(ctx context.Context, filter *model.OrderFilter, sort model.OrderSort, first int, after string) (*model.OrderPage, error) {
+	if first <= 0 {
+		first = DefaultPageSize
+	}
+	if first > MaxPageSize {
+		return nil, fmt.Errorf("first must not be over %d", MaxPageSize)
+	}
+	query, err := SearchFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	total, err := OR.St.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	pageQuery := query
+	if after != "" {
+		c, err := decodeCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		_, field, dir := sortSpec(sort)
+		pageQuery = bson.M{"$and": []bson.M{query, afterCursor(c, field, dir)}}
+	}
+	page := &model.OrderPage{Orders: []*model.Order{}, TotalCount: int(total)}
+	// one more than asked tells if there is a next page
+	err = OR.FindOrders(ctx, pageQuery, sort, first+1, func(order *model.Order) error {
+		page.Orders = append(page.Orders, order)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Orders) > first {
+		page.Orders = page.Orders[:first]
+		page.HasNextPage = true
+	}
+	if n := len(page.Orders); n > 0 {
+		last := page.Orders[n-1]
+		endCursor := encodeCursor(cursor{Value: last.Total, OrderID: last.OrderID})
+		page.EndCursor = &endCursor
+	}
+	return page, nil
+}
+
+// uniqueIndexes keep two orders from sharing an ID or a number.
+// Orders placed before numbers existed have none, the partial filter skips them
+var uniqueIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "orderid", Value: 1}}, Options: options.Index().SetUnique(true)},
+	{
+		Keys: bson.D{{Key: "number", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"number": bson.M{"$type": "string"}}),
+	},
+}
+
+// indexConflict is the error Mongo gives for an index that exists with other options
+func indexConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86)
+}
+
+// EnsureIndexes creates the indexes the order search relies on.
+// The orderid and number indexes used to be plain ones, they are dropped and built unique
+func (OR *OrderRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := OR.St.Indexes().CreateMany(ctx, uniqueIndexes)
+	if indexConflict(err) {
+		for _, name := range []string{"orderid_1", "number_1"} {
+			if _, err := OR.St.Indexes().DropOne(ctx, name); err != nil {
+				log.Printf("failed to drop order index %s: %v", name, err)
+			}
+		}
+		_, err = OR.St.Indexes().CreateMany(ctx, uniqueIndexes)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = OR.St.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "orderid", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "orderid", Value: -1}}},
+		{Keys: bson.D{{Key: "createdat", Value: 1}}},
+		{Keys: bson.D{{Key: "total", Value: 1}, {Key: "orderid", Value: 1}}},
+		{Keys: bson.D{{Key: "items.item.sellerid", Value: 1}, {Key: "orderid", Value: -1}}},
+		{Keys: bson.D{{Key: "items.item.id", Value: 1}, {Key: "orderid", Value: -1}}},
+	})
+	return err
+}
+
+// BackfillStatuses moves orders placed before the lifecycle existed to created,
+// the old value isn't a valid OrderStatus and can't be served
+func (OR *OrderRepo) BackfillStatuses(ctx context.Context) error {
+	_, err := OR.St.UpdateMany(ctx,
+		bson.M{"status": legacyCreated},
+		bson.M{"$set": bson.M{"status": model.OrderStatusCreated}},
+	)
+	return err
+}
+
+// BackfillTotals sets the total of orders placed before totals were stored
+func (OR *OrderRepo) BackfillTotals(ctx context.Context) error {
+	_, err := OR.St.UpdateMany(ctx,
+		bson.M{"total": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"total": bson.M{"$sum": bson.M{"$map": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$items", bson.A{}}},
+				"as":    "line",
+				"in":    bson.M{"$multiply": bson.A{"$$line.quantity", bson.M{"$ifNull": bson.A{"$$line.item.price", 0}}}},
+			}}},
+		}}}},
+	)
+	return err
+}
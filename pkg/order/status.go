@@ -0,0 +1,292 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/outbox"
+	"log"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrStatusChange is wrapped by the error of a transition the current status doesn't allow
+var ErrStatusChange = errors.New("cannot change order status")
+
+// legacyCreated is the status orders got before the lifecycle existed.
+// BackfillStatuses migrates it at startup, transitions still accept it from orders written meanwhile
+const legacyCreated = "Order created"
+
+// Transitions lists the statuses an order may move to from each status, a failed payment may be retried.
+// Cancelled and returned are left out: CancelOrder and the returns flow set them, since they also restock and refund
+var Transitions = map[model.OrderStatus][]model.OrderStatus{
+	model.OrderStatusCreated:       {model.OrderStatusPaid, model.OrderStatusPaymentFailed},
+	model.OrderStatusPaymentFailed: {model.OrderStatusPaid, model.OrderStatusPaymentFailed},
+	model.OrderStatusPaid:          {model.OrderStatusAssembling},
+	model.OrderStatusAssembling:    {model.OrderStatusShipped},
+	model.OrderStatusShipped:       {model.OrderStatusDelivered},
+}
+
+func CanTransition(from, to model.OrderStatus) bool {
+	if from == legacyCreated {
+		from = model.OrderStatusCreated
+	}
+	for _, next := range Transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedFrom returns the statuses an order may have to move to status
+func allowedFrom(status model.OrderStatus) []model.OrderStatus {
+	var from []model.OrderStatus
+	for prev := range Transitions {
+		if CanTransition(prev, status) {
+			from = append(from, prev)
+		}
+	}
+	if CanTransition(model.OrderStatusCreated, status) {
+		from = append(from, legacyCreated)
+	}
+	return from
+}
+
+func statusChange(status model.OrderStatus, actor string, note *string) *model.OrderStatusChange {
+	return &model.OrderStatusChange{
+		Status: status,
+		At:     time.Now().UTC().Format(time.RFC3339),
+		Actor:  actor,
+		Note:   note,
+	}
+}
+
+// statusEvent goes into the outbox with the status change
+func statusEvent(orderID int, status model.OrderStatus, actor string) outbox.Event {
+	return outbox.NewEvent(outbox.OrderStatusChanged, strconv.Itoa(orderID), bson.M{
+		"orderID": orderID,
+		"status":  status,
+		"actor":   actor,
+	})
+}
+
+// UpdateOrderStatus moves the order to status if the current status allows it.
+// The check and the change are one update, so two concurrent changes can't both apply
+func (OR *OrderRepo) UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, actor string, note *string) (*model.Order, error) {
+	if !status.IsValid() {
+		return nil, fmt.Errorf("unknown order status %q", status)
+	}
+	switch status {
+	case model.OrderStatusCancelled:
+		return nil, fmt.Errorf("order status %s is set by cancelling the order", status)
+	case model.OrderStatusReturned:
+		return nil, fmt.Errorf("order status %s is set by receiving the returns", status)
+	}
+	return OR.moveOrder(ctx, orderID, allowedFrom(status), status, actor, note)
+}
+
+// ReturnOrder marks the delivered order returned once the returns flow took every line back
+func (OR *OrderRepo) ReturnOrder(ctx context.Context, orderID int, actor string) (*model.Order, error) {
+	return OR.moveOrder(ctx, orderID, []model.OrderStatus{model.OrderStatusDelivered}, model.OrderStatusReturned, actor, nil)
+}
+
+// AcceptReturn records a received return on the order. The order must be delivered,
+// or returned by earlier returns, the check and the record are one update
+func (OR *OrderRepo) AcceptReturn(ctx context.Context, orderID int, returnID string) error {
+	res, err := OR.St.UpdateOne(ctx,
+		bson.M{
+			"orderid": orderID,
+			"status":  bson.M{"$in": []model.OrderStatus{model.OrderStatusDelivered, model.OrderStatusReturned}},
+		},
+		bson.M{"$addToSet": bson.M{"returns": returnID}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		order, err := OR.OrderByID(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("order can't be returned in status %s", order.Status)
+	}
+	return nil
+}
+
+// moveOrder sets status on the order if its current status is one of from
+func (OR *OrderRepo) moveOrder(ctx context.Context, orderID int, from []model.OrderStatus, status model.OrderStatus, actor string, note *string) (*model.Order, error) {
+	filter := bson.M{
+		"orderid": orderID,
+		"status":  bson.M{"$in": from},
+	}
+	set := bson.M{"status": status}
+	if status == model.OrderStatusDelivered {
+		set["shipments.$[].status"] = ShipmentDelivered
+	}
+	update := bson.M{
+		"$set": set,
+		"$push": bson.M{
+			"statushistory": statusChange(status, actor, note),
+			outbox.Field:    statusEvent(orderID, status, actor),
+		},
+	}
+	res, err := OR.St.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		order, err := OR.OrderByID(ctx, orderID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w from %s to %s", ErrStatusChange, order.Status, status)
+	}
+	OR.ordersChanged(ctx)
+	order, err := OR.OrderByID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if status == model.OrderStatusDelivered {
+		OR.recordDelivery(ctx, order)
+	}
+	OR.publish(order)
+	return order, nil
+}
+
+// recordDelivery books the sales of the delivered order. Booking skips lines booked before,
+// a failure is only logged since the order is delivered anyway
+func (OR *OrderRepo) recordDelivery(ctx context.Context, order *model.Order) {
+	if OR.Ledger == nil {
+		return
+	}
+	for _, shipment := range order.Shipments {
+		if err := OR.Ledger.RecordDelivery(ctx, shipment); err != nil {
+			log.Printf("failed to book delivery of order %d for seller %d: %v", order.OrderID, shipment.SellerID, err)
+		}
+	}
+}
+
+// reverseSales takes back the booked sales of the cancelled order
+func (OR *OrderRepo) reverseSales(ctx context.Context, order *model.Order) {
+	if OR.Ledger == nil {
+		return
+	}
+	for _, line := range order.Items {
+		if line.Item == nil {
+			continue
+		}
+		if err := OR.Ledger.ReverseSale(ctx, "cancel", order.OrderID, line.Item.ID, line.Quantity); err != nil {
+			log.Printf("failed to reverse sale of item %d in order %d: %v", line.Item.ID, order.OrderID, err)
+		}
+	}
+}
+
+// OrdersFeedTopic gets every order change, OrderTopic the changes of one order
+const OrdersFeedTopic = "orders"
+
+func OrderTopic(orderID int) string {
+	return fmt.Sprintf("order:%d", orderID)
+}
+
+func (OR *OrderRepo) publish(order *model.Order) {
+	if OR.Events == nil {
+		return
+	}
+	OR.Events.Publish(OrderTopic(order.OrderID), order)
+	OR.Events.Publish(OrdersFeedTopic, order)
+}
+
+func UserActor(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+func AdminActor(userID int) string {
+	return fmt.Sprintf("admin:%d", userID)
+}
+
+// cancellableBy lists the statuses a user can cancel from, admins can cancel any order that isn't final
+func cancellableBy(admin bool) []model.OrderStatus {
+	statuses := []model.OrderStatus{
+		model.OrderStatusCreated,
+		legacyCreated,
+		model.OrderStatusPaymentFailed,
+		model.OrderStatusPaid,
+		model.OrderStatusAssembling,
+	}
+	if admin {
+		statuses = append(statuses, model.OrderStatusShipped, model.OrderStatusDelivered)
+	}
+	return statuses
+}
+
+// CancelOrder cancels the order, returns its items to stock, reverses the booked sales and refunds the payment.
+// Only the call that flips the status restores stock. A refund that fails is returned as the error,
+// repeating the call refunds what is left and returns the cancelled order
+func (OR *OrderRepo) CancelOrder(ctx context.Context, orderID, userID int, admin bool, reason *string) (*model.Order, error) {
+	actor := UserActor(userID)
+	filter := bson.M{
+		"orderid": orderID,
+		"status":  bson.M{"$in": cancellableBy(admin)},
+	}
+	if admin {
+		actor = AdminActor(userID)
+	} else {
+		filter["userid"] = userID
+	}
+	update := bson.M{
+		"$set": bson.M{"status": model.OrderStatusCancelled},
+		"$push": bson.M{
+			"statushistory": statusChange(model.OrderStatusCancelled, actor, reason),
+			outbox.Field:    statusEvent(orderID, model.OrderStatusCancelled, actor),
+		},
+	}
+	res, err := OR.St.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	order, err := OR.OrderByID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !admin && order.UserID != userID {
+		return nil, fmt.Errorf("order not exist")
+	}
+	if res.ModifiedCount == 0 {
+		if order.Status == model.OrderStatusCancelled {
+			return order, OR.refund(ctx, orderID)
+		}
+		return nil, fmt.Errorf("order can't be cancelled in status %s", order.Status)
+	}
+
+	for _, line := range order.Items {
+		if line.Item == nil {
+			continue
+		}
+		_, err := OR.ItemRepoI.RestockItem(ctx, line.Item.ID, line.Quantity)
+		if err != nil {
+			log.Printf("failed to return %d of item %d to stock: %v", line.Quantity, line.Item.ID, err)
+		}
+	}
+	OR.reverseSales(ctx, order)
+	OR.ordersChanged(ctx)
+	OR.publish(order)
+	if err := OR.refund(ctx, orderID); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// refund returns the payment of the cancelled order
+func (OR *OrderRepo) refund(ctx context.Context, orderID int) error {
+	if OR.Payments == nil {
+		return nil
+	}
+	if err := OR.Payments.RefundPayments(ctx, orderID); err != nil {
+		return fmt.Errorf("order is cancelled, refund failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DefaultInterval    = 5 * time.Second
+	DefaultLease       = time.Minute
+	DefaultMaxAttempts = 10
+	// DefaultBackoff is the delay before the first retry, it doubles with every attempt
+	DefaultBackoff    = 5 * time.Second
+	DefaultMaxBackoff = time.Hour
+)
+
+// Dispatcher delivers the outbox to every sink at least once.
+// A failed event is retried with a growing delay and dead lettered after MaxAttempts
+type Dispatcher struct {
+	Outbox      *OutboxRepo
+	Sinks       []Sink
+	Interval    time.Duration
+	Lease       time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (D *Dispatcher) backoff(attempt int) time.Duration {
+	delay := D.Backoff
+	for i := 1; i < attempt && delay < D.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > D.MaxBackoff {
+		delay = D.MaxBackoff
+	}
+	return delay
+}
+
+// deliver hands the entry to the sinks that don't have it yet and books the result
+func (D *Dispatcher) deliver(ctx context.Context, entry *Entry) error {
+	done := make(map[string]bool, len(entry.Delivered))
+	for _, name := range entry.Delivered {
+		done[name] = true
+	}
+	delivered := entry.Delivered
+	var errs []error
+	for _, sink := range D.Sinks {
+		if done[sink.Name()] {
+			continue
+		}
+		if err := sink.Deliver(ctx, entry.Event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+			continue
+		}
+		delivered = append(delivered, sink.Name())
+	}
+	if len(errs) == 0 {
+		return D.Outbox.MarkDelivered(ctx, entry.ID, delivered)
+	}
+
+	lastError := errors.Join(errs...).Error()
+	attempt := entry.Attempts + 1
+	if attempt >= D.MaxAttempts {
+		log.Printf("outbox: event %s [%s] dead lettered after %d attempts: %s", entry.ID, entry.Type, attempt, lastError)
+		return D.Outbox.MarkFailed(ctx, entry.ID, delivered, lastError, nil)
+	}
+	next := time.Now().UTC().Add(D.backoff(attempt))
+	return D.Outbox.MarkFailed(ctx, entry.ID, delivered, lastError, &next)
+}
+
+// RunOnce relays new events and delivers every due one
+func (D *Dispatcher) RunOnce(ctx context.Context) (delivered int, err error) {
+	if _, err := D.Outbox.Relay(ctx); err != nil {
+		return 0, err
+	}
+	for {
+		entry, err := D.Outbox.Claim(ctx, D.Lease)
+		if err != nil || entry == nil {
+			return delivered, err
+		}
+		if err := D.deliver(ctx, entry); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+}
+
+// Run repeats RunOnce every Interval until ctx is done
+func (D *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(D.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := D.RunOnce(ctx); err != nil {
+			log.Println("outbox dispatcher failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func CreateDispatcher(outbox *OutboxRepo, sinks ...Sink) *Dispatcher {
+	return &Dispatcher{
+		Outbox:      outbox,
+		Sinks:       sinks,
+		Interval:    DefaultInterval,
+		Lease:       DefaultLease,
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+	}
+}
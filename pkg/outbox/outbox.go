@@ -0,0 +1,203 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Field holds the events not yet relayed inside the changed document.
+// Mongo runs without a replica set, so there are no transactions over two collections,
+// instead the event is written by the same single document insert or update as the change
+const Field = "outbox"
+
+const (
+	OrderCreated       = "order.created"
+	OrderStatusChanged = "order.status_changed"
+	StockChanged       = "item.stock_changed"
+	CommentPosted      = "comment.posted"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	// StatusDead is the dead letter, the event ran out of attempts
+	StatusDead = "dead"
+)
+
+// Event is something that happened to an order, item or comment
+type Event struct {
+	ID          string    `bson:"_id" json:"id"`
+	Type        string    `json:"type"`
+	AggregateID string    `json:"aggregateID"`
+	Payload     bson.M    `json:"payload"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func NewEvent(eventType, aggregateID string, payload bson.M) Event {
+	return Event{
+		ID:          primitive.NewObjectID().Hex(),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Payload:     payload,
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// Attach returns doc with the events under Field, ready for InsertOne
+func Attach(doc interface{}, events ...Event) (bson.D, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var out bson.D
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return append(out, bson.E{Key: Field, Value: events}), nil
+}
+
+// Entry is an event in the outbox collection with its delivery state
+type Entry struct {
+	Event    `bson:",inline"`
+	Status   string
+	Attempts int
+	// Delivered lists the sinks that got the event, a retry skips them
+	Delivered     []string
+	NextAttemptAt time.Time
+	LastError     string
+	UpdatedAt     time.Time
+}
+
+type OutboxRepo struct {
+	St *mongo.Collection
+	// Sources are the collections whose documents carry events under Field
+	Sources []*mongo.Collection
+}
+
+// Relay moves the events out of the source documents into the outbox collection.
+// The insert is keyed by the event ID, so an event moved twice is stored once
+func (OB *OutboxRepo) Relay(ctx context.Context) (int, error) {
+	moved := 0
+	for _, source := range OB.Sources {
+		cur, err := source.Find(ctx,
+			bson.M{Field + ".0": bson.M{"$exists": true}},
+			options.Find().SetProjection(bson.M{Field: 1}),
+		)
+		if err != nil {
+			return moved, err
+		}
+		var docs []struct {
+			ID     interface{} `bson:"_id"`
+			Outbox []Event
+		}
+		if err := cur.All(ctx, &docs); err != nil {
+			return moved, err
+		}
+		for _, doc := range docs {
+			ids := make([]string, 0, len(doc.Outbox))
+			for _, event := range doc.Outbox {
+				entry := &Entry{
+					Event:         event,
+					Status:        StatusPending,
+					Delivered:     []string{},
+					NextAttemptAt: event.CreatedAt,
+					UpdatedAt:     time.Now().UTC(),
+				}
+				if _, err := OB.St.InsertOne(ctx, entry); err != nil && !mongo.IsDuplicateKeyError(err) {
+					return moved, err
+				}
+				ids = append(ids, event.ID)
+			}
+			_, err := source.UpdateOne(ctx,
+				bson.M{"_id": doc.ID},
+				bson.M{"$pull": bson.M{Field: bson.M{"_id": bson.M{"$in": ids}}}},
+			)
+			if err != nil {
+				return moved, err
+			}
+			moved += len(ids)
+		}
+	}
+	return moved, nil
+}
+
+// Claim takes the oldest due pending entry and hides it for lease.
+// If the claimer dies, the entry is due again when the lease runs out
+func (OB *OutboxRepo) Claim(ctx context.Context, lease time.Duration) (*Entry, error) {
+	now := time.Now().UTC()
+	var entry *Entry
+	err := OB.St.FindOneAndUpdate(ctx,
+		bson.M{"status": StatusPending, "nextattemptat": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextattemptat": now.Add(lease), "updatedat": now}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextattemptat", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (OB *OutboxRepo) MarkDelivered(ctx context.Context, id string, sinks []string) error {
+	_, err := OB.St.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":    StatusDelivered,
+		"delivered": sinks,
+		"lasterror": "",
+		"updatedat": time.Now().UTC(),
+	}})
+	return err
+}
+
+// MarkFailed books a failed attempt, the entry is retried at next or dead lettered when next is nil
+func (OB *OutboxRepo) MarkFailed(ctx context.Context, id string, sinks []string, lastError string, next *time.Time) error {
+	set := bson.M{
+		"delivered": sinks,
+		"lasterror": lastError,
+		"updatedat": time.Now().UTC(),
+	}
+	if next != nil {
+		set["nextattemptat"] = *next
+	} else {
+		set["status"] = StatusDead
+	}
+	_, err := OB.St.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": set,
+		"$inc": bson.M{"attempts": 1},
+	})
+	return err
+}
+
+// EnsureIndexes creates the index the dispatcher claims entries by and,
+// on every source, a partial index of the documents carrying events that Relay looks them up by
+func (OB *OutboxRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := OB.St.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	pending := bson.M{Field + ".0": bson.M{"$exists": true}}
+	for _, source := range OB.Sources {
+		_, err := source.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: Field + ".0", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(pending),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CreateOutboxRepo(St *mongo.Collection, sources ...*mongo.Collection) *OutboxRepo {
+	return &OutboxRepo{
+		St:      St,
+		Sources: sources,
+	}
+}
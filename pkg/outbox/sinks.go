@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	EventIDHeader   = "X-Event-ID"
+	EventTypeHeader = "X-Event-Type"
+	// SignatureHeader carries the HMAC-SHA256 of the body when the webhook has a secret
+	SignatureHeader = "X-Event-Signature"
+)
+
+// Sink receives the events. A sink may get an event more than once,
+// receivers tell repeats apart by the event ID
+type Sink interface {
+	Name() string
+	Deliver(ctx context.Context, event Event) error
+}
+
+// LogSink only writes events to the log, for local runs
+type LogSink struct{}
+
+func (LS *LogSink) Name() string {
+	return "log"
+}
+
+func (LS *LogSink) Deliver(ctx context.Context, event Event) error {
+	log.Printf("event %s [%s] %s: %v", event.ID, event.Type, event.AggregateID, event.Payload)
+	return nil
+}
+
+// FileSink appends events to a file, one JSON per line
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (FS *FileSink) Name() string {
+	return "file"
+}
+
+func (FS *FileSink) Deliver(ctx context.Context, event Event) error {
+	FS.mu.Lock()
+	defer FS.mu.Unlock()
+	file, err := os.OpenFile(FS.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(event)
+}
+
+func CreateFileSink(path string) *FileSink {
+	return &FileSink{
+		Path: path,
+	}
+}
+
+// WebhookSink posts events as JSON, any answer but 2xx is a failure
+type WebhookSink struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+func (WS *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (WS *WebhookSink) Deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, WS.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, event.ID)
+	req.Header.Set(EventTypeHeader, event.Type)
+	if len(WS.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(WS.Secret, body))
+	}
+	resp, err := WS.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func CreateWebhookSink(url string, secret []byte) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
@@ -0,0 +1,97 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Payment-Signature"
+	TimestampHeader = "X-Payment-Timestamp"
+	// DefaultTolerance is how old a webhook may be, older ones are taken for replays
+	DefaultTolerance = 5 * time.Minute
+)
+
+// FakeProvider accepts every payment, the result comes with a webhook
+// signed by Sign. It is meant for local runs and tests
+type FakeProvider struct {
+	Secret     []byte
+	ConfirmURL string
+	Tolerance  time.Duration
+}
+
+func (FP *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (FP *FakeProvider) CreatePayment(ctx context.Context, orderID int, amount float64) (*Session, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	paymentID := fmt.Sprintf("fake-%d-%s", orderID, hex.EncodeToString(raw))
+	return &Session{
+		PaymentID:       paymentID,
+		Provider:        FP.Name(),
+		Amount:          amount,
+		ConfirmationURL: FP.ConfirmURL + "?payment=" + paymentID,
+	}, nil
+}
+
+func (FP *FakeProvider) Refund(ctx context.Context, paymentID string, amount float64) (string, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return "refund-" + hex.EncodeToString(raw), nil
+}
+
+// Sign returns the signature of a webhook body sent at timestamp (unix seconds)
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (FP *FakeProvider) ParseWebhook(r *http.Request, body []byte) (*Event, error) {
+	timestamp := r.Header.Get(TimestampHeader)
+	sig := r.Header.Get(SignatureHeader)
+	if !hmac.Equal([]byte(sig), []byte(Sign(FP.Secret, timestamp, body))) {
+		return nil, fmt.Errorf("bad webhook signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad webhook timestamp")
+	}
+	sentAt := time.Unix(unix, 0)
+	if age := time.Since(sentAt); age > FP.Tolerance || age < -FP.Tolerance {
+		return nil, fmt.Errorf("webhook timestamp out of tolerance")
+	}
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("bad webhook body")
+	}
+	if event.ID == "" || event.PaymentID == "" {
+		return nil, fmt.Errorf("bad webhook body")
+	}
+	event.CreatedAt = sentAt.UTC()
+	return event, nil
+}
+
+func CreateFakeProvider(secret []byte, confirmURL string) *FakeProvider {
+	return &FakeProvider{
+		Secret:     secret,
+		ConfirmURL: confirmURL,
+		Tolerance:  DefaultTolerance,
+	}
+}
@@ -0,0 +1,300 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/order"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusVoided is a pending payment replaced by a new one, its webhooks are ignored
+	StatusVoided = "voided"
+)
+
+// ErrReplayed is returned for a webhook event that was already handled
+var ErrReplayed = errors.New("webhook event already handled")
+
+type Payment struct {
+	ID       string `bson:"_id"`
+	OrderID  int
+	UserID   int
+	Provider string
+	Amount   float64
+	Refunded float64
+	Status   string
+	// ConfirmationURL lets a repeated StartPayment hand out the pending payment again
+	ConfirmationURL string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+type OrderRepoInterface interface {
+	OrderByID(ctx context.Context, orderID int) (*model.Order, error)
+	UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, actor string, note *string) (*model.Order, error)
+}
+
+type PaymentRepoInterface interface {
+	StartPayment(ctx context.Context, orderID, userID int) (*Session, error)
+	HandleEvent(ctx context.Context, event *Event) error
+	RefundOrder(ctx context.Context, orderID int, amount float64) (string, error)
+}
+
+type PaymentRepo struct {
+	StMongoDB *mongo.Collection
+	// EventsSt keeps the IDs of handled webhook events
+	EventsSt  *mongo.Collection
+	Provider  PaymentProvider
+	OrderRepo OrderRepoInterface
+}
+
+func orderAmount(o *model.Order) float64 {
+	var amount float64
+	for _, line := range o.Items {
+		if line.Item != nil {
+			amount += line.Item.Price * float64(line.Quantity)
+		}
+	}
+	return amount
+}
+
+// StartPayment opens a payment of the whole order with the provider.
+// A pending payment of the same amount is handed out again, one of another amount is voided.
+// Orders of other users are reported as missing
+func (PR *PaymentRepo) StartPayment(ctx context.Context, orderID, userID int) (*Session, error) {
+	o, err := PR.OrderRepo.OrderByID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if o.UserID != userID {
+		return nil, fmt.Errorf("order not exist")
+	}
+	if !order.CanTransition(o.Status, model.OrderStatusPaid) {
+		return nil, fmt.Errorf("order can't be paid in status %s", o.Status)
+	}
+	amount := orderAmount(o)
+	if amount <= 0 {
+		return nil, fmt.Errorf("nothing to pay")
+	}
+	session, err := PR.pendingSession(ctx, orderID, amount)
+	if err != nil || session != nil {
+		return session, err
+	}
+	session, err = PR.Provider.CreatePayment(ctx, orderID, amount)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	_, err = PR.StMongoDB.InsertOne(ctx, &Payment{
+		ID:              session.PaymentID,
+		OrderID:         orderID,
+		UserID:          userID,
+		Provider:        session.Provider,
+		Amount:          amount,
+		Status:          StatusPending,
+		ConfirmationURL: session.ConfirmationURL,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent call opened the payment first
+		return PR.pendingSession(ctx, orderID, amount)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// pendingSession returns the session of the pending payment of the order,
+// nil if there is none or it was voided for another amount
+func (PR *PaymentRepo) pendingSession(ctx context.Context, orderID int, amount float64) (*Session, error) {
+	var p *Payment
+	err := PR.StMongoDB.FindOne(ctx, bson.M{"orderid": orderID, "status": StatusPending}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Amount == amount && p.ConfirmationURL != "" {
+		return &Session{
+			PaymentID:       p.ID,
+			Provider:        p.Provider,
+			Amount:          p.Amount,
+			ConfirmationURL: p.ConfirmationURL,
+		}, nil
+	}
+	_, err = PR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": p.ID, "status": StatusPending},
+		bson.M{"$set": bson.M{"status": StatusVoided, "updatedat": time.Now().UTC()}},
+	)
+	return nil, err
+}
+
+// HandleEvent applies a verified webhook event to its payment and order.
+// Every event is applied once, if applying fails the event is forgotten so the provider can retry it
+func (PR *PaymentRepo) HandleEvent(ctx context.Context, event *Event) error {
+	_, err := PR.EventsSt.InsertOne(ctx, bson.M{"_id": event.ID, "paymentid": event.PaymentID, "createdat": event.CreatedAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrReplayed
+	}
+	if err != nil {
+		return err
+	}
+	if err := PR.applyEvent(ctx, event); err != nil {
+		if _, delErr := PR.EventsSt.DeleteOne(ctx, bson.M{"_id": event.ID}); delErr != nil {
+			log.Printf("failed to forget webhook event %s: %v", event.ID, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (PR *PaymentRepo) applyEvent(ctx context.Context, event *Event) error {
+	var status string
+	var orderStatus model.OrderStatus
+	switch event.Status {
+	case EventSucceeded:
+		status, orderStatus = StatusSucceeded, model.OrderStatusPaid
+	case EventFailed:
+		status, orderStatus = StatusFailed, model.OrderStatusPaymentFailed
+	default:
+		return fmt.Errorf("unknown payment status %q", event.Status)
+	}
+
+	var p *Payment
+	err := PR.StMongoDB.FindOneAndUpdate(ctx,
+		bson.M{"_id": event.PaymentID, "status": StatusPending},
+		bson.M{"$set": bson.M{"status": status, "updatedat": time.Now().UTC()}},
+	).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		// unknown payment or one that already got its result, retrying won't change that
+		log.Printf("payment %s is not pending, event %s ignored", event.PaymentID, event.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	note := fmt.Sprintf("payment %s %s", p.ID, event.Status)
+	_, err = PR.OrderRepo.UpdateOrderStatus(ctx, p.OrderID, orderStatus, "payment:"+p.Provider, &note)
+	if errors.Is(err, order.ErrStatusChange) {
+		if status != StatusSucceeded {
+			log.Printf("payment %s of order %d: %v", p.ID, p.OrderID, err)
+			return nil
+		}
+		// the order was cancelled or paid by another payment meanwhile, the money goes back
+		log.Printf("payment %s of order %d is refunded: %v", p.ID, p.OrderID, err)
+		err = PR.refundRest(ctx, p.ID)
+	}
+	if err != nil {
+		// the payment goes back to pending, so the retried event applies again
+		if _, undoErr := PR.StMongoDB.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"status": StatusPending}}); undoErr != nil {
+			log.Printf("failed to undo status of payment %s: %v", p.ID, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// RefundOrder returns amount from the succeeded payment of the order.
+// The amount is booked on the payment before the provider is called,
+// so two refunds can't together return more than was paid
+func (PR *PaymentRepo) RefundOrder(ctx context.Context, orderID int, amount float64) (string, error) {
+	if amount <= 0 {
+		return "", fmt.Errorf("refund amount must be positive")
+	}
+	var p *Payment
+	err := PR.StMongoDB.FindOne(ctx, bson.M{"orderid": orderID, "status": StatusSucceeded}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return "", fmt.Errorf("order %d has no succeeded payment", orderID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return PR.refund(ctx, p, amount)
+}
+
+// RefundPayments returns what is left of every succeeded payment of the order,
+// an order that was never paid has nothing to refund. Repeating the call after a failure finishes the refund
+func (PR *PaymentRepo) RefundPayments(ctx context.Context, orderID int) error {
+	var payments []*Payment
+	cur, err := PR.StMongoDB.Find(ctx, bson.M{"orderid": orderID, "status": StatusSucceeded})
+	if err != nil {
+		return err
+	}
+	if err := cur.All(ctx, &payments); err != nil {
+		return err
+	}
+	for _, p := range payments {
+		if err := PR.refundRest(ctx, p.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundRest returns the part of the payment that wasn't refunded yet
+func (PR *PaymentRepo) refundRest(ctx context.Context, paymentID string) error {
+	var p *Payment
+	if err := PR.StMongoDB.FindOne(ctx, bson.M{"_id": paymentID}).Decode(&p); err != nil {
+		return err
+	}
+	if p.Amount-p.Refunded <= 0 {
+		return nil
+	}
+	_, err := PR.refund(ctx, p, p.Amount-p.Refunded)
+	return err
+}
+
+// refund books amount on the payment and returns it through the provider
+func (PR *PaymentRepo) refund(ctx context.Context, p *Payment, amount float64) (string, error) {
+	res, err := PR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": p.ID, "refunded": bson.M{"$lte": p.Amount - amount}},
+		bson.M{"$inc": bson.M{"refunded": amount}, "$set": bson.M{"updatedat": time.Now().UTC()}},
+	)
+	if err != nil {
+		return "", err
+	}
+	if res.ModifiedCount == 0 {
+		return "", fmt.Errorf("refund exceeds the paid amount")
+	}
+	refundID, err := PR.Provider.Refund(ctx, p.ID, amount)
+	if err != nil {
+		if _, undoErr := PR.StMongoDB.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$inc": bson.M{"refunded": -amount}}); undoErr != nil {
+			log.Printf("failed to undo refund booking of payment %s: %v", p.ID, undoErr)
+		}
+		return "", err
+	}
+	return refundID, nil
+}
+
+// EnsureIndexes keeps one pending payment per order
+func (PR *PaymentRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := PR.StMongoDB.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "orderid", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": StatusPending}),
+	})
+	return err
+}
+
+func CreatePaymentRepo(St *mongo.Collection, eventsSt *mongo.Collection, provider PaymentProvider, orderRepo OrderRepoInterface) *PaymentRepo {
+	return &PaymentRepo{
+		StMongoDB: St,
+		EventsSt:  eventsSt,
+		Provider:  provider,
+		OrderRepo: orderRepo,
+	}
+}
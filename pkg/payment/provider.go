@@ -0,0 +1,38 @@
+package payment
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+)
+
+// Session is what the buyer needs to confirm the payment with the provider
+type Session struct {
+	PaymentID       string
+	Provider        string
+	Amount          float64
+	ConfirmationURL string
+}
+
+// Event is a verified webhook notification about a payment
+type Event struct {
+	ID        string    `json:"id"`
+	PaymentID string    `json:"paymentID"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"-"`
+}
+
+// PaymentProvider is a payment service the shop redirects buyers to.
+// ParseWebhook must reject requests the provider didn't sign,
+// Refund returns money of a succeeded payment and the provider's refund ID
+type PaymentProvider interface {
+	Name() string
+	CreatePayment(ctx context.Context, orderID int, amount float64) (*Session, error)
+	ParseWebhook(r *http.Request, body []byte) (*Event, error)
+	Refund(ctx context.Context, paymentID string, amount float64) (string, error)
+}
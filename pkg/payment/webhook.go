@@ -0,0 +1,49 @@
+package payment
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+const maxWebhookBody = 64 << 10
+
+type WebhookHandler struct {
+	Payments *PaymentRepo
+}
+
+// Webhook receives payment results from the provider.
+// A replayed event is acknowledged without doing anything, so the provider stops sending it
+func (wh *WebhookHandler) Webhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	event, err := wh.Payments.Provider.ParseWebhook(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = wh.Payments.HandleEvent(r.Context(), event)
+	if err == ErrReplayed {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		log.Printf("payment webhook %s: %v", event.ID, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func CreateWebhookHandler(payments *PaymentRepo) *WebhookHandler {
+	return &WebhookHandler{
+		Payments: payments,
+	}
+}
@@ -0,0 +1,331 @@
+package payout
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	KindSale   = "sale"
+	KindPayout = "payout"
+	// KindReversal takes back a sale that was cancelled or refunded
+	KindReversal = "reversal"
+
+	DefaultCommission = 0.1
+)
+
+// Entry is a record of the seller ledger. Entries are only ever inserted,
+// the ID is derived from what the entry is for so the same sale can't be booked twice
+type Entry struct {
+	ID             string `bson:"_id"`
+	Kind           string
+	SellerID       int
+	OrderID        int
+	ItemID         int
+	Quantity       int
+	Gross          float64
+	CommissionRate float64
+	Commission     float64
+	Net            float64
+	CreatedAt      time.Time
+}
+
+// CommissionRate is set either for a seller or for a catalog
+type CommissionRate struct {
+	SellerID  *int
+	CatalogID *int
+	Rate      float64
+}
+
+type Balance struct {
+	SellerID   int
+	From       *time.Time
+	To         *time.Time
+	Gross      float64
+	Commission float64
+	Net        float64
+	PaidOut    float64
+	Balance    float64
+	Entries    []*Entry
+}
+
+type CatalogRepoInterface interface {
+	LookupCatalogChain(ctx context.Context, ID int) ([]model.Catalog, error)
+}
+
+type PayoutRepoInterface interface {
+	SetCommissionRate(ctx context.Context, rate CommissionRate) (*CommissionRate, error)
+	CommissionRateFor(ctx context.Context, sellerID, catalogID int) (float64, error)
+	RecordDelivery(ctx context.Context, shipment *model.Shipment) error
+	ReverseSale(ctx context.Context, ref string, orderID, itemID, quantity int) error
+	SellerBalance(ctx context.Context, sellerID int, from, to *time.Time) (*Balance, error)
+	CreatePayout(ctx context.Context, sellerID int) (*Entry, error)
+}
+
+// PayoutRepo keeps the ledger of what is owed to sellers.
+// Commission is taken by the seller rate, then by the nearest catalog rate, then by Default
+type PayoutRepo struct {
+	StMongoDB    *mongo.Collection
+	RatesSt      *mongo.Collection
+	CatalogRepoI CatalogRepoInterface
+	Default      float64
+}
+
+func sellerRateID(sellerID int) string {
+	return fmt.Sprintf("seller-%d", sellerID)
+}
+
+func catalogRateID(catalogID int) string {
+	return fmt.Sprintf("catalog-%d", catalogID)
+}
+
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func (PR *PayoutRepo) SetCommissionRate(ctx context.Context, rate CommissionRate) (*CommissionRate, error) {
+	if (rate.SellerID == nil) == (rate.CatalogID == nil) {
+		return nil, fmt.Errorf("commission rate needs either seller or catalog")
+	}
+	if rate.Rate < 0 || rate.Rate > 1 {
+		return nil, fmt.Errorf("commission rate must be between 0 and 1")
+	}
+	id := ""
+	if rate.SellerID != nil {
+		id = sellerRateID(*rate.SellerID)
+	} else {
+		id = catalogRateID(*rate.CatalogID)
+	}
+	_, err := PR.RatesSt.ReplaceOne(ctx, bson.M{"_id": id}, rate, options.Replace().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+func (PR *PayoutRepo) lookupRate(ctx context.Context, id string) (float64, bool, error) {
+	var rate CommissionRate
+	err := PR.RatesSt.FindOne(ctx, bson.M{"_id": id}).Decode(&rate)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return rate.Rate, true, nil
+}
+
+func (PR *PayoutRepo) CommissionRateFor(ctx context.Context, sellerID, catalogID int) (float64, error) {
+	rate, ok, err := PR.lookupRate(ctx, sellerRateID(sellerID))
+	if err != nil || ok {
+		return rate, err
+	}
+	chain, err := PR.CatalogRepoI.LookupCatalogChain(ctx, catalogID)
+	if err != nil {
+		return 0, err
+	}
+	for _, catalog := range chain {
+		rate, ok, err := PR.lookupRate(ctx, catalogRateID(catalog.ID))
+		if err != nil || ok {
+			return rate, err
+		}
+	}
+	return PR.Default, nil
+}
+
+// RecordDelivery books a sale entry for every line of the delivered shipment.
+// Lines already booked are skipped, so it is safe to call again
+func (PR *PayoutRepo) RecordDelivery(ctx context.Context, shipment *model.Shipment) error {
+	now := time.Now().UTC()
+	for _, line := range shipment.Items {
+		if line.Item == nil {
+			continue
+		}
+		rate, err := PR.CommissionRateFor(ctx, shipment.SellerID, line.Item.CatalogID)
+		if err != nil {
+			return err
+		}
+		gross := roundMoney(line.Item.Price * float64(line.Quantity))
+		commission := roundMoney(gross * rate)
+		entry := Entry{
+			ID:             fmt.Sprintf("%s-%d-%d", KindSale, shipment.OrderID, line.Item.ID),
+			Kind:           KindSale,
+			SellerID:       shipment.SellerID,
+			OrderID:        shipment.OrderID,
+			ItemID:         line.Item.ID,
+			Quantity:       line.Quantity,
+			Gross:          gross,
+			CommissionRate: rate,
+			Commission:     commission,
+			Net:            roundMoney(gross - commission),
+			CreatedAt:      now,
+		}
+		_, err = PR.StMongoDB.InsertOne(ctx, entry)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReverseSale books back quantity of a sold item with the sale's prices and commission.
+// ref names what the sale is reversed for, e.g. a return, and goes into the entry ID,
+// so a repeated call books nothing. Items that weren't booked as sold have nothing to reverse,
+// and no more than the sold quantity is reversed over all refs
+func (PR *PayoutRepo) ReverseSale(ctx context.Context, ref string, orderID, itemID, quantity int) error {
+	var sale Entry
+	err := PR.StMongoDB.FindOne(ctx, bson.M{"_id": fmt.Sprintf("%s-%d-%d", KindSale, orderID, itemID)}).Decode(&sale)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id := fmt.Sprintf("%s-%s-%d-%d", KindReversal, ref, orderID, itemID)
+	reversals, err := PR.entries(ctx, bson.M{"kind": KindReversal, "orderid": orderID, "itemid": itemID, "_id": bson.M{"$ne": id}})
+	if err != nil {
+		return err
+	}
+	left := sale.Quantity
+	for _, reversal := range reversals {
+		left -= reversal.Quantity
+	}
+	if quantity > left {
+		quantity = left
+	}
+	if quantity <= 0 {
+		return nil
+	}
+	share := float64(quantity) / float64(sale.Quantity)
+	gross := -roundMoney(sale.Gross * share)
+	commission := -roundMoney(sale.Commission * share)
+	entry := Entry{
+		ID:             id,
+		Kind:           KindReversal,
+		SellerID:       sale.SellerID,
+		OrderID:        orderID,
+		ItemID:         itemID,
+		Quantity:       quantity,
+		Gross:          gross,
+		CommissionRate: sale.CommissionRate,
+		Commission:     commission,
+		Net:            roundMoney(gross - commission),
+		CreatedAt:      time.Now().UTC(),
+	}
+	_, err = PR.StMongoDB.InsertOne(ctx, entry)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	return nil
+}
+
+func (PR *PayoutRepo) entries(ctx context.Context, filter bson.M) ([]*Entry, error) {
+	opts := options.Find().SetSort(bson.D{
+		{Key: "createdat", Value: 1},
+		{Key: "_id", Value: 1},
+	})
+	cur, err := PR.StMongoDB.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	entries := []*Entry{}
+	for cur.Next(ctx) {
+		var entry *Entry
+		if err := cur.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SellerBalance sums the ledger of the seller, from and to limit the period and may be nil
+func (PR *PayoutRepo) SellerBalance(ctx context.Context, sellerID int, from, to *time.Time) (*Balance, error) {
+	filter := bson.M{"sellerid": sellerID}
+	period := bson.M{}
+	if from != nil {
+		period["$gte"] = *from
+	}
+	if to != nil {
+		period["$lt"] = *to
+	}
+	if len(period) > 0 {
+		filter["createdat"] = period
+	}
+	entries, err := PR.entries(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := &Balance{SellerID: sellerID, From: from, To: to, Entries: entries}
+	for _, entry := range entries {
+		switch entry.Kind {
+		case KindSale, KindReversal:
+			balance.Gross += entry.Gross
+			balance.Commission += entry.Commission
+			balance.Net += entry.Net
+		case KindPayout:
+			balance.PaidOut -= entry.Net
+		}
+	}
+	balance.Gross = roundMoney(balance.Gross)
+	balance.Commission = roundMoney(balance.Commission)
+	balance.Net = roundMoney(balance.Net)
+	balance.PaidOut = roundMoney(balance.PaidOut)
+	balance.Balance = roundMoney(balance.Net - balance.PaidOut)
+	return balance, nil
+}
+
+// CreatePayout settles the whole balance of the seller with a payout entry.
+// The entry ID is numbered by previous payouts, so of two concurrent payouts only one is booked
+func (PR *PayoutRepo) CreatePayout(ctx context.Context, sellerID int) (*Entry, error) {
+	balance, err := PR.SellerBalance(ctx, sellerID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Balance <= 0 {
+		return nil, fmt.Errorf("nothing to pay out")
+	}
+	payouts := 0
+	for _, entry := range balance.Entries {
+		if entry.Kind == KindPayout {
+			payouts++
+		}
+	}
+	entry := &Entry{
+		ID:        fmt.Sprintf("%s-%d-%d", KindPayout, sellerID, payouts+1),
+		Kind:      KindPayout,
+		SellerID:  sellerID,
+		Net:       -balance.Balance,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = PR.StMongoDB.InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("payout is already in progress")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func CreatePayoutRepo(St *mongo.Collection, ratesSt *mongo.Collection, catalogRepoI CatalogRepoInterface) *PayoutRepo {
+	return &PayoutRepo{
+		StMongoDB:    St,
+		RatesSt:      ratesSt,
+		CatalogRepoI: catalogRepoI,
+		Default:      DefaultCommission,
+	}
+}
@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"hw11_shopql/graph/model"
+)
+
+var (
+	ErrNotVerified = errors.New("only verified buyers can review this item")
+)
+
+type OrderRepoInterface interface {
+	UsersOrders(ctx context.Context, userID int) ([]*model.Order, error)
+}
+
+type ItemRepoInterface interface {
+	GetItemByID(ctx context.Context, id int) (*model.Item, error)
+}
+
+type CatalogRepoInterface interface {
+	LookupCatalogChain(ctx context.Context, ID int) ([]model.Catalog, error)
+}
+
+type ReviewPolicyInterface interface {
+	CheckReview(ctx context.Context, userID, itemID int) (bool, error)
+}
+
+// ReviewPolicy decides whether a user may rate or comment an item.
+// Catalogs without own policy inherit it from the parent, the root defaults to open
+type ReviewPolicy struct {
+	OrderRepoI   OrderRepoInterface
+	ItemRepoI    ItemRepoInterface
+	CatalogRepoI CatalogRepoInterface
+}
+
+// purchased are the statuses of an order that was paid for and not cancelled
+var purchased = map[model.OrderStatus]bool{
+	model.OrderStatusPaid:       true,
+	model.OrderStatusAssembling: true,
+	model.OrderStatusShipped:    true,
+	model.OrderStatusDelivered:  true,
+	model.OrderStatusReturned:   true,
+}
+
+func (RP *ReviewPolicy) HasPurchased(ctx context.Context, userID, itemID int) (bool, error) {
+	orders, err := RP.OrderRepoI.UsersOrders(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, order := range orders {
+		if !purchased[order.Status] {
+			continue
+		}
+		for _, line := range order.Items {
+			if line.Item != nil && line.Item.ID == itemID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (RP *ReviewPolicy) CatalogPolicy(ctx context.Context, catalogID int) (model.ReviewPolicy, error) {
+	chain, err := RP.CatalogRepoI.LookupCatalogChain(ctx, catalogID)
+	if err != nil {
+		return "", err
+	}
+	for _, catalog := range chain {
+		if catalog.ReviewPolicy.IsValid() {
+			return catalog.ReviewPolicy, nil
+		}
+	}
+	return model.ReviewPolicyOpen, nil
+}
+
+// CheckReview returns whether the review comes from a buyer of the item,
+// and ErrNotVerified if the item's catalog accepts only such reviews
+func (RP *ReviewPolicy) CheckReview(ctx context.Context, userID, itemID int) (bool, error) {
+	item, err := RP.ItemRepoI.GetItemByID(ctx, itemID)
+	if err != nil {
+		return false, err
+	}
+	verified, err := RP.HasPurchased(ctx, userID, itemID)
+	if err != nil {
+		return false, err
+	}
+	policy, err := RP.CatalogPolicy(ctx, item.CatalogID)
+	if err != nil {
+		return false, err
+	}
+	if policy == model.ReviewPolicyStrict && !verified {
+		return false, ErrNotVerified
+	}
+	return verified, nil
+}
+
+func CreateReviewPolicy(orderRepoI OrderRepoInterface, itemRepoI ItemRepoInterface, catalogRepoI CatalogRepoInterface) *ReviewPolicy {
+	return &ReviewPolicy{
+		OrderRepoI:   orderRepoI,
+		ItemRepoI:    itemRepoI,
+		CatalogRepoI: catalogRepoI,
+	}
+}
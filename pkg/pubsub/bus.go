@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// DefaultBuffer is how many messages a subscriber may lag behind before it misses some
+const DefaultBuffer = 16
+
+// Bus delivers messages published to a topic to its current subscribers.
+// MemoryBus works inside one process, a broker backed Bus can replace it
+type Bus interface {
+	Publish(topic string, msg interface{})
+	// Subscribe returns the messages of topic until ctx is done, then closes the channel
+	Subscribe(ctx context.Context, topic string) <-chan interface{}
+}
+
+type MemoryBus struct {
+	mu     sync.RWMutex
+	subs   map[string]map[chan interface{}]struct{}
+	Buffer int
+}
+
+// Publish never blocks, a subscriber with a full buffer misses the message
+func (MB *MemoryBus) Publish(topic string, msg interface{}) {
+	MB.mu.RLock()
+	defer MB.mu.RUnlock()
+	for ch := range MB.subs[topic] {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("pubsub: slow subscriber of %s missed a message", topic)
+		}
+	}
+}
+
+func (MB *MemoryBus) Subscribe(ctx context.Context, topic string) <-chan interface{} {
+	ch := make(chan interface{}, MB.Buffer)
+	MB.mu.Lock()
+	if MB.subs[topic] == nil {
+		MB.subs[topic] = make(map[chan interface{}]struct{})
+	}
+	MB.subs[topic][ch] = struct{}{}
+	MB.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		MB.mu.Lock()
+		delete(MB.subs[topic], ch)
+		if len(MB.subs[topic]) == 0 {
+			delete(MB.subs, topic)
+		}
+		MB.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func CreateMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subs:   make(map[string]map[chan interface{}]struct{}),
+		Buffer: DefaultBuffer,
+	}
+}
@@ -6,21 +6,61 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultMinRate = 1
+	DefaultMaxRate = 5
+	// DefaultPriorWeight is how many "virtual" votes of the prior mean every item starts with
+	DefaultPriorWeight = 10
 )
 
 type Rate struct {
-	UserID int
-	ItemID int
-	Rate   int
+	UserID     int
+	ItemID     int
+	Rate       int
+	Verified   bool
+	Dimensions []DimensionRate
+}
+
+// DimensionRate is a score of one catalog-specific criterion, e.g. "aroma"
+type DimensionRate struct {
+	Name string
+	Rate int
+}
+
+// DimensionStats is the average score of one criterion over all rates of an item
+type DimensionStats struct {
+	Name  string  `bson:"_id"`
+	Avg   float64 `bson:"avg"`
+	Count int     `bson:"count"`
+}
+
+// RateStats is a summary of all rates of an item
+type RateStats struct {
+	Avg          float64
+	Count        int
+	Distribution map[int]int
 }
 
 type RateRepo struct {
-	StMongoDB *mongo.Collection
+	StMongoDB   *mongo.Collection
+	ItemsSt     *mongo.Collection
+	MinRate     int
+	MaxRate     int
+	PriorMean   float64
+	PriorWeight float64
 }
 
 type RateRepoInterface interface {
 	ItemsRate(ctx context.Context, itemID int) (float64, error)
-	RateItem(ctx context.Context, userID, itemID, rate int) error
+	ItemsRateStats(ctx context.Context, itemID int) (*RateStats, error)
+	UserRate(ctx context.Context, userID, itemID int) (*int, error)
+	ItemRates(ctx context.Context, itemID int, limit int, offset int) ([]*Rate, error)
+	ItemsDimensionRates(ctx context.Context, itemID int) ([]*DimensionStats, error)
+	RateItem(ctx context.Context, userID, itemID, rate int, verified bool, dimensions []DimensionRate) error
+	Bayesian(sum, count int) float64
 }
 
 func (RR *RateRepo) RateExist(ctx context.Context, userID, itemID int) (bool, error) {
@@ -35,23 +75,23 @@ func (RR *RateRepo) RateExist(ctx context.Context, userID, itemID int) (bool, er
 	return count > 0, err
 }
 
-func (RR *RateRepo) RateItem(ctx context.Context, userID, itemID, rate int) error {
+func (RR *RateRepo) ValidateRate(rate int) error {
+	if rate < RR.MinRate || rate > RR.MaxRate {
+		return fmt.Errorf("rate must be between %d and %d", RR.MinRate, RR.MaxRate)
+	}
+	return nil
+}
 
-	exist, err := RR.RateExist(ctx, userID, itemID)
-	if err != nil {
+// RateItem stores the user's rate and applies the difference to the
+// ratingsum/ratingcount aggregates of the item document
+func (RR *RateRepo) RateItem(ctx context.Context, userID, itemID, rate int, verified bool, dimensions []DimensionRate) error {
+	if err := RR.ValidateRate(rate); err != nil {
 		return err
 	}
-
-	if !exist {
-		_, err := RR.StMongoDB.InsertOne(ctx, Rate{
-			UserID: userID,
-			ItemID: itemID,
-			Rate:   rate,
-		})
-		if err != nil {
-			return err
+	for _, dimension := range dimensions {
+		if err := RR.ValidateRate(dimension.Rate); err != nil {
+			return fmt.Errorf("%s: %w", dimension.Name, err)
 		}
-		return nil
 	}
 
 	filter := bson.M{
@@ -60,31 +100,137 @@ func (RR *RateRepo) RateItem(ctx context.Context, userID, itemID, rate int) erro
 	}
 	update := bson.M{
 		"$set": bson.M{
-			"rate": rate,
+			"rate":       rate,
+			"verified":   verified,
+			"dimensions": dimensions,
 		},
 	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
 
-	_, err = RR.StMongoDB.UpdateOne(ctx, filter, update)
-	if err != nil {
+	var previous Rate
+	sumDelta, countDelta := rate, 1
+	err := RR.StMongoDB.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+	if err == nil {
+		sumDelta, countDelta = rate-previous.Rate, 0
+	} else if err != mongo.ErrNoDocuments {
 		return err
 	}
 
-	return nil
+	return RR.applyAggregates(ctx, itemID, sumDelta, countDelta)
+}
+
+// applyAggregates adds the deltas on the server, so concurrent rates of one item all count
+func (RR *RateRepo) applyAggregates(ctx context.Context, itemID, sumDelta, countDelta int) error {
+	filter := bson.M{
+		"id": itemID,
+	}
+	update := mongo.Pipeline{
+		{
+			{Key: "$set", Value: bson.D{
+				{Key: "ratingsum", Value: bson.D{{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$ratingsum", 0}}}, sumDelta}}}},
+				{Key: "ratingcount", Value: bson.D{{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$ratingcount", 0}}}, countDelta}}}},
+			}},
+		},
+		{
+			{Key: "$set", Value: bson.D{
+				{Key: "bayesianrating", Value: bson.D{{Key: "$divide", Value: bson.A{
+					bson.D{{Key: "$add", Value: bson.A{RR.PriorWeight * RR.PriorMean, "$ratingsum"}}},
+					bson.D{{Key: "$add", Value: bson.A{RR.PriorWeight, "$ratingcount"}}},
+				}}}},
+			}},
+		},
+	}
+	_, err := RR.ItemsSt.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// setAggregates overwrites the aggregates with a full recompute, only BackfillItemAggregates uses it
+func (RR *RateRepo) setAggregates(ctx context.Context, itemID, sum, count int) error {
+	update := bson.M{
+		"$set": bson.M{
+			"ratingsum":      sum,
+			"ratingcount":    count,
+			"bayesianrating": RR.Bayesian(sum, count),
+		},
+	}
+	_, err := RR.ItemsSt.UpdateOne(ctx, bson.M{"id": itemID}, update)
+	return err
+}
+
+// Bayesian is the average shrunk towards PriorMean, so few votes can't outrank many
+func (RR *RateRepo) Bayesian(sum, count int) float64 {
+	return (RR.PriorWeight*RR.PriorMean + float64(sum)) / (RR.PriorWeight + float64(count))
 }
+
+// BackfillItemAggregates recomputes ratingsum, ratingcount and bayesianrating
+// of every item from the Rates collection and returns the number of rated items
+func (RR *RateRepo) BackfillItemAggregates(ctx context.Context) (int, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$itemid"},
+				{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$rate"}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}},
+		},
+	}
+	cur, err := RR.StMongoDB.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var rated []int
+	for cur.Next(ctx) {
+		var result struct {
+			ItemID int `bson:"_id"`
+			Sum    int `bson:"sum"`
+			Count  int `bson:"count"`
+		}
+		if err := cur.Decode(&result); err != nil {
+			return 0, err
+		}
+		if err := RR.setAggregates(ctx, result.ItemID, result.Sum, result.Count); err != nil {
+			return 0, err
+		}
+		rated = append(rated, result.ItemID)
+	}
+	if err := cur.Err(); err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{
+		"id": bson.M{"$nin": rated},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"ratingsum":      0,
+			"ratingcount":    0,
+			"bayesianrating": RR.Bayesian(0, 0),
+		},
+	}
+	if _, err := RR.ItemsSt.UpdateMany(ctx, filter, update); err != nil {
+		return 0, err
+	}
+	return len(rated), nil
+}
+
 func (RR *RateRepo) ItemsRate(ctx context.Context, itemID int) (float64, error) {
 	filter := bson.D{
-		{"itemid", itemID}, // Ensure the field matches your database schema
+		{Key: "itemid", Value: itemID}, // Ensure the field matches your database schema
 	}
 
 	// Use the aggregation pipeline to calculate the average of rates
 	pipeline := mongo.Pipeline{
 		{
-			{"$match", filter}, // Match documents with the specified itemID
+			{Key: "$match", Value: filter}, // Match documents with the specified itemID
 		},
 		{
-			{"$group", bson.D{
-				{"_id", "$itemid"},                 // Group by item_id
-				{"avg", bson.D{{"$avg", "$rate"}}}, // Calculate the average of the rates
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$itemid"},                             // Group by item_id
+				{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$rate"}}}, // Calculate the average of the rates
 			}},
 		},
 	}
@@ -112,6 +258,150 @@ func (RR *RateRepo) ItemsRate(ctx context.Context, itemID int) (float64, error)
 	return result.Avg, nil
 }
 
-func CreateRateRepo(st *mongo.Collection) *RateRepo {
-	return &RateRepo{StMongoDB: st}
+// ItemsRateStats counts rates of the item per star in one pass,
+// average and total count are derived from the buckets
+func (RR *RateRepo) ItemsRateStats(ctx context.Context, itemID int) (*RateStats, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{Key: "$match", Value: bson.D{{Key: "itemid", Value: itemID}}},
+		},
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$rate"}, // Group by star
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}},
+		},
+	}
+
+	cur, err := RR.StMongoDB.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	stats := &RateStats{Distribution: make(map[int]int)}
+	for rate := RR.MinRate; rate <= RR.MaxRate; rate++ {
+		stats.Distribution[rate] = 0
+	}
+	sum := 0
+	for cur.Next(ctx) {
+		var bucket struct {
+			Rate  int `bson:"_id"`
+			Count int `bson:"count"`
+		}
+		if err := cur.Decode(&bucket); err != nil {
+			return nil, err
+		}
+		stats.Distribution[bucket.Rate] += bucket.Count
+		stats.Count += bucket.Count
+		sum += bucket.Rate * bucket.Count
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if stats.Count > 0 {
+		stats.Avg = float64(sum) / float64(stats.Count)
+	}
+	return stats, nil
+}
+
+func (RR *RateRepo) ItemsDimensionRates(ctx context.Context, itemID int) ([]*DimensionStats, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{Key: "$match", Value: bson.D{{Key: "itemid", Value: itemID}}},
+		},
+		{
+			{Key: "$unwind", Value: "$dimensions"},
+		},
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$dimensions.name"}, // Group by criterion
+				{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$dimensions.rate"}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}},
+		},
+		{
+			{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}},
+		},
+	}
+
+	cur, err := RR.StMongoDB.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var stats []*DimensionStats
+	if err := cur.All(ctx, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CheckDimensions makes sure every scored criterion is defined for the catalog
+// and is scored only once
+func CheckDimensions(allowed []string, dimensions []DimensionRate) error {
+	known := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		known[name] = true
+	}
+	seen := make(map[string]bool, len(dimensions))
+	for _, dimension := range dimensions {
+		if !known[dimension.Name] {
+			return fmt.Errorf("unknown rating dimension %q", dimension.Name)
+		}
+		if seen[dimension.Name] {
+			return fmt.Errorf("rating dimension %q rated twice", dimension.Name)
+		}
+		seen[dimension.Name] = true
+	}
+	return nil
+}
+
+func (RR *RateRepo) UserRate(ctx context.Context, userID, itemID int) (*int, error) {
+	filter := bson.M{
+		"userid": userID,
+		"itemid": itemID,
+	}
+	var rate Rate
+	err := RR.StMongoDB.FindOne(ctx, filter).Decode(&rate)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rate.Rate, nil
+}
+
+func (RR *RateRepo) ItemRates(ctx context.Context, itemID int, limit int, offset int) ([]*Rate, error) {
+	filter := bson.M{
+		"itemid": itemID,
+	}
+	findOptions := options.Find().
+		SetLimit(int64(limit)).
+		SetSkip(int64(offset))
+
+	cur, err := RR.StMongoDB.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rates []*Rate
+	if err := cur.All(ctx, &rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+func CreateRateRepo(st *mongo.Collection, itemsSt *mongo.Collection) *RateRepo {
+	return &RateRepo{
+		StMongoDB:   st,
+		ItemsSt:     itemsSt,
+		MinRate:     DefaultMinRate,
+		MaxRate:     DefaultMaxRate,
+		PriorMean:   float64(DefaultMinRate+DefaultMaxRate) / 2,
+		PriorWeight: DefaultPriorWeight,
+	}
 }
@@ -0,0 +1,373 @@
+package rma
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/graph/model"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxPhotos = 5
+
+type Line struct {
+	ItemID   int
+	Quantity int
+	// Price is the price the item was ordered for
+	Price float64
+}
+
+// ReturnRequest is a customer's request to send back lines of a delivered order
+type ReturnRequest struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	OrderID      int
+	UserID       int
+	Lines        []Line
+	Reason       string
+	Photos       []string
+	Status       model.ReturnStatus
+	Note         *string
+	RefundAmount float64
+	// RefundID is stored as soon as the provider refunded, a retry only finishes the move to refunded
+	RefundID *string
+	// Refunding is set while the refund is sent, so two calls can't both refund
+	Refunding bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type OrderRepoInterface interface {
+	OrderByID(ctx context.Context, orderID int) (*model.Order, error)
+	ReturnOrder(ctx context.Context, orderID int, actor string) (*model.Order, error)
+	AcceptReturn(ctx context.Context, orderID int, returnID string) error
+}
+
+type ItemRepoInterface interface {
+	RestockItem(ctx context.Context, itemID, quantity int) (*model.Item, error)
+}
+
+type RefunderInterface interface {
+	RefundOrder(ctx context.Context, orderID int, amount float64) (string, error)
+}
+
+type LedgerInterface interface {
+	ReverseSale(ctx context.Context, ref string, orderID, itemID, quantity int) error
+}
+
+type ReturnRepoInterface interface {
+	OpenReturn(ctx context.Context, userID int, in model.ReturnInput) (*ReturnRequest, error)
+	ApproveReturn(ctx context.Context, id string, note *string) (*ReturnRequest, error)
+	RejectReturn(ctx context.Context, id string, note *string) (*ReturnRequest, error)
+	ReceiveReturn(ctx context.Context, id, actor string) (*ReturnRequest, error)
+	UserReturns(ctx context.Context, userID int) ([]*ReturnRequest, error)
+	Returns(ctx context.Context, status *model.ReturnStatus) ([]*ReturnRequest, error)
+}
+
+type ReturnRepo struct {
+	StMongoDB *mongo.Collection
+	OrderRepo OrderRepoInterface
+	ItemRepo  ItemRepoInterface
+	Refunder  RefunderInterface
+	// Ledger reverses the sales of refunded lines, may be nil
+	Ledger LedgerInterface
+}
+
+func validPhoto(photo string) bool {
+	u, err := url.ParseRequestURI(photo)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// returnedQuantities counts the items of the order already in returns that weren't rejected
+func (RR *ReturnRepo) returnedQuantities(ctx context.Context, orderID int) (map[int]int, error) {
+	returns, err := RR.find(ctx, bson.M{"orderid": orderID, "status": bson.M{"$ne": model.ReturnStatusRejected}})
+	if err != nil {
+		return nil, err
+	}
+	returned := make(map[int]int)
+	for _, ret := range returns {
+		for _, line := range ret.Lines {
+			returned[line.ItemID] += line.Quantity
+		}
+	}
+	return returned, nil
+}
+
+// OpenReturn files a return of lines of a delivered order of the user.
+// An item can't be returned more times than it was ordered
+func (RR *ReturnRepo) OpenReturn(ctx context.Context, userID int, in model.ReturnInput) (*ReturnRequest, error) {
+	if strings.TrimSpace(in.Reason) == "" {
+		return nil, fmt.Errorf("reason is required")
+	}
+	if len(in.Lines) == 0 {
+		return nil, fmt.Errorf("nothing to return")
+	}
+	if len(in.Photos) > maxPhotos {
+		return nil, fmt.Errorf("at most %d photos", maxPhotos)
+	}
+	for _, photo := range in.Photos {
+		if !validPhoto(photo) {
+			return nil, fmt.Errorf("photo must be an http(s) link: %q", photo)
+		}
+	}
+	order, err := RR.OrderRepo.OrderByID(ctx, in.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, fmt.Errorf("order not exist")
+	}
+	if order.Status != model.OrderStatusDelivered {
+		return nil, fmt.Errorf("order can't be returned in status %s", order.Status)
+	}
+
+	ordered := make(map[int]*model.CartItem)
+	for _, line := range order.Items {
+		if line.Item != nil {
+			ordered[line.Item.ID] = line
+		}
+	}
+	returned, err := RR.returnedQuantities(ctx, in.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ReturnRequest{
+		ID:      primitive.NewObjectID(),
+		OrderID: in.OrderID,
+		UserID:  userID,
+		Reason:  in.Reason,
+		Photos:  in.Photos,
+		Status:  model.ReturnStatusRequested,
+	}
+	if ret.Photos == nil {
+		ret.Photos = []string{}
+	}
+	for _, line := range in.Lines {
+		orderLine, ok := ordered[line.ItemID]
+		if !ok {
+			return nil, fmt.Errorf("item %d is not in the order", line.ItemID)
+		}
+		if line.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity must be positive")
+		}
+		returned[line.ItemID] += line.Quantity
+		if returned[line.ItemID] > orderLine.Quantity {
+			return nil, fmt.Errorf("item %d: can't return more than %d", line.ItemID, orderLine.Quantity)
+		}
+		ret.Lines = append(ret.Lines, Line{ItemID: line.ItemID, Quantity: line.Quantity, Price: orderLine.Item.Price})
+		ret.RefundAmount += orderLine.Item.Price * float64(line.Quantity)
+	}
+	ret.CreatedAt = time.Now().UTC()
+	ret.UpdatedAt = ret.CreatedAt
+	if _, err := RR.StMongoDB.InsertOne(ctx, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (RR *ReturnRepo) returnByID(ctx context.Context, objectID primitive.ObjectID) (*ReturnRequest, error) {
+	var ret *ReturnRequest
+	err := RR.StMongoDB.FindOne(ctx, bson.M{"_id": objectID}).Decode(&ret)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("return not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// move changes the status of the return if it is in from, the check and the change are one update
+func (RR *ReturnRepo) move(ctx context.Context, id string, from, to model.ReturnStatus, set bson.M) (*ReturnRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("return not exist")
+	}
+	if set == nil {
+		set = bson.M{}
+	}
+	set["status"] = to
+	set["updatedat"] = time.Now().UTC()
+	var ret *ReturnRequest
+	err = RR.StMongoDB.FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "status": from},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ret)
+	if err != mongo.ErrNoDocuments {
+		return ret, err
+	}
+	ret, err = RR.returnByID(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+	return ret, fmt.Errorf("cannot change return status from %s to %s", ret.Status, to)
+}
+
+func (RR *ReturnRepo) ApproveReturn(ctx context.Context, id string, note *string) (*ReturnRequest, error) {
+	return RR.move(ctx, id, model.ReturnStatusRequested, model.ReturnStatusApproved, bson.M{"note": note})
+}
+
+func (RR *ReturnRepo) RejectReturn(ctx context.Context, id string, note *string) (*ReturnRequest, error) {
+	return RR.move(ctx, id, model.ReturnStatusRequested, model.ReturnStatusRejected, bson.M{"note": note})
+}
+
+// claimRefund marks the received return as being refunded, only one call gets the claim.
+// If the process dies after the provider refunded, the marker stays and keeps the refund from repeating
+func (RR *ReturnRepo) claimRefund(ctx context.Context, ret *ReturnRequest) error {
+	res, err := RR.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": ret.ID, "status": model.ReturnStatusReceived, "refunding": bson.M{"$ne": true}, "refundid": nil},
+		bson.M{"$set": bson.M{"refunding": true, "updatedat": time.Now().UTC()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("refund of the return is in progress")
+	}
+	return nil
+}
+
+// refund claims the return and refunds it, the refund ID is stored with the claim
+func (RR *ReturnRepo) refund(ctx context.Context, ret *ReturnRequest) error {
+	if err := RR.claimRefund(ctx, ret); err != nil {
+		return err
+	}
+	refundID, err := RR.Refunder.RefundOrder(ctx, ret.OrderID, ret.RefundAmount)
+	if err != nil {
+		if _, undoErr := RR.StMongoDB.UpdateOne(ctx, bson.M{"_id": ret.ID}, bson.M{"$set": bson.M{"refunding": false}}); undoErr != nil {
+			log.Printf("failed to release refund of return %s: %v", ret.ID.Hex(), undoErr)
+		}
+		return fmt.Errorf("items received, refund failed: %w", err)
+	}
+	ret.RefundID = &refundID
+	if _, err := RR.StMongoDB.UpdateOne(ctx, bson.M{"_id": ret.ID}, bson.M{"$set": bson.M{"refundid": refundID}}); err != nil {
+		log.Printf("failed to store refund %s of return %s: %v", refundID, ret.ID.Hex(), err)
+	}
+	return nil
+}
+
+// ReceiveReturn puts the returned items back to stock and refunds them.
+// The order must still be delivered, or returned by earlier returns.
+// If the refund fails the return stays received and the next call retries only the refund,
+// a return refunded already only moves to refunded
+func (RR *ReturnRepo) ReceiveReturn(ctx context.Context, id, actor string) (*ReturnRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("return not exist")
+	}
+	ret, err := RR.returnByID(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Status == model.ReturnStatusApproved || ret.Status == model.ReturnStatusReceived {
+		if err := RR.OrderRepo.AcceptReturn(ctx, ret.OrderID, id); err != nil {
+			return nil, err
+		}
+	}
+	ret, err = RR.move(ctx, id, model.ReturnStatusApproved, model.ReturnStatusReceived, nil)
+	switch {
+	case err == nil:
+		for _, line := range ret.Lines {
+			if _, err := RR.ItemRepo.RestockItem(ctx, line.ItemID, line.Quantity); err != nil {
+				log.Printf("failed to return %d of item %d to stock: %v", line.Quantity, line.ItemID, err)
+			}
+		}
+	case ret != nil && ret.Status == model.ReturnStatusReceived:
+		// the items are back already, only the refund is left
+	default:
+		return nil, err
+	}
+
+	if ret.RefundID == nil {
+		if err := RR.refund(ctx, ret); err != nil {
+			return nil, err
+		}
+	}
+	ret, err = RR.move(ctx, id, model.ReturnStatusReceived, model.ReturnStatusRefunded, bson.M{"refundid": ret.RefundID, "refunding": false})
+	if err != nil {
+		return nil, err
+	}
+	RR.reverseSales(ctx, ret)
+	RR.closeOrder(ctx, ret.OrderID, actor)
+	return ret, nil
+}
+
+// reverseSales takes the refunded lines back from the sellers' ledger
+func (RR *ReturnRepo) reverseSales(ctx context.Context, ret *ReturnRequest) {
+	if RR.Ledger == nil {
+		return
+	}
+	for _, line := range ret.Lines {
+		if err := RR.Ledger.ReverseSale(ctx, ret.ID.Hex(), ret.OrderID, line.ItemID, line.Quantity); err != nil {
+			log.Printf("failed to reverse sale of item %d in order %d: %v", line.ItemID, ret.OrderID, err)
+		}
+	}
+}
+
+// closeOrder marks the order returned once every ordered item is refunded
+func (RR *ReturnRepo) closeOrder(ctx context.Context, orderID int, actor string) {
+	order, err := RR.OrderRepo.OrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("failed to load order %d: %v", orderID, err)
+		return
+	}
+	returns, err := RR.find(ctx, bson.M{"orderid": orderID, "status": model.ReturnStatusRefunded})
+	if err != nil {
+		log.Printf("failed to load returns of order %d: %v", orderID, err)
+		return
+	}
+	refunded := make(map[int]int)
+	for _, ret := range returns {
+		for _, line := range ret.Lines {
+			refunded[line.ItemID] += line.Quantity
+		}
+	}
+	for _, line := range order.Items {
+		if line.Item != nil && refunded[line.Item.ID] < line.Quantity {
+			return
+		}
+	}
+	if _, err := RR.OrderRepo.ReturnOrder(ctx, orderID, actor); err != nil {
+		log.Printf("failed to mark order %d returned: %v", orderID, err)
+	}
+}
+
+func (RR *ReturnRepo) find(ctx context.Context, filter bson.M) ([]*ReturnRequest, error) {
+	cur, err := RR.StMongoDB.Find(ctx, filter, options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		return nil, err
+	}
+	returns := []*ReturnRequest{}
+	if err := cur.All(ctx, &returns); err != nil {
+		return nil, err
+	}
+	return returns, nil
+}
+
+func (RR *ReturnRepo) UserReturns(ctx context.Context, userID int) ([]*ReturnRequest, error) {
+	return RR.find(ctx, bson.M{"userid": userID})
+}
+
+func (RR *ReturnRepo) Returns(ctx context.Context, status *model.ReturnStatus) ([]*ReturnRequest, error) {
+	filter := bson.M{}
+	if status != nil {
+		filter["status"] = *status
+	}
+	return RR.find(ctx, filter)
+}
+
+func CreateReturnRepo(St *mongo.Collection, orderRepo OrderRepoInterface, itemRepo ItemRepoInterface, refunder RefunderInterface) *ReturnRepo {
+	return &ReturnRepo{
+		StMongoDB: St,
+		OrderRepo: orderRepo,
+		ItemRepo:  itemRepo,
+		Refunder:  refunder,
+	}
+}
@@ -3,14 +3,20 @@ package role
 import (
 	"database/sql"
 	"fmt"
+	"hw11_shopql/pkg/utils/roleutils"
 )
 
+const SellerRoleID = 4
+
 type RoleRepo struct {
 	Db *sql.DB
 }
 
 type RoleRepoI interface {
 	AddRoleForUser(id int, RoleID int) error
+	AddSellerForUser(id int, SellerID int) error
+	UserSellers(id int) ([]int, error)
+	HasRole(id int, role string) bool
 }
 
 func (RP *RoleRepo) AddRoleForUser(id int, RoleID int) error {
@@ -21,6 +27,54 @@ func (RP *RoleRepo) AddRoleForUser(id int, RoleID int) error {
 	return nil
 }
 
+// AddSellerForUser links the user to the seller and grants the seller role
+func (RP *RoleRepo) AddSellerForUser(id int, SellerID int) error {
+	tx, err := RP.Db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction")
+	}
+	_, err = tx.Exec("INSERT INTO seller_user VALUES($1, $2)", SellerID, id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to add seller")
+	}
+	_, err = tx.Exec(`INSERT INTO user_role SELECT $1, $2
+		WHERE NOT EXISTS (SELECT 1 FROM user_role WHERE user_id = $1 and role_id = $2)`, id, SellerRoleID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to add role")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit")
+	}
+	return nil
+}
+
+func (RP *RoleRepo) UserSellers(id int) ([]int, error) {
+	rows, err := RP.Db.Query("SELECT seller_id FROM seller_user WHERE user_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sellers []int
+	for rows.Next() {
+		var sellerID int
+		if err := rows.Scan(&sellerID); err != nil {
+			return nil, err
+		}
+		sellers = append(sellers, sellerID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sellers, nil
+}
+
+func (RP *RoleRepo) HasRole(id int, role string) bool {
+	return roleutils.HasRole(RP.Db, id, role)
+}
+
 func CreateRoleRepo(db *sql.DB) *RoleRepo {
 	return &RoleRepo{Db: db}
 }
@@ -2,16 +2,23 @@ package seller
 
 import (
 	"context"
+	"fmt"
 	"hw11_shopql/graph/model"
+	"regexp"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SellerRepoInterface interface {
 	SellerExists(ctx context.Context, id int) (bool, error)
 	InsertSeller(ctx context.Context, seller model.Seller) error
 	LookupSellerById(ctx context.Context, id int) (*model.Seller, error)
+	UpdateSeller(ctx context.Context, in model.SellerInput) (*model.Seller, error)
+	DeactivateSeller(ctx context.Context, id int) (*model.Seller, error)
+	Sellers(ctx context.Context, filter *model.SellerFilter, limit int, offset int) ([]*model.Seller, error)
+	DeactivatedSellerIDs(ctx context.Context) ([]int, error)
 }
 
 type SellerRepo struct {
@@ -30,14 +37,27 @@ func (h *SellerRepo) SellerExists(ctx context.Context, id int) (bool, error) {
 	return true, nil
 }
 
+// InsertSeller relies on the unique index on id, so two concurrent inserts can't both succeed
 func (SR *SellerRepo) InsertSeller(ctx context.Context, seller model.Seller) error {
 	_, err := SR.StMongoDB.InsertOne(ctx, seller)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("seller already exist")
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// EnsureIndexes creates the unique index on the seller id
+func (SR *SellerRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := SR.StMongoDB.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
 func (SR *SellerRepo) LookupSellerById(ctx context.Context, id int) (*model.Seller, error) {
 	filter := bson.M{
 		"id": id,
@@ -51,6 +71,95 @@ func (SR *SellerRepo) LookupSellerById(ctx context.Context, id int) (*model.Sell
 
 }
 
+func (SR *SellerRepo) UpdateSeller(ctx context.Context, in model.SellerInput) (*model.Seller, error) {
+	filter := bson.M{
+		"id": in.SellerID,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"name": in.Name,
+		},
+	}
+	res, err := SR.StMongoDB.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("seller not exist")
+	}
+	return SR.LookupSellerById(ctx, in.SellerID)
+}
+
+// DeactivateSeller hides the seller's items from catalogs, items themselves stay untouched
+func (SR *SellerRepo) DeactivateSeller(ctx context.Context, id int) (*model.Seller, error) {
+	filter := bson.M{
+		"id": id,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"deactivated": true,
+		},
+	}
+	res, err := SR.StMongoDB.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("seller not exist")
+	}
+	return SR.LookupSellerById(ctx, id)
+}
+
+func (SR *SellerRepo) Sellers(ctx context.Context, filter *model.SellerFilter, limit int, offset int) ([]*model.Seller, error) {
+	query := bson.M{}
+	if filter != nil {
+		if filter.Name != nil {
+			query["name"] = bson.M{"$regex": regexp.QuoteMeta(*filter.Name), "$options": "i"}
+		}
+		if filter.Deactivated != nil {
+			if *filter.Deactivated {
+				query["deactivated"] = true
+			} else {
+				query["deactivated"] = bson.M{"$ne": true}
+			}
+		}
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.M{"id": 1}).
+		SetLimit(int64(limit)).
+		SetSkip(int64(offset))
+
+	cursor, err := SR.StMongoDB.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sellers: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	sellers := []*model.Seller{}
+	if err := cursor.All(ctx, &sellers); err != nil {
+		return nil, fmt.Errorf("failed to decode sellers: %w", err)
+	}
+	return sellers, nil
+}
+
+func (SR *SellerRepo) DeactivatedSellerIDs(ctx context.Context) ([]int, error) {
+	ids, err := SR.StMongoDB.Distinct(ctx, "id", bson.M{"deactivated": true})
+	if err != nil {
+		return nil, err
+	}
+	sellerIDs := make([]int, 0, len(ids))
+	for _, id := range ids {
+		switch v := id.(type) {
+		case int32:
+			sellerIDs = append(sellerIDs, int(v))
+		case int64:
+			sellerIDs = append(sellerIDs, int(v))
+		}
+	}
+	return sellerIDs, nil
+}
+
 func CreateSellersHandler(collection *mongo.Collection) *SellerRepo {
 	return &SellerRepo{
 		StMongoDB: collection,
@@ -0,0 +1,213 @@
+package seller
+
+import (
+	"context"
+	"hw11_shopql/graph/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DefaultStatsTTL = 5 * time.Minute
+
+// Stats is a row of the SellerStats materialized view
+type Stats struct {
+	SellerID       int `bson:"_id"`
+	ItemCount      int
+	UnitsInStock   int
+	CompletedDeals int
+	Revenue        float64
+	RatingSum      int
+	RatingCount    int
+	RefreshedAt    time.Time
+}
+
+func (s *Stats) AverageRating() float64 {
+	if s.RatingCount == 0 {
+		return 0
+	}
+	return float64(s.RatingSum) / float64(s.RatingCount)
+}
+
+type SellerStatsRepoInterface interface {
+	Refresh(ctx context.Context) error
+	MarkStale(ctx context.Context) error
+	SellerStats(ctx context.Context, sellerID int) (*Stats, error)
+}
+
+// SellerStatsRepo keeps statistics of all sellers computed from Items and orders.
+// Rates are taken from the per-item rating aggregates.
+// Order changes only mark the view stale, it is refreshed by the next read after that
+// or when it gets older than TTL, so a burst of orders costs one refresh
+type SellerStatsRepo struct {
+	StMongoDB *mongo.Collection
+	SellersSt *mongo.Collection
+	ItemsSt   *mongo.Collection
+	OrdersSt  *mongo.Collection
+	TTL       time.Duration
+}
+
+// staleID is the document of the view that keeps when it was last marked stale.
+// It lives in Mongo, so a change on one instance is seen by the reads of all of them
+const staleID = "stale"
+
+// MarkStale makes the next read refresh the view
+func (SS *SellerStatsRepo) MarkStale(ctx context.Context) error {
+	_, err := SS.StMongoDB.UpdateOne(ctx,
+		bson.M{"_id": staleID},
+		bson.M{"$max": bson.M{"staleat": time.Now().UTC()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// staleAt returns when the view was last marked stale, zero if never
+func (SS *SellerStatsRepo) staleAt(ctx context.Context) (time.Time, error) {
+	var marker struct {
+		StaleAt time.Time
+	}
+	err := SS.StMongoDB.FindOne(ctx, bson.M{"_id": staleID}).Decode(&marker)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return time.Time{}, err
+	}
+	return marker.StaleAt, nil
+}
+
+func (SS *SellerStatsRepo) Refresh(ctx context.Context) error {
+	now := time.Now().UTC()
+	stats := make(map[int]*Stats)
+	get := func(sellerID int) *Stats {
+		if _, ok := stats[sellerID]; !ok {
+			stats[sellerID] = &Stats{SellerID: sellerID, RefreshedAt: now}
+		}
+		return stats[sellerID]
+	}
+
+	var sellers []struct {
+		ID    int
+		Deals int
+	}
+	cur, err := SS.SellersSt.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if err := cur.All(ctx, &sellers); err != nil {
+		return err
+	}
+	for _, seller := range sellers {
+		get(seller.ID).CompletedDeals += seller.Deals
+	}
+
+	itemsPipeline := mongo.Pipeline{
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$sellerid"},
+				{Key: "itemcount", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "unitsinstock", Value: bson.D{{Key: "$sum", Value: "$instock"}}},
+				{Key: "ratingsum", Value: bson.D{{Key: "$sum", Value: "$ratingsum"}}},
+				{Key: "ratingcount", Value: bson.D{{Key: "$sum", Value: "$ratingcount"}}},
+			}},
+		},
+	}
+	var items []Stats
+	cur, err = SS.ItemsSt.Aggregate(ctx, itemsPipeline)
+	if err != nil {
+		return err
+	}
+	if err := cur.All(ctx, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		s := get(item.SellerID)
+		s.ItemCount = item.ItemCount
+		s.UnitsInStock = item.UnitsInStock
+		s.RatingSum = item.RatingSum
+		s.RatingCount = item.RatingCount
+	}
+
+	// only delivered orders are completed deals
+	ordersPipeline := mongo.Pipeline{
+		{
+			{Key: "$match", Value: bson.D{{Key: "status", Value: model.OrderStatusDelivered}}},
+		},
+		{
+			{Key: "$unwind", Value: "$items"},
+		},
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "seller", Value: "$items.item.sellerid"}, {Key: "order", Value: "$_id"}}},
+				{Key: "revenue", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$multiply", Value: bson.A{"$items.quantity", "$items.item.price"}}}}}},
+			}},
+		},
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$_id.seller"},
+				{Key: "completeddeals", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "revenue", Value: bson.D{{Key: "$sum", Value: "$revenue"}}},
+			}},
+		},
+	}
+	var orders []Stats
+	cur, err = SS.OrdersSt.Aggregate(ctx, ordersPipeline)
+	if err != nil {
+		return err
+	}
+	if err := cur.All(ctx, &orders); err != nil {
+		return err
+	}
+	for _, order := range orders {
+		s := get(order.SellerID)
+		s.CompletedDeals += order.CompletedDeals
+		s.Revenue = order.Revenue
+	}
+
+	ids := make([]int, 0, len(stats))
+	for sellerID, s := range stats {
+		opts := options.Replace().SetUpsert(true)
+		if _, err := SS.StMongoDB.ReplaceOne(ctx, bson.M{"_id": sellerID}, s, opts); err != nil {
+			return err
+		}
+		ids = append(ids, sellerID)
+	}
+	// rows of sellers this pass didn't see are gone, the stale marker is kept
+	_, err = SS.StMongoDB.DeleteMany(ctx, bson.M{"_id": bson.M{"$nin": ids, "$type": "number"}})
+	return err
+}
+
+func (SS *SellerStatsRepo) SellerStats(ctx context.Context, sellerID int) (*Stats, error) {
+	stats := &Stats{}
+	err := SS.StMongoDB.FindOne(ctx, bson.M{"_id": sellerID}).Decode(stats)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	staleAt, staleErr := SS.staleAt(ctx)
+	if staleErr != nil {
+		return nil, staleErr
+	}
+	// a change made while the row was computed is later than its RefreshedAt and refreshes again
+	if err == nil && staleAt.Before(stats.RefreshedAt) && time.Since(stats.RefreshedAt) < SS.TTL {
+		return stats, nil
+	}
+
+	if err := SS.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	stats = &Stats{SellerID: sellerID}
+	err = SS.StMongoDB.FindOne(ctx, bson.M{"_id": sellerID}).Decode(stats)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func CreateSellerStatsRepo(st, sellersSt, itemsSt, ordersSt *mongo.Collection) *SellerStatsRepo {
+	return &SellerStatsRepo{
+		StMongoDB: st,
+		SellersSt: sellersSt,
+		ItemsSt:   itemsSt,
+		OrdersSt:  ordersSt,
+		TTL:       DefaultStatsTTL,
+	}
+}
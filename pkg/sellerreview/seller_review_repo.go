@@ -0,0 +1,200 @@
+package sellerreview
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/pkg/rate"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SellerReview struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    int
+	SellerID  int
+	OrderID   int
+	Rate      int
+	Text      string
+	CreatedAt time.Time
+}
+
+type SellerReviewRepoInterface interface {
+	ReviewSeller(ctx context.Context, review SellerReview) (*SellerReview, error)
+	SellerRate(ctx context.Context, sellerID int) (float64, error)
+	SellerReviews(ctx context.Context, sellerID int, first int, after string) ([]*SellerReview, error)
+}
+
+// SellerReviewRepo stores one review per user and seller, a later order updates it,
+// so a buyer with many orders counts once. The ratingsum/ratingcount of the seller
+// document are kept up to date the way RateRepo does for items
+type SellerReviewRepo struct {
+	StMongoDB *mongo.Collection
+	SellersSt *mongo.Collection
+	MinRate   int
+	MaxRate   int
+}
+
+func (SR *SellerReviewRepo) ReviewSeller(ctx context.Context, review SellerReview) (*SellerReview, error) {
+	if review.Rate < SR.MinRate || review.Rate > SR.MaxRate {
+		return nil, fmt.Errorf("rate must be between %d and %d", SR.MinRate, SR.MaxRate)
+	}
+	filter := bson.M{
+		"userid":   review.UserID,
+		"sellerid": review.SellerID,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"orderid": review.OrderID,
+			"rate":    review.Rate,
+			"text":    review.Text,
+		},
+		"$setOnInsert": bson.M{
+			"createdat": time.Now().UTC(),
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
+
+	var previous SellerReview
+	sumDelta, countDelta := review.Rate, 1
+	err := SR.StMongoDB.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+	if err == nil {
+		sumDelta, countDelta = review.Rate-previous.Rate, 0
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err := SR.applyAggregates(ctx, review.SellerID, sumDelta, countDelta); err != nil {
+		return nil, err
+	}
+
+	var saved *SellerReview
+	if err := SR.StMongoDB.FindOne(ctx, filter).Decode(&saved); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (SR *SellerReviewRepo) applyAggregates(ctx context.Context, sellerID, sumDelta, countDelta int) error {
+	_, err := SR.SellersSt.UpdateOne(ctx,
+		bson.M{"id": sellerID},
+		bson.M{"$inc": bson.M{"ratingsum": sumDelta, "ratingcount": countDelta}},
+	)
+	return err
+}
+
+// SellerRate is the average rate of the seller read from its aggregates
+func (SR *SellerReviewRepo) SellerRate(ctx context.Context, sellerID int) (float64, error) {
+	var aggregates struct {
+		RatingSum   int
+		RatingCount int
+	}
+	err := SR.SellersSt.FindOne(ctx,
+		bson.M{"id": sellerID},
+		options.FindOne().SetProjection(bson.M{"ratingsum": 1, "ratingcount": 1}),
+	).Decode(&aggregates)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if aggregates.RatingCount == 0 {
+		return 0, nil
+	}
+	return float64(aggregates.RatingSum) / float64(aggregates.RatingCount), nil
+}
+
+// BackfillSellerAggregates recomputes ratingsum and ratingcount of every seller from the reviews
+func (SR *SellerReviewRepo) BackfillSellerAggregates(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$sellerid"},
+				{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$rate"}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}},
+		},
+	}
+	cur, err := SR.StMongoDB.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var reviewed []int
+	for cur.Next(ctx) {
+		var result struct {
+			SellerID int `bson:"_id"`
+			Sum      int `bson:"sum"`
+			Count    int `bson:"count"`
+		}
+		if err := cur.Decode(&result); err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"ratingsum": result.Sum, "ratingcount": result.Count}}
+		if _, err := SR.SellersSt.UpdateOne(ctx, bson.M{"id": result.SellerID}, update); err != nil {
+			return err
+		}
+		reviewed = append(reviewed, result.SellerID)
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	_, err = SR.SellersSt.UpdateMany(ctx,
+		bson.M{"id": bson.M{"$nin": reviewed}},
+		bson.M{"$set": bson.M{"ratingsum": 0, "ratingcount": 0}},
+	)
+	return err
+}
+
+// EnsureIndexes keeps one review per user and seller
+func (SR *SellerReviewRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := SR.StMongoDB.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userid", Value: 1}, {Key: "sellerid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// SellerReviews returns reviews newest first, after is the id of the last review of the previous page
+func (SR *SellerReviewRepo) SellerReviews(ctx context.Context, sellerID int, first int, after string) ([]*SellerReview, error) {
+	filter := bson.M{
+		"sellerid": sellerID,
+	}
+	if after != "" {
+		afterID, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return nil, fmt.Errorf("bad cursor")
+		}
+		filter["_id"] = bson.M{"$lt": afterID}
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetLimit(int64(first))
+
+	cur, err := SR.StMongoDB.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var reviews []*SellerReview
+	if err := cur.All(ctx, &reviews); err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+func CreateSellerReviewRepo(st, sellersSt *mongo.Collection) *SellerReviewRepo {
+	return &SellerReviewRepo{
+		StMongoDB: st,
+		SellersSt: sellersSt,
+		MinRate:   rate.DefaultMinRate,
+		MaxRate:   rate.DefaultMaxRate,
+	}
+}
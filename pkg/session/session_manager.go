@@ -94,12 +94,17 @@ func NewSessionsDB(db *sql.DB) *SessionsDB {
 }
 
 func (sm *SessionsDB) Check(r *http.Request) (*Session, error) {
-	sessionId := r.Header.Get("Authorization")
-	if len(sessionId) < 6 {
+	return sm.CheckToken(r.Header.Get("Authorization"))
+}
+
+// CheckToken validates an "Authorization" value ("Token <session id>") given outside of a request header
+func (sm *SessionsDB) CheckToken(sessionId string) (*Session, error) {
+	parts := strings.Fields(sessionId)
+	if len(sessionId) < 6 || len(parts) < 2 {
 		return nil, ErrNoAuth
 	}
 	sess := &Session{}
-	row := sm.DB.QueryRow(`SELECT user_id FROM sessions WHERE id = $1`, strings.Split(sessionId, " ")[1])
+	row := sm.DB.QueryRow(`SELECT user_id FROM sessions WHERE id = $1`, parts[1])
 	err := row.Scan(&sess.UserID)
 	if err == sql.ErrNoRows {
 		log.Println("CheckSession no rows")
@@ -1,17 +1,37 @@
 package user
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hw11_shopql/pkg/guest"
 	"hw11_shopql/pkg/session"
+	"log"
 	"net/http"
 )
 
 type Resp map[string]map[string]string
 
+type CartRepoInterface interface {
+	MergeGuestCart(ctx context.Context, GuestID string, UserID int) error
+}
+
 type UserHandler struct {
 	St UserRepoInterface
 	SM session.SessionManagerInterface
+	// Carts takes over the guest cart on login and registration, may be nil
+	Carts CartRepoInterface
+}
+
+// mergeGuestCart doesn't fail the login, the guest cart just stays where it was
+func (uh *UserHandler) mergeGuestCart(r *http.Request, UserID uint32) {
+	guestID, ok := guest.IdFromContext(r.Context())
+	if !ok || uh.Carts == nil {
+		return
+	}
+	if err := uh.Carts.MergeGuestCart(r.Context(), guestID, int(UserID)); err != nil {
+		log.Println("failed to merge guest cart:", err)
+	}
 }
 
 func (uh *UserHandler) Log(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +52,7 @@ func (uh *UserHandler) Log(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		User.ID = id
+		uh.mergeGuestCart(r, id)
 		sess, _ := uh.SM.Create(w, User)
 		res, _ := json.Marshal(Resp{"body": map[string]string{"token": sess.ID}})
 		w.Write(res)
@@ -57,6 +78,7 @@ func (uh *UserHandler) Reg(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		User.ID = id
+		uh.mergeGuestCart(r, id)
 		sess, _ := uh.SM.Create(w, User)
 		res, _ := json.Marshal(Resp{"body": map[string]string{"token": sess.ID}})
 		w.Write(res)
@@ -0,0 +1,38 @@
+package ownerutils
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/graph/model"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+type ItemRepoInterface interface {
+	GetItemByID(ctx context.Context, id int) (*model.Item, error)
+}
+
+// SellerIDFromArgs finds out which seller the current field works with,
+// either from the seller id in the input or from the seller of the item
+func SellerIDFromArgs(ctx context.Context, itemRepo ItemRepoInterface) (int, error) {
+	args := graphql.GetFieldContext(ctx).Args
+	itemID, ok := args["itemID"].(int)
+	for _, arg := range args {
+		switch in := arg.(type) {
+		case model.ItemInput:
+			return in.SellerID, nil
+		case model.ItemUpdateInput:
+			itemID, ok = in.ItemID, true
+		case model.ShipmentInput:
+			return in.SellerID, nil
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("failed to fetch seller")
+	}
+	item, err := itemRepo.GetItemByID(ctx, itemID)
+	if err != nil {
+		return 0, err
+	}
+	return item.SellerID, nil
+}
@@ -20,3 +20,16 @@ func HasRole(db *sql.DB, UserID int, role string) bool {
 	}
 	return true
 }
+
+// OwnsSeller reports whether the user is linked to the seller, a failed query is an error, not a refusal
+func OwnsSeller(db *sql.DB, UserID int, SellerID int) (bool, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM seller_user WHERE user_id = $1 and seller_id = $2", UserID, SellerID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check seller of user: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,30 @@
+package sessionutils
+
+import (
+	"context"
+	"fmt"
+	"hw11_shopql/pkg/session"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+)
+
+type TokenCheckerInterface interface {
+	CheckToken(token string) (*session.Session, error)
+}
+
+// WebsocketInit authenticates a websocket connection by the Authorization value
+// of its init payload, the same "Token <id>" the HTTP header carries.
+// A connection without it stays anonymous
+func WebsocketInit(sm TokenCheckerInterface) transport.WebsocketInitFunc {
+	return func(ctx context.Context, initPayload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+		token := initPayload.Authorization()
+		if token == "" {
+			return ctx, nil, nil
+		}
+		sess, err := sm.CheckToken(token)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("User not authorized")
+		}
+		return context.WithValue(ctx, "tokens", sess), nil, nil
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"hw11_shopql/pkg/cart"
+	"hw11_shopql/pkg/notify"
+	"hw11_shopql/pkg/outbox"
+	"hw11_shopql/pkg/payment"
 	"hw11_shopql/pkg/utils/dbutils"
 	"io/ioutil"
 	"log"
@@ -14,11 +18,15 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/mcuadros/go-lookup"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/d4l3k/messagediff.v1"
@@ -40,6 +48,7 @@ type ApiTestCase struct {
 	GQLVars        CR
 	URL            string
 	TokenName      string
+	Header         map[string]string
 	ResponseStatus int
 	ResponsePath   string
 	Expected       interface{}
@@ -76,11 +85,97 @@ func TestApp(t *testing.T) {
 	tplParams := map[string]string{
 		"EMAIL":    username + "@example.com",
 		"PASSWORD": password,
+		// idempotency keys outlive a test run, so every run takes its own
+		"idemKey":  fmt.Sprintf("key-%d", rand.Int63()),
 		"USERNAME": username,
 	}
 
 	replaceRe := regexp.MustCompile("{{(.*?)}}")
 	replaceBrackets := strings.NewReplacer("{", "", "}", "")
+	// storePayment keeps the payment the webhooks are sent for
+	storePayment := func(resp interface{}) error {
+		id, err := lookup.LookupString(resp, "data.StartPayment.paymentID")
+		if err != nil {
+			return err
+		}
+		provider, err := lookup.LookupString(resp, "data.StartPayment.provider")
+		if err != nil {
+			return err
+		}
+		if provider.String() != "fake" {
+			return fmt.Errorf("expected fake provider, got %s", provider.String())
+		}
+		tplParams["paymentID"] = id.String()
+		return nil
+	}
+	// signWebhook prepares a webhook of the fake provider about the stored payment
+	signWebhook := func(eventID, status string) func() {
+		return func() {
+			body := fmt.Sprintf(`{"id": %q, "paymentID": %q, "status": %q}`, eventID, tplParams["paymentID"], status)
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			tplParams["webhookBody"] = body
+			tplParams["webhookTimestamp"] = timestamp
+			tplParams["webhookSignature"] = payment.Sign([]byte(paymentSecret), timestamp, []byte(body))
+		}
+	}
+	// orderUpdates is the websocket the owner of the paid order follows it on
+	var (
+		orderUpdates    *websocket.Conn
+		orderUpdatesErr error
+	)
+	// nextOrderStatus reads the status of the next order the subscription sends
+	nextOrderStatus := func() (string, error) {
+		for {
+			var msg struct {
+				Type    string          `json:"type"`
+				Payload json.RawMessage `json:"payload"`
+			}
+			if err := orderUpdates.ReadJSON(&msg); err != nil {
+				return "", err
+			}
+			switch msg.Type {
+			case "connection_ack", "ping", "pong":
+				continue
+			case "next":
+				var payload struct {
+					Data struct {
+						OrderUpdated struct {
+							Status string `json:"status"`
+						} `json:"orderUpdated"`
+					} `json:"data"`
+					Errors []interface{} `json:"errors"`
+				}
+				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+					return "", err
+				}
+				if len(payload.Errors) > 0 {
+					return "", fmt.Errorf("subscription errors: %s", msg.Payload)
+				}
+				return payload.Data.OrderUpdated.Status, nil
+			default:
+				return "", fmt.Errorf("unexpected %s message: %s", msg.Type, msg.Payload)
+			}
+		}
+	}
+	// subscribeOrder authenticates in the init payload and subscribes to the paid order,
+	// its current status comes first
+	subscribeOrder := func() {
+		dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+		orderUpdates, _, orderUpdatesErr = dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+gqlURL, nil)
+		if orderUpdatesErr != nil {
+			return
+		}
+		orderUpdates.SetReadDeadline(time.Now().Add(10 * time.Second))
+		orderUpdates.WriteJSON(CR{"type": "connection_init", "payload": CR{"Authorization": "Token " + tplParams["token1"]}})
+		orderUpdates.WriteJSON(CR{"id": "1", "type": "subscribe", "payload": CR{
+			"query": fmt.Sprintf("subscription { orderUpdated(orderID: %s) { status } }", tplParams["payOrderID"]),
+		}})
+		status, err := nextOrderStatus()
+		if err == nil && status != "paid" {
+			err = fmt.Errorf("expected paid order first, got %s", status)
+		}
+		orderUpdatesErr = err
+	}
 	replacer := func(key []byte) []byte {
 		k := replaceBrackets.Replace(string(key))
 		val, ok := tplParams[k]
@@ -490,6 +585,63 @@ func TestApp(t *testing.T) {
 			`,
 		},
 		// ----------------------------------------------------------------------------------------
+		&ApiTestCase{
+			Name: "Sellers list with name filter",
+			GQL: `
+			{
+				Sellers(filter: {name: "издательство"}, limit: 5) {
+					id
+					name
+					deactivated
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{
+				"data": {
+					"Sellers": [
+						{"id": 3, "name": "Издательство Питер", "deactivated": false},
+						{"id": 4, "name": "Издательство Вильямс", "deactivated": false},
+						{"id": 5, "name": "Издательство ДМК Пресс", "deactivated": false}
+					]
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller with deals and statistics",
+			GQL: `
+			{
+				Seller(ID: "2") {
+					id
+					deals
+					item_ids
+					stats {
+						itemCount
+						unitsInStock
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{
+				"data": {
+					"Seller": {
+						"id": 2,
+						"deals": 2,
+						"item_ids": [9, 10, 11, 12],
+						"stats": {
+							"itemCount": 4,
+							"unitsInStock": 11
+						}
+					}
+				}
+			}
+			`,
+		},
+		// ----------------------------------------------------------------------------------------
 		&ApiTestCase{
 			Name: "Catalog - how many in cart - ERROR(no access) - directive @authorized",
 			GQL: `
@@ -929,6 +1081,97 @@ func TestApp(t *testing.T) {
 			}
 			`,
 		},
+		&ApiTestCase{
+			Name: "Item's rate out of scale",
+			GQL: `
+			mutation {
+				RateItem(in: {itemID: 1, rate: 1000}) {
+					id
+					rate
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{
+					"message": "rate must be between 1 and 5",
+					"path": ["RateItem"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Item's rating distribution",
+			GQL: `
+			{
+				Catalog(ID: "3") {
+					items(limit: 1) {
+						id
+						ratingCount
+						myRating
+						ratingDistribution {
+							rate
+							count
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": {
+					"Catalog": {
+						"items": [{
+							"id": 1,
+							"ratingCount": 2,
+							"myRating": 3,
+							"ratingDistribution": [
+								{"rate": 1, "count": 1},
+								{"rate": 2, "count": 0},
+								{"rate": 3, "count": 1},
+								{"rate": 4, "count": 0},
+								{"rate": 5, "count": 0}
+							]
+						}]
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Catalog items sorted by bayesian rating",
+			GQL: `
+			{
+				Catalog(ID: "3") {
+					items(limit: 5, sort: topRated) {
+						id
+						ratingSum
+						ratingCount
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{
+				"data": {
+					"Catalog": {
+						"items": [
+							{"id": 2, "ratingSum": 0, "ratingCount": 0},
+							{"id": 3, "ratingSum": 0, "ratingCount": 0},
+							{"id": 4, "ratingSum": 0, "ratingCount": 0},
+							{"id": 1, "ratingSum": 4, "ratingCount": 2}
+						]
+					}
+				}
+			}
+			`,
+		},
 		//---------------------------------------------------------------------
 		&ApiTestCase{
 			Name: "Comment to item",
@@ -1045,15 +1288,14 @@ func TestApp(t *testing.T) {
 			}
 			`,
 		},
-		//-----------------------------------------------------------------------------
 		&ApiTestCase{
-			Name: "Add catalog by admin",
+			Name: "Restock item by admin",
 			GQL: `
 			mutation {
-				AddCatalog(in: {catalogID: 6, name: "Verden"}) 
+				RestockItem(itemID: 14, quantity: 3)
 				{
 					id,
-					name,
+					in_stock
 				}
 			}
 			`,
@@ -1061,23 +1303,24 @@ func TestApp(t *testing.T) {
 			TokenName: "AdminToken",
 			ExpectedRaw: `
 			{
-				"data":{
-					"AddCatalog":{
-						"id":6,
-						"name":"Verden"
+				"data": {
+				  "RestockItem":
+					{
+						"id": 14,
+						"in_stock": 15
 					}
 				}
 			}
 			`,
 		},
 		&ApiTestCase{
-			Name: "Check new catalog",
+			Name: "Set item price by admin",
 			GQL: `
-			query {
-				Catalog(ID: "6")
+			mutation {
+				UpdateItem(in: {itemID: 12, price: 250})
 				{
 					id,
-					name,
+					price
 				}
 			}
 			`,
@@ -1085,143 +1328,2892 @@ func TestApp(t *testing.T) {
 			TokenName: "AdminToken",
 			ExpectedRaw: `
 			{
-				"data":{
-					"Catalog":
+				"data": {
+				  "UpdateItem":
 					{
-						"id":6,
-						"name":"Verden"
+						"id": 12,
+						"price": 250
 					}
 				}
 			}
 			`,
 		},
-		// ----------------------------------------------------------------------------------------
-		&ApiTestCase{
-			Name: "Add to cart - second item",
-			GQL: `
-					mutation {
-						AddToCart(in: {itemID: 5, quantity: 1}) {
-						  item {
-							id
-							name
-							inStockText
-						  }
-						  quantity
-						}
-					}
-					`,
-			URL:       gqlURL,
-			TokenName: "token1",
-			ExpectedRaw: `
-					{
-						"data": {
-						  "AddToCart": [
-							{
-							  "item": {
-								"id": 12,
-								"name": "Да Хун Пао",
-								"inStockText": "мало"
-							  },
-							  "quantity": 4
-							},
-							{
-								"item": {
-								  "id": 5,
-								  "name": "Язык программирования Go | Донован Алан А. А., Керниган Брайан У.",
-								  "inStockText": "мало"
-								},
-								"quantity": 1
-							}
-						  ]
-						}
-					}
-					`,
-		},
 		&ApiTestCase{
-			Name: "Create an order",
+			Name: "Restock item by user without seller",
 			GQL: `
 			mutation {
-				CreateAnOrder(in: "1")
+				RestockItem(itemID: 14, quantity: 3)
 				{
-					orderID,
-					items{
-						quantity,
-						item{
-							id,
-							name,
-							in_stock
-						}
-					},
-					status
+					id
 				}
 			}
 			`,
 			URL:       gqlURL,
 			TokenName: "token1",
 			ExpectedRaw: `
-			{"data":
-				{"CreateAnOrder":
-					{"orderID":1,
-					"items":[
-					{"quantity":4,"item":{"id":12,"name":"Да Хун Пао", "in_stock": 5}},
-					{"item": {"id":5, "in_stock":1, "name":"Язык программирования Go | Донован Алан А. А., Керниган Брайан У."}, "quantity":1}
-					],
-					"status":"Order created"
-					}
-				}
+			{
+				"data": null,
+				"errors": [{
+					"message": "Forbiden",
+					"path": ["RestockItem"]
+				}]
 			}
 			`,
 		},
 		&ApiTestCase{
-			Name: "Check user orders",
+			Name:           "Register seller user",
+			URL:            "/register",
+			Method:         http.MethodPost,
+			BodyRaw:        "{\"user\":{\"email\":\"{{EMAIL}}\", \"password\":\"{{PASSWORD}}\", \"username\":\"{{USERNAME}}\"}}",
+			ResponseStatus: 200,
+			CheckFunc: func(resp interface{}) error {
+				val, err := lookup.LookupString(resp, "body.token")
+				if err != nil {
+					return err
+				}
+				tplParams["sellerToken"] = val.String()
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Comment to item by seller user",
 			GQL: `
-			query {
-				MyOrders{
-					orderID,
-					items{
-						quantity,
-						item{
-							name
-						}
-					}
+			mutation {
+				AddCommentToItem(in: {itemID: 9, commentText: "хороший пуэр"}) {
+					userID
 				}
 			}
 			`,
 			URL:       gqlURL,
-			TokenName: "token1",
-			ExpectedRaw: `
-			{"data": {
-				"MyOrders":[
-						{
-							"orderID":1,
-							"items":
-							[{"quantity":4,"item":{"name":"Да Хун Пао"}},
-							{"quantity":1,"item":{"name":"Язык программирования Go | Донован Алан А. А., Керниган Брайан У."}}]
-
-						}
-					]
+			TokenName: "sellerToken",
+			CheckFunc: func(resp interface{}) error {
+				id, err := lookup.LookupString(resp, "data.AddCommentToItem.userID")
+				if err != nil {
+					return err
 				}
-			}
-			`,
+				tplParams["sellerUserID"] = strconv.Itoa(int(id.Float()))
+				return nil
+			},
 		},
 		&ApiTestCase{
-			Name: "Check users orders by not admin",
+			Name: "Link user to seller by admin",
 			GQL: `
-			query {
-				UserOrders(ID: 1){
-					orderID,
+			mutation {
+				AddSellerForUser(in: {userID: {{sellerUserID}}, sellerID: 5}) {
+					sellerID
 				}
 			}
 			`,
 			URL:       gqlURL,
-			TokenName: "token1",
+			TokenName: "AdminToken",
 			ExpectedRaw: `
-			{
-				"errors":[{"message":"Forbiden","path":["UserOrders"]}],
+			{"data": {"AddSellerForUser": {"sellerID": 5}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Restock own item by seller",
+			GQL: `
+			mutation {
+				RestockItem(itemID: 7, quantity: 2) {
+					id,
+					in_stock
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"RestockItem": {"id": 7, "in_stock": 5}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Restock another seller's item by seller",
+			GQL: `
+			mutation {
+				RestockItem(itemID: 12, quantity: 2) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "Forbiden", "path": ["RestockItem"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add item for another seller by seller",
+			GQL: `
+			mutation {
+				AddItem(in: {itemID: 16, catalogID: 4, name: "Go для всех", sellerID: 4, inStock: 1}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "Forbiden", "path": ["AddItem"]}]
+			}
+			`,
+		},
+		//-----------------------------------------------------------------------------
+		&ApiTestCase{
+			Name: "Add catalog by admin",
+			GQL: `
+			mutation {
+				AddCatalog(in: {catalogID: 6, name: "Verden"}) 
+				{
+					id,
+					name,
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data":{
+					"AddCatalog":{
+						"id":6,
+						"name":"Verden"
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Check new catalog",
+			GQL: `
+			query {
+				Catalog(ID: "6")
+				{
+					id,
+					name,
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data":{
+					"Catalog":
+					{
+						"id":6,
+						"name":"Verden"
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add seller by admin",
+			GQL: `
+			mutation {
+				AddSeller(in: {sellerID: 6, name: "Чайная лавка"}) {
+					id,
+					name,
+					deactivated
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"AddSeller": {"id": 6, "name": "Чайная лавка", "deactivated": false}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add seller twice",
+			GQL: `
+			mutation {
+				AddSeller(in: {sellerID: 6, name: "Чайная лавка"}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "seller already exist", "path": ["AddSeller"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add seller by user",
+			GQL: `
+			mutation {
+				AddSeller(in: {sellerID: 7, name: "Лавка"}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "Forbiden", "path": ["AddSeller"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Update seller by admin",
+			GQL: `
+			mutation {
+				UpdateSeller(in: {sellerID: 6, name: "Чайная лавка на Тверской"}) {
+					id,
+					name
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateSeller": {"id": 6, "name": "Чайная лавка на Тверской"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Update unknown seller",
+			GQL: `
+			mutation {
+				UpdateSeller(in: {sellerID: 100, name: "Нет такого"}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "seller not exist", "path": ["UpdateSeller"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add item of new seller",
+			GQL: `
+			mutation {
+				AddItem(in: {itemID: 15, catalogID: 6, name: "Шу Пуэр", sellerID: 6, inStock: 10}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"AddItem": {"id": 15}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Catalog with new seller's item",
+			GQL: `
+			query {
+				Catalog(ID: "6") {
+					items {
+						id,
+						seller {
+							name
+						}
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{"data": {"Catalog": {"items": [{"id": 15, "seller": {"name": "Чайная лавка на Тверской"}}]}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Deactivate seller by admin",
+			GQL: `
+			mutation {
+				DeactivateSeller(ID: 6) {
+					id,
+					deactivated
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"DeactivateSeller": {"id": 6, "deactivated": true}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Deactivated seller's items hidden from catalog",
+			GQL: `
+			query {
+				Catalog(ID: "6") {
+					items {
+						id
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{"data": {"Catalog": {"items": []}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Deactivated sellers list",
+			GQL: `
+			query {
+				Sellers(filter: {deactivated: true}) {
+					id,
+					name
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{"data": {"Sellers": [{"id": 6, "name": "Чайная лавка на Тверской"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Strict review policy for books by admin",
+			GQL: `
+			mutation {
+				SetCatalogReviewPolicy(catalogID: 2, policy: strict) {
+					id,
+					reviewPolicy
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data":{
+					"SetCatalogReviewPolicy":{
+						"id":2,
+						"reviewPolicy":"strict"
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Comment to book without purchase",
+			GQL: `
+			mutation {
+				AddCommentToItem(in: {itemID: 1, commentText: "not bought"}) {
+					commentText
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": {
+					"AddCommentToItem": null
+				},
+				"errors": [{
+					"message": "only verified buyers can review this item",
+					"path": ["AddCommentToItem"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Reply to book comment without purchase",
+			GQL: `
+			mutation {
+				AddCommentToComment(in: {commentID: "68a0eb6d88885af37eb5c165", commentText: "not bought"}) {
+					commentText
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": {
+					"AddCommentToComment": null
+				},
+				"errors": [{
+					"message": "only verified buyers can review this item",
+					"path": ["AddCommentToComment"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Open review policy for books by admin",
+			GQL: `
+			mutation {
+				SetCatalogReviewPolicy(catalogID: 2, policy: open) {
+					id,
+					reviewPolicy
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data":{
+					"SetCatalogReviewPolicy":{
+						"id":2,
+						"reviewPolicy":"open"
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Rating dimensions for tea by admin",
+			GQL: `
+			mutation {
+				SetCatalogRatingDimensions(catalogID: 5, dimensions: ["aroma", "taste", "aftertaste"]) {
+					id,
+					ratingDimensions
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data":{
+					"SetCatalogRatingDimensions":{
+						"id":5,
+						"ratingDimensions":["aroma", "taste", "aftertaste"]
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Item's rate with dimensions",
+			GQL: `
+			mutation {
+				RateItem(in: {itemID: 9, rate: 5, dimensions: [{name: "aroma", rate: 4}, {name: "taste", rate: 5}]}) {
+					id
+					rate
+					dimensionRates {
+						name
+						rate
+						count
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": {
+					"RateItem": {
+						"id": 9,
+						"rate": 5,
+						"dimensionRates": [
+							{"name": "aroma", "rate": 4, "count": 1},
+							{"name": "taste", "rate": 5, "count": 1}
+						]
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Item's rate with unknown dimension",
+			GQL: `
+			mutation {
+				RateItem(in: {itemID: 9, rate: 5, dimensions: [{name: "translation", rate: 4}]}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{
+					"message": "unknown rating dimension \"translation\"",
+					"path": ["RateItem"]
+				}]
+			}
+			`,
+		},
+		// ----------------------------------------------------------------------------------------
+		&ApiTestCase{
+			Name: "Add to cart - second item",
+			GQL: `
+					mutation {
+						AddToCart(in: {itemID: 5, quantity: 1}) {
+						  item {
+							id
+							name
+							inStockText
+						  }
+						  quantity
+						}
+					}
+					`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+					{
+						"data": {
+						  "AddToCart": [
+							{
+							  "item": {
+								"id": 12,
+								"name": "Да Хун Пао",
+								"inStockText": "мало"
+							  },
+							  "quantity": 4
+							},
+							{
+								"item": {
+								  "id": 5,
+								  "name": "Язык программирования Go | Донован Алан А. А., Керниган Брайан У.",
+								  "inStockText": "мало"
+								},
+								"quantity": 1
+							}
+						  ]
+						}
+					}
+					`,
+		},
+		&ApiTestCase{
+			Name: "Preview order",
+			GQL: `
+			query {
+				PreviewOrder {
+					quantity,
+					total,
+					lines {
+						itemID,
+						status,
+						requested,
+						available,
+						cartPrice,
+						price,
+						total
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"PreviewOrder": {
+				"quantity": 5,
+				"total": 1000,
+				"lines": [
+					{"itemID": 5, "status": "ok", "requested": 1, "available": 1, "cartPrice": 0, "price": 0, "total": 0},
+					{"itemID": 12, "status": "priceChanged", "requested": 4, "available": 4, "cartPrice": 0, "price": 250, "total": 1000}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order with stale preview",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Иван Петров", phone: "+7 900 000-00-00", deliveryMethod: pickup, fingerprint: "stale"}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cart changed since preview", "path": ["CreateAnOrder"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {
+					address: {city: "Москва", street: "Тверская", house: "1"},
+					recipient: "Иван Петров",
+					phone: "+7 900 000-00-00",
+					deliveryMethod: courier
+				})
+				{
+					orderID,
+					items{
+						quantity,
+						item{
+							id,
+							name,
+							in_stock
+						}
+					},
+					status,
+					delivery{
+						method,
+						recipient,
+						address{
+							city,
+							house
+						}
+					},
+					shipments{
+						sellerID,
+						status,
+						items{
+							quantity,
+							item{
+								id
+							}
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data":
+				{"CreateAnOrder":
+					{"orderID":1,
+					"items":[
+					{"quantity":4,"item":{"id":12,"name":"Да Хун Пао", "in_stock": 5}},
+					{"item": {"id":5, "in_stock":1, "name":"Язык программирования Go | Донован Алан А. А., Керниган Брайан У."}, "quantity":1}
+					],
+					"status":"created",
+					"delivery":{"method":"courier","recipient":"Иван Петров","address":{"city":"Москва","house":"1"}},
+					"shipments":[
+					{"sellerID":2,"status":"created","items":[{"quantity":4,"item":{"id":12}}]},
+					{"sellerID":4,"status":"created","items":[{"quantity":1,"item":{"id":5}}]}
+					]
+					}
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cart is empty after order",
+			GQL: `
+			query {
+				MyCart {
+					quantity
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyCart": []}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order from empty cart",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Иван Петров", phone: "+7 900 000-00-00", deliveryMethod: pickup}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cart is empty", "path": ["CreateAnOrder"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order without address",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Иван Петров", phone: "+7 900 000-00-00", deliveryMethod: post}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "address is required for post delivery", "path": ["CreateAnOrder"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add address to address book",
+			GQL: `
+			mutation {
+				AddAddress(in: {city: "Москва", street: "Тверская", house: "1", apartment: "5"}) {
+					city,
+					apartment
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"AddAddress": {"city": "Москва", "apartment": "5"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "My addresses",
+			GQL: `
+			query {
+				MyAddresses {
+					street,
+					house
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyAddresses": [{"street": "Тверская", "house": "1"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add address with idempotency key",
+			GQL: `
+			mutation {
+				AddAddress(in: {city: "Казань", street: "Баумана", house: "2"}) {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			Header:    map[string]string{"Idempotency-Key": "{{idemKey}}"},
+			ExpectedRaw: `
+			{"data": {"AddAddress": {"city": "Казань"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Retry with the same idempotency key",
+			GQL: `
+			mutation {
+				AddAddress(in: {city: "Казань", street: "Баумана", house: "2"}) {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			Header:    map[string]string{"Idempotency-Key": "{{idemKey}}"},
+			ExpectedRaw: `
+			{"data": {"AddAddress": {"city": "Казань"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Idempotency key reused with another request",
+			GQL: `
+			mutation {
+				AddAddress(in: {city: "Самара", street: "Ленина", house: "3"}) {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			Header:    map[string]string{"Idempotency-Key": "{{idemKey}}"},
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "idempotency key was used with another request", "extensions": {"code": "CONFLICT"}}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add address with idempotent directive",
+			GQL: `
+			mutation @idempotent(key: "{{idemKey}}-directive") {
+				AddAddress(in: {city: "Самара", street: "Ленина", house: "3"}) {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"AddAddress": {"city": "Самара"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Retry with the idempotent directive",
+			GQL: `
+			mutation @idempotent(key: "{{idemKey}}-directive") {
+				AddAddress(in: {city: "Самара", street: "Ленина", house: "3"}) {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"AddAddress": {"city": "Самара"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Addresses after idempotent retries",
+			GQL: `
+			query {
+				MyAddresses {
+					city
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyAddresses": [{"city": "Москва"}, {"city": "Казань"}, {"city": "Самара"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Check user orders",
+			GQL: `
+			query {
+				MyOrders{
+					orderID,
+					items{
+						quantity,
+						item{
+							name
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {
+				"MyOrders":[
+						{
+							"orderID":1,
+							"items":
+							[{"quantity":4,"item":{"name":"Да Хун Пао"}},
+							{"quantity":1,"item":{"name":"Язык программирования Go | Донован Алан А. А., Керниган Брайан У."}}]
+
+						}
+					]
+				}
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order by number",
+			GQL: fmt.Sprintf(`
+			query {
+				Order(number: "SQ-%d-000001") {
+					orderID,
+					number
+				}
+			}
+			`, time.Now().UTC().Year()),
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: fmt.Sprintf(`
+			{"data": {"Order": {"orderID": 1, "number": "SQ-%d-000001"}}}
+			`, time.Now().UTC().Year()),
+		},
+		&ApiTestCase{
+			Name: "Order by number of another user",
+			GQL: fmt.Sprintf(`
+			query {
+				Order(number: "SQ-%d-000001") {
+					orderID
+				}
+			}
+			`, time.Now().UTC().Year()),
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "order not exist", "path": ["Order"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Review seller before delivery",
+			GQL: `
+			mutation {
+				ReviewSeller(in: {sellerID: 2, orderID: 1, rate: 5, text: "ships on time"}) {
+					rate
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{
+					"message": "seller can be reviewed only after a completed order",
+					"path": ["ReviewSeller"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Review seller not in order",
+			GQL: `
+			mutation {
+				ReviewSeller(in: {sellerID: 3, orderID: 1, rate: 5}) {
+					rate
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{
+					"message": "seller can be reviewed only after a completed order",
+					"path": ["ReviewSeller"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order paid by admin",
+			GQL: `
+			mutation {
+				UpdateOrderStatus(orderID: 1, status: paid, note: "bank transfer") {
+					status,
+					statusHistory {
+						status,
+						note
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateOrderStatus": {
+				"status": "paid",
+				"statusHistory": [
+					{"status": "created", "note": null},
+					{"status": "paid", "note": "bank transfer"}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order status transition not allowed",
+			GQL: `
+			mutation {
+				UpdateOrderStatus(orderID: 1, status: delivered) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change order status from paid to delivered", "path": ["UpdateOrderStatus"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cancel order by status update",
+			GQL: `
+			mutation {
+				UpdateOrderStatus(orderID: 1, status: cancelled) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "order status cancelled is set by cancelling the order", "path": ["UpdateOrderStatus"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cancel order by user",
+			GQL: `
+			mutation {
+				CancelOrder(orderID: 1, reason: "changed my mind") {
+					status,
+					statusHistory {
+						status,
+						note
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"CancelOrder": {
+				"status": "cancelled",
+				"statusHistory": [
+					{"status": "created", "note": null},
+					{"status": "paid", "note": "bank transfer"},
+					{"status": "cancelled", "note": "changed my mind"}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cancel order twice",
+			GQL: `
+			mutation {
+				CancelOrder(orderID: 1) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"CancelOrder": {"status": "cancelled"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Stock returned after cancel",
+			GQL: `
+			query {
+				Catalog(ID: "4") {
+					items(limit: 1) {
+						id,
+						in_stock
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{"data": {"Catalog": {"items": [{"id": 5, "in_stock": 1}]}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Strict review policy for books after cancel",
+			GQL: `
+			mutation {
+				SetCatalogReviewPolicy(catalogID: 2, policy: strict) {
+					reviewPolicy
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"SetCatalogReviewPolicy": {"reviewPolicy": "strict"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Comment to book from cancelled order",
+			GQL: `
+			mutation {
+				AddCommentToItem(in: {itemID: 5, commentText: "cancelled"}) {
+					commentText
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": {
+					"AddCommentToItem": null
+				},
+				"errors": [{
+					"message": "only verified buyers can review this item",
+					"path": ["AddCommentToItem"]
+				}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Open review policy for books after cancel",
+			GQL: `
+			mutation {
+				SetCatalogReviewPolicy(catalogID: 2, policy: open) {
+					reviewPolicy
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"SetCatalogReviewPolicy": {"reviewPolicy": "open"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Commission rate for tea by admin",
+			GQL: `
+			mutation {
+				SetCommissionRate(in: {catalogID: 5, rate: 0.2}) {
+					catalogID,
+					rate
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"SetCommissionRate": {"catalogID": 5, "rate": 0.2}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Deliver shipment of cancelled order",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: 1, sellerID: 2, status: "delivered"}) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change shipment of cancelled order", "path": ["UpdateShipment"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Set price of item to pay for by admin",
+			GQL: `
+			mutation {
+				UpdateItem(in: {itemID: 11, price: 400}) {
+					price
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateItem": {"price": 400}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add to cart before payment",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 11, quantity: 1}) {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"AddToCart": [{"quantity": 1, "item": {"id": 11}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order to pay",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Иван Петров", phone: "+7 900 000-00-00", deliveryMethod: pickup}) {
+					orderID,
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				id, err := lookup.LookupString(resp, "data.CreateAnOrder.orderID")
+				if err != nil {
+					return err
+				}
+				tplParams["payOrderID"] = strconv.Itoa(int(id.Float()))
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Start payment of another user's order",
+			GQL: `
+			mutation {
+				StartPayment(orderID: {{payOrderID}}) {
+					paymentID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "order not exist", "path": ["StartPayment"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Start payment",
+			GQL: `
+			mutation {
+				StartPayment(orderID: {{payOrderID}}) {
+					paymentID,
+					provider,
+					confirmationURL
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: storePayment,
+		},
+		&ApiTestCase{
+			Name: "Start payment again",
+			GQL: `
+			mutation {
+				StartPayment(orderID: {{payOrderID}}) {
+					paymentID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				id, err := lookup.LookupString(resp, "data.StartPayment.paymentID")
+				if err != nil {
+					return err
+				}
+				if id.String() != tplParams["paymentID"] {
+					return fmt.Errorf("expected pending payment %s, got %s", tplParams["paymentID"], id.String())
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name:           "Payment webhook with bad signature",
+			URL:            "/payments/webhook",
+			Method:         http.MethodPost,
+			Before:         signWebhook("evt-1", "failed"),
+			BodyRaw:        "{{webhookBody}}",
+			Header:         map[string]string{"X-Payment-Timestamp": "{{webhookTimestamp}}", "X-Payment-Signature": "bad"},
+			ResponseStatus: http.StatusUnauthorized,
+		},
+		&ApiTestCase{
+			Name:           "Payment failed webhook",
+			URL:            "/payments/webhook",
+			Method:         http.MethodPost,
+			Before:         signWebhook("evt-1", "failed"),
+			BodyRaw:        "{{webhookBody}}",
+			Header:         map[string]string{"X-Payment-Timestamp": "{{webhookTimestamp}}", "X-Payment-Signature": "{{webhookSignature}}"},
+			ResponseStatus: http.StatusOK,
+		},
+		&ApiTestCase{
+			Name: "Order after failed payment",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyOrders": [{"status": "cancelled"}, {"status": "payment_failed"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Retry payment",
+			GQL: `
+			mutation {
+				StartPayment(orderID: {{payOrderID}}) {
+					paymentID,
+					provider,
+					confirmationURL
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: storePayment,
+		},
+		&ApiTestCase{
+			Name:           "Payment succeeded webhook",
+			URL:            "/payments/webhook",
+			Method:         http.MethodPost,
+			Before:         signWebhook("evt-2", "succeeded"),
+			BodyRaw:        "{{webhookBody}}",
+			Header:         map[string]string{"X-Payment-Timestamp": "{{webhookTimestamp}}", "X-Payment-Signature": "{{webhookSignature}}"},
+			ResponseStatus: http.StatusOK,
+		},
+		&ApiTestCase{
+			Name:           "Replayed payment failed webhook",
+			URL:            "/payments/webhook",
+			Method:         http.MethodPost,
+			Before:         signWebhook("evt-1", "failed"),
+			BodyRaw:        "{{webhookBody}}",
+			Header:         map[string]string{"X-Payment-Timestamp": "{{webhookTimestamp}}", "X-Payment-Signature": "{{webhookSignature}}"},
+			ResponseStatus: http.StatusOK,
+		},
+		&ApiTestCase{
+			Name: "Order paid by webhook",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyOrders": [{"status": "cancelled"}, {"status": "paid"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Ship shipment by admin",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{payOrderID}}, sellerID: 2, status: "shipped", trackingNumber: "RA123456789RU"}) {
+					status,
+					trackingNumber
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateShipment": {"status": "shipped", "trackingNumber": "RA123456789RU"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Shipment status can't go back",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{payOrderID}}, sellerID: 2, status: "assembling"}) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change shipment status from shipped to assembling", "path": ["UpdateShipment"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Deliver shipment by admin",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{payOrderID}}, sellerID: 2, status: "delivered"}) {
+					sellerID,
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateShipment": {"sellerID": 2, "status": "delivered"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name:   "Paid order delivered by admin",
+			Before: subscribeOrder,
+			GQL: `
+			mutation {
+				assembling: UpdateOrderStatus(orderID: {{payOrderID}}, status: assembling) {
+					status
+				}
+				shipped: UpdateOrderStatus(orderID: {{payOrderID}}, status: shipped) {
+					status
+				}
+				delivered: UpdateOrderStatus(orderID: {{payOrderID}}, status: delivered) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"assembling": {"status": "assembling"},
+				"shipped": {"status": "shipped"},
+				"delivered": {"status": "delivered"}
+			}}
+			`,
+			After: func(resp *http.Response, body []byte, got interface{}) error {
+				if orderUpdatesErr != nil {
+					return orderUpdatesErr
+				}
+				defer orderUpdates.Close()
+				for _, want := range []string{"assembling", "shipped", "delivered"} {
+					status, err := nextOrderStatus()
+					if err != nil {
+						return err
+					}
+					if status != want {
+						return fmt.Errorf("expected %s update, got %s", want, status)
+					}
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Review seller after delivery",
+			GQL: `
+			mutation {
+				ReviewSeller(in: {sellerID: 2, orderID: {{payOrderID}}, rate: 5, text: "ships on time"}) {
+					sellerID,
+					rate,
+					text
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {
+				"ReviewSeller": {
+					"sellerID": 2,
+					"rate": 5,
+					"text": "ships on time"
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Review seller again",
+			GQL: `
+			mutation {
+				ReviewSeller(in: {sellerID: 2, orderID: {{payOrderID}}, rate: 3, text: "slower this time"}) {
+					rate
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"ReviewSeller": {"rate": 3}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller rating counts one review per buyer",
+			GQL: `
+			query {
+				Seller(ID: "2") {
+					rating,
+					reviews {
+						rate,
+						text
+					}
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{"data": {"Seller": {"rating": 3, "reviews": [{"rate": 3, "text": "slower this time"}]}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller balance after delivery",
+			GQL: `
+			query {
+				sellerBalance(sellerID: 2) {
+					gross,
+					commission,
+					net,
+					paidOut,
+					balance,
+					entries {
+						kind,
+						itemID,
+						quantity,
+						commissionRate
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"sellerBalance": {
+					"gross": 400,
+					"commission": 80,
+					"net": 320,
+					"paidOut": 0,
+					"balance": 320,
+					"entries": [
+						{"kind": "sale", "itemID": 11, "quantity": 1, "commissionRate": 0.2}
+					]
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create payout by admin",
+			GQL: `
+			mutation {
+				CreatePayout(sellerID: 2) {
+					kind,
+					sellerID,
+					net
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"CreatePayout": {"kind": "payout", "sellerID": 2, "net": -320}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create payout with nothing to pay",
+			GQL: `
+			mutation {
+				CreatePayout(sellerID: 2) {
+					net
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "nothing to pay out", "path": ["CreatePayout"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order events delivered from the outbox",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				if _, err := outboxDispatcher.RunOnce(context.Background()); err != nil {
+					return err
+				}
+				orderID := tplParams["payOrderID"]
+				if len(deliveredEvents.Find(outbox.OrderCreated, orderID)) != 1 {
+					return fmt.Errorf("expected one %s event of order %s", outbox.OrderCreated, orderID)
+				}
+				// changes made in one request may share a timestamp, so their order isn't checked
+				statuses := []string{}
+				for _, event := range deliveredEvents.Find(outbox.OrderStatusChanged, orderID) {
+					statuses = append(statuses, fmt.Sprint(event.Payload["status"]))
+				}
+				sort.Strings(statuses)
+				if strings.Join(statuses, ",") != "assembling,delivered,paid,payment_failed,shipped" {
+					return fmt.Errorf("unexpected status events of order %s: %v", orderID, statuses)
+				}
+				stockEvents := deliveredEvents.Find(outbox.StockChanged, "11")
+				if len(stockEvents) == 0 {
+					return fmt.Errorf("expected %s events of item 11", outbox.StockChanged)
+				}
+				for _, event := range stockEvents {
+					if _, ok := event.Payload["inStock"]; !ok {
+						return fmt.Errorf("%s event %s has no inStock", outbox.StockChanged, event.ID)
+					}
+					if _, ok := event.Payload["delta"]; !ok {
+						return fmt.Errorf("%s event %s has no delta", outbox.StockChanged, event.ID)
+					}
+				}
+				posted := false
+				for _, event := range deliveredEvents.Find(outbox.CommentPosted, "") {
+					if fmt.Sprint(event.Payload["userID"]) == tplParams["sellerUserID"] && fmt.Sprint(event.Payload["itemID"]) == "9" {
+						posted = true
+					}
+				}
+				if !posted {
+					return fmt.Errorf("expected %s event of the seller user's comment to item 9", outbox.CommentPosted)
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Outbox retries a failed delivery",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				ctx := context.Background()
+				event, err := putFlakyEvent(ctx)
+				if err != nil {
+					return err
+				}
+				flakySink.FailNext(flakyDispatcher.MaxAttempts - 1)
+				if _, err := flakyDispatcher.RunOnce(ctx); err != nil {
+					return err
+				}
+				var entry outbox.Entry
+				if err := flakyOutbox.St.FindOne(ctx, bson.M{"_id": event.ID}).Decode(&entry); err != nil {
+					return err
+				}
+				if entry.Status != outbox.StatusDelivered || entry.Attempts != flakyDispatcher.MaxAttempts-1 {
+					return fmt.Errorf("expected event delivered after %d failures, got %s after %d", flakyDispatcher.MaxAttempts-1, entry.Status, entry.Attempts)
+				}
+				if len(flakySink.Find(event.Type, event.AggregateID)) != 1 {
+					return fmt.Errorf("expected event %s delivered once", event.ID)
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Outbox dead letters an event out of attempts",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				ctx := context.Background()
+				event, err := putFlakyEvent(ctx)
+				if err != nil {
+					return err
+				}
+				flakySink.FailNext(flakyDispatcher.MaxAttempts)
+				if _, err := flakyDispatcher.RunOnce(ctx); err != nil {
+					return err
+				}
+				var entry outbox.Entry
+				if err := flakyOutbox.St.FindOne(ctx, bson.M{"_id": event.ID}).Decode(&entry); err != nil {
+					return err
+				}
+				if entry.Status != outbox.StatusDead || entry.Attempts != flakyDispatcher.MaxAttempts {
+					return fmt.Errorf("expected event dead after %d attempts, got %s after %d", flakyDispatcher.MaxAttempts, entry.Status, entry.Attempts)
+				}
+				if !strings.Contains(entry.LastError, "sink is down") {
+					return fmt.Errorf("unexpected last error %q", entry.LastError)
+				}
+				if len(flakySink.Find(event.Type, event.AggregateID)) != 0 {
+					return fmt.Errorf("dead event %s was delivered", event.ID)
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Open return of more than ordered",
+			GQL: `
+			mutation {
+				OpenReturn(in: {orderID: {{payOrderID}}, lines: [{itemID: 11, quantity: 2}], reason: "printing defect"}) {
+					id
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "item 11: can't return more than 1", "path": ["OpenReturn"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Open return",
+			GQL: `
+			mutation {
+				OpenReturn(in: {
+					orderID: {{payOrderID}},
+					lines: [{itemID: 11, quantity: 1}],
+					reason: "printing defect",
+					photos: ["https://example.com/defect.jpg"]
+				}) {
+					id,
+					status,
+					photos,
+					refundAmount
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			CheckFunc: func(resp interface{}) error {
+				status, err := lookup.LookupString(resp, "data.OpenReturn.status")
+				if err != nil {
+					return err
+				}
+				amount, err := lookup.LookupString(resp, "data.OpenReturn.refundAmount")
+				if err != nil {
+					return err
+				}
+				if status.String() != "requested" || amount.Float() != 400 {
+					return fmt.Errorf("expected requested return of 400, got %s of %v", status.String(), amount.Float())
+				}
+				id, err := lookup.LookupString(resp, "data.OpenReturn.id")
+				if err != nil {
+					return err
+				}
+				tplParams["returnID"] = id.String()
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Receive return before approval",
+			GQL: `
+			mutation {
+				ReceiveReturn(id: "{{returnID}}") {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change return status from requested to received", "path": ["ReceiveReturn"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Approve return by admin",
+			GQL: `
+			mutation {
+				ApproveReturn(id: "{{returnID}}", note: "send it back") {
+					status,
+					note
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"ApproveReturn": {"status": "approved", "note": "send it back"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Receive return and refund by admin",
+			GQL: `
+			mutation {
+				ReceiveReturn(id: "{{returnID}}") {
+					status,
+					refundID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			CheckFunc: func(resp interface{}) error {
+				status, err := lookup.LookupString(resp, "data.ReceiveReturn.status")
+				if err != nil {
+					return err
+				}
+				refundID, err := lookup.LookupString(resp, "data.ReceiveReturn.refundID")
+				if err != nil {
+					return err
+				}
+				if status.String() != "refunded" || !strings.HasPrefix(refundID.String(), "refund-") {
+					return fmt.Errorf("expected refunded return, got %s with refund %q", status.String(), refundID.String())
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Receive refunded return again",
+			GQL: `
+			mutation {
+				ReceiveReturn(id: "{{returnID}}") {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change return status from refunded to received", "path": ["ReceiveReturn"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order returned after refund",
+			GQL: `
+			query {
+				MyOrders {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{"data": {"MyOrders": [{"status": "cancelled"}, {"status": "returned"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller balance after refund",
+			GQL: `
+			query {
+				sellerBalance(sellerID: 2) {
+					gross,
+					commission,
+					net,
+					paidOut,
+					balance,
+					entries {
+						kind,
+						itemID,
+						quantity
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"sellerBalance": {
+					"gross": 0,
+					"commission": 0,
+					"net": 0,
+					"paidOut": 320,
+					"balance": -320,
+					"entries": [
+						{"kind": "sale", "itemID": 11, "quantity": 1},
+						{"kind": "payout", "itemID": null, "quantity": null},
+						{"kind": "reversal", "itemID": 11, "quantity": 1}
+					]
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Search orders by not admin",
+			GQL: `
+			query {
+				Orders {
+					totalCount
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"errors": [{"message": "Forbiden", "path": ["Orders"]}],
+				"data": null
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Search orders by item and status",
+			GQL: `
+			query {
+				Orders(filter: {itemID: 11, status: [returned]}) {
+					totalCount,
+					hasNextPage,
+					orders {
+						status,
+						total
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"Orders": {
+				"totalCount": 1,
+				"hasNextPage": false,
+				"orders": [{"status": "returned", "total": 400}]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Search orders first page by total",
+			GQL: `
+			query {
+				Orders(filter: {minTotal: 300}, sort: totalDesc, first: 1) {
+					totalCount,
+					hasNextPage,
+					endCursor,
+					orders {
+						total
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			CheckFunc: func(resp interface{}) error {
+				next, err := lookup.LookupString(resp, "data.Orders.hasNextPage")
+				if err != nil {
+					return err
+				}
+				total, err := lookup.LookupString(resp, "data.Orders.orders.total")
+				if err != nil {
+					return err
+				}
+				if !next.Bool() || total.Len() != 1 || total.Index(0).Float() != 1000 {
+					return fmt.Errorf("expected the 1000 order and a next page")
+				}
+				cursor, err := lookup.LookupString(resp, "data.Orders.endCursor")
+				if err != nil {
+					return err
+				}
+				tplParams["ordersCursor"] = cursor.String()
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Search orders next page by total",
+			GQL: `
+			query {
+				Orders(filter: {minTotal: 300}, sort: totalDesc, first: 1, after: "{{ordersCursor}}") {
+					totalCount,
+					hasNextPage,
+					orders {
+						total
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"Orders": {"totalCount": 2, "hasNextPage": false, "orders": [{"total": 400}]}}}
+			`,
+		},
+		&ApiTestCase{
+			Name:           "Export orders as CSV by not admin",
+			URL:            "/admin/orders.csv?status=returned",
+			TokenName:      "token1",
+			ResponseStatus: http.StatusForbidden,
+		},
+		&ApiTestCase{
+			Name:           "Export orders as CSV by admin",
+			URL:            "/admin/orders.csv?status=returned&sort=newest",
+			TokenName:      "AdminToken",
+			ResponseStatus: http.StatusOK,
+		},
+		&ApiTestCase{
+			Name: "Check users orders by not admin",
+			GQL: `
+			query {
+				UserOrders(ID: 1){
+					orderID,
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"errors":[{"message":"Forbiden","path":["UserOrders"]}],
 				"data":null
 			}
 			`,
 		},
+		&ApiTestCase{
+			Name: "Guest token for anonymous visitor",
+			GQL: `
+			query {
+				MyCart {
+					quantity
+				}
+			}
+			`,
+			URL: gqlURL,
+			ExpectedRaw: `
+			{
+				"errors": [{"message": "User not authorized", "path": ["MyCart"]}],
+				"data": null
+			}
+			`,
+			After: func(resp *http.Response, body []byte, got interface{}) error {
+				token := resp.Header.Get("X-Guest-Token")
+				if token == "" {
+					return fmt.Errorf("no guest token issued")
+				}
+				tplParams["guestToken"] = token
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Add to cart as guest",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 13, quantity: 3}) {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:    gqlURL,
+			Header: map[string]string{"X-Guest-Token": "{{guestToken}}"},
+			ExpectedRaw: `
+			{"data": {"AddToCart": [{"quantity": 3, "item": {"id": 13}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add to cart with forged guest token",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 13, quantity: 1}) {
+					quantity
+				}
+			}
+			`,
+			URL:    gqlURL,
+			Header: map[string]string{"X-Guest-Token": "forged.token"},
+			ExpectedRaw: `
+			{
+				"errors": [{"message": "User not authorized", "path": ["AddToCart"]}],
+				"data": null
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name:           "Register with guest cart",
+			URL:            "/register",
+			Method:         http.MethodPost,
+			Header:         map[string]string{"X-Guest-Token": "{{guestToken}}"},
+			BodyRaw:        "{\"user\":{\"email\":\"{{EMAIL}}\", \"password\":\"{{PASSWORD}}\", \"username\":\"{{USERNAME}}\"}}",
+			ResponseStatus: 200,
+			CheckFunc: func(resp interface{}) error {
+				val, err := lookup.LookupString(resp, "body.token")
+				if err != nil {
+					return err
+				}
+				tplParams["token3"] = val.String()
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "My cart after guest cart merge",
+			GQL: `
+			query {
+				MyCart {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"MyCart": [{"quantity": 3, "item": {"id": 13}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Set cart item quantity",
+			GQL: `
+			mutation {
+				SetCartItemQuantity(in: {itemID: 13, quantity: 2}) {
+					quantity,
+					lines {
+						quantity,
+						item {
+							id
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"SetCartItemQuantity": {"quantity": 2, "lines": [{"quantity": 2, "item": {"id": 13}}]}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Update cart in bulk",
+			GQL: `
+			mutation {
+				UpdateCart(in: [{itemID: 13, quantity: 4}, {itemID: 12, quantity: 1}]) {
+					quantity,
+					total
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"UpdateCart": {"quantity": 5, "total": 250}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Update cart in bulk with line over stock",
+			GQL: `
+			mutation {
+				UpdateCart(in: [{itemID: 13, quantity: 1}, {itemID: 9, quantity: 2}]) {
+					quantity
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "not enough quantity", "path": ["UpdateCart"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cart unchanged after rejected bulk update",
+			GQL: `
+			query {
+				MyCart {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"MyCart": [{"quantity": 4, "item": {"id": 13}}, {"quantity": 1, "item": {"id": 12}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Stock dropped below cart quantity by admin",
+			GQL: `
+			mutation {
+				UpdateItem(in: {itemID: 13, inStock: 2}) {
+					in_stock
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateItem": {"in_stock": 2}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cart summary with stock warning",
+			GQL: `
+			query {
+				MyCartSummary {
+					quantity,
+					lines {
+						quantity,
+						warning,
+						item {
+							id
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"MyCartSummary": {
+				"quantity": 5,
+				"lines": [
+					{"quantity": 4, "warning": "only 2 left", "item": {"id": 13}},
+					{"quantity": 1, "warning": null, "item": {"id": 12}}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Move cart line to saved for later",
+			GQL: `
+			mutation {
+				MoveToSaved(itemID: 12) {
+					quantity,
+					total,
+					lines {
+						saved,
+						item {
+							id
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"MoveToSaved": {
+				"quantity": 4,
+				"total": 0,
+				"lines": [
+					{"saved": false, "item": {"id": 13}},
+					{"saved": true, "item": {"id": 12}}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Move saved line back to cart",
+			GQL: `
+			mutation {
+				MoveToCart(itemID: 12) {
+					quantity,
+					total
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"MoveToCart": {"quantity": 5, "total": 250}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Abandoned carts report by not admin",
+			GQL: `
+			query {
+				AbandonedCarts(idleHours: 0) {
+					count
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token1",
+			ExpectedRaw: `
+			{
+				"errors": [{"message": "Forbiden", "path": ["AbandonedCarts"]}],
+				"data": null
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Abandoned carts report by admin",
+			GQL: `
+			query {
+				AbandonedCarts(idleHours: 0) {
+					count,
+					carts {
+						guest,
+						lines
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			CheckFunc: func(resp interface{}) error {
+				count, err := lookup.LookupString(resp, "data.AbandonedCarts.count")
+				if err != nil {
+					return err
+				}
+				if count.Float() < 1 {
+					return fmt.Errorf("expected idle carts, got %v", count.Float())
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Abandoned cart job reminds once and expires carts",
+			GQL: `
+			query {
+				MyCart {
+					quantity
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			CheckFunc: func(resp interface{}) error {
+				ctx := context.Background()
+				defer func() {
+					cartJob.IdleAfter = cart.DefaultIdleAfter
+					cartJob.ExpireAfter = cart.DefaultExpireAfter
+				}()
+				cartJob.IdleAfter = 0
+				reminded, expired, err := cartJob.RunOnce(ctx)
+				if err != nil {
+					return err
+				}
+				if reminded < 1 || expired != 0 {
+					return fmt.Errorf("expected reminders and nothing expired, got %d reminded, %d expired", reminded, expired)
+				}
+				if len(sentNotifications.Find(notify.KindCartReminder, "You left 5 items in your cart")) != 1 {
+					return fmt.Errorf("expected one reminder about the 5 items in the cart")
+				}
+				reminded, _, err = cartJob.RunOnce(ctx)
+				if err != nil {
+					return err
+				}
+				if reminded != 0 {
+					return fmt.Errorf("expected no reminders for carts reminded already, got %d", reminded)
+				}
+				cartJob.ExpireAfter = 0
+				_, expired, err = cartJob.RunOnce(ctx)
+				if err != nil {
+					return err
+				}
+				if expired < 2 {
+					return fmt.Errorf("expected both cart lines expired, got %d", expired)
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Clear cart",
+			GQL: `
+			mutation {
+				ClearCart {
+					quantity,
+					lines {
+						quantity
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token3",
+			ExpectedRaw: `
+			{"data": {"ClearCart": {"quantity": 0, "lines": []}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Guest cart is empty after merge",
+			GQL: `
+			query {
+				MyCart {
+					quantity
+				}
+			}
+			`,
+			URL:    gqlURL,
+			Header: map[string]string{"X-Guest-Token": "{{guestToken}}"},
+			ExpectedRaw: `
+			{"data": {"MyCart": []}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Set price of own item by seller",
+			GQL: `
+			mutation {
+				UpdateItem(in: {itemID: 7, price: 500}) {
+					price
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"UpdateItem": {"price": 500}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add to cart item of seller user",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 7, quantity: 1}) {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{"data": {"AddToCart": [{"quantity": 1, "item": {"id": 7}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order for seller user",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Пётр Иванов", phone: "+7 900 000-00-01", deliveryMethod: pickup}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			Header:    map[string]string{"Idempotency-Key": "{{idemKey}}-order"},
+			CheckFunc: func(resp interface{}) error {
+				id, err := lookup.LookupString(resp, "data.CreateAnOrder.orderID")
+				if err != nil {
+					return err
+				}
+				tplParams["sellerOrderID"] = strconv.Itoa(int(id.Float()))
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Retry order with the same idempotency key",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Пётр Иванов", phone: "+7 900 000-00-01", deliveryMethod: pickup}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			Header:    map[string]string{"Idempotency-Key": "{{idemKey}}-order"},
+			CheckFunc: func(resp interface{}) error {
+				id, err := lookup.LookupString(resp, "data.CreateAnOrder.orderID")
+				if err != nil {
+					return err
+				}
+				if got := strconv.Itoa(int(id.Float())); got != tplParams["sellerOrderID"] {
+					return fmt.Errorf("expected order %s to be replayed, got %s", tplParams["sellerOrderID"], got)
+				}
+				return nil
+			},
+		},
+		&ApiTestCase{
+			Name: "Seller shipments",
+			GQL: `
+			query {
+				MyShipments {
+					sellerID,
+					status,
+					items {
+						quantity,
+						item {
+							id
+						}
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"MyShipments": [
+				{"sellerID": 5, "status": "created", "items": [{"quantity": 1, "item": {"id": 7}}]}
+			]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Shipments by not seller",
+			GQL: `
+			query {
+				MyShipments {
+					sellerID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "Forbiden", "path": ["MyShipments"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller ships unpaid order",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{sellerOrderID}}, sellerID: 5, status: "shipped"}) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "cannot change shipment of created order", "path": ["UpdateShipment"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order of seller user paid by admin",
+			GQL: `
+			mutation {
+				UpdateOrderStatus(orderID: {{sellerOrderID}}, status: paid) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateOrderStatus": {"status": "paid"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller updates shipment of another seller",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{sellerOrderID}}, sellerID: 2, status: "shipped"}) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "Forbiden", "path": ["UpdateShipment"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller ships own shipment",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{sellerOrderID}}, sellerID: 5, status: "shipped", trackingNumber: "RA987654321RU"}) {
+					sellerID,
+					status,
+					trackingNumber
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"UpdateShipment": {"sellerID": 5, "status": "shipped", "trackingNumber": "RA987654321RU"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller shipments after shipping",
+			GQL: `
+			query {
+				MyShipments {
+					status,
+					trackingNumber
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"MyShipments": [{"status": "shipped", "trackingNumber": "RA987654321RU"}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller delivers own shipment",
+			GQL: `
+			mutation {
+				UpdateShipment(in: {orderID: {{sellerOrderID}}, sellerID: 5, status: "delivered"}) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "sellerToken",
+			ExpectedRaw: `
+			{"data": {"UpdateShipment": {"status": "delivered"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller balance after own delivery",
+			GQL: `
+			query {
+				sellerBalance(sellerID: 5) {
+					gross,
+					commission,
+					net,
+					balance,
+					entries {
+						kind,
+						itemID,
+						quantity,
+						commissionRate
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"sellerBalance": {
+					"gross": 0,
+					"commission": 0,
+					"net": 0,
+					"balance": 0,
+					"entries": []
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Order of seller user delivered by admin",
+			GQL: `
+			mutation {
+				assembling: UpdateOrderStatus(orderID: {{sellerOrderID}}, status: assembling) {
+					status
+				}
+				shipped: UpdateOrderStatus(orderID: {{sellerOrderID}}, status: shipped) {
+					status
+				}
+				delivered: UpdateOrderStatus(orderID: {{sellerOrderID}}, status: delivered) {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"assembling": {"status": "assembling"},
+				"shipped": {"status": "shipped"},
+				"delivered": {"status": "delivered"}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller balance after order delivered",
+			GQL: `
+			query {
+				sellerBalance(sellerID: 5) {
+					gross,
+					commission,
+					net,
+					balance,
+					entries {
+						kind,
+						itemID,
+						quantity,
+						commissionRate
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"sellerBalance": {
+					"gross": 500,
+					"commission": 50,
+					"net": 450,
+					"balance": 450,
+					"entries": [
+						{"kind": "sale", "itemID": 7, "quantity": 1, "commissionRate": 0.1}
+					]
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Cancel delivered order by admin",
+			GQL: `
+			mutation {
+				CancelOrder(orderID: {{sellerOrderID}}, reason: "lost in transit") {
+					status
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"CancelOrder": {"status": "cancelled"}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Seller balance after cancel",
+			GQL: `
+			query {
+				sellerBalance(sellerID: 5) {
+					gross,
+					commission,
+					net,
+					balance,
+					entries {
+						kind,
+						itemID,
+						quantity,
+						commissionRate
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {
+				"sellerBalance": {
+					"gross": 0,
+					"commission": 0,
+					"net": 0,
+					"balance": 0,
+					"entries": [
+						{"kind": "sale", "itemID": 7, "quantity": 1, "commissionRate": 0.1},
+						{"kind": "reversal", "itemID": 7, "quantity": 1, "commissionRate": 0.1}
+					]
+				}
+			}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add to cart before stock dropped",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 7, quantity: 2}) {
+					quantity,
+					item {
+						id
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{"data": {"AddToCart": [{"quantity": 2, "item": {"id": 7}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Stock of cart item dropped by admin",
+			GQL: `
+			mutation {
+				UpdateItem(in: {itemID: 7, inStock: 1}) {
+					in_stock
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "AdminToken",
+			ExpectedRaw: `
+			{"data": {"UpdateItem": {"in_stock": 1}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order over stock",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Пётр Иванов", phone: "+7 900 000-00-01", deliveryMethod: pickup}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "item 7: not enough quantity", "path": ["CreateAnOrder"]}]
+			}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Stock and cart unchanged after order over stock",
+			GQL: `
+			query {
+				MyCart {
+					quantity,
+					item {
+						id,
+						in_stock
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{"data": {"MyCart": [{"quantity": 2, "item": {"id": 7, "in_stock": 1}}]}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Add to cart item of deactivated seller",
+			GQL: `
+			mutation {
+				AddToCart(in: {itemID: 15, quantity: 1}) {
+					quantity
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			CheckFunc: func(resp interface{}) error {
+				_, err := lookup.LookupString(resp, "data.AddToCart")
+				return err
+			},
+		},
+		&ApiTestCase{
+			Name: "Preview with item of deactivated seller",
+			GQL: `
+			query {
+				PreviewOrder {
+					quantity,
+					total,
+					lines {
+						itemID,
+						status,
+						requested,
+						available
+					}
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{"data": {"PreviewOrder": {
+				"quantity": 1,
+				"total": 500,
+				"lines": [
+					{"itemID": 7, "status": "quantityReduced", "requested": 2, "available": 1},
+					{"itemID": 15, "status": "unavailable", "requested": 1, "available": 0}
+				]
+			}}}
+			`,
+		},
+		&ApiTestCase{
+			Name: "Create an order with item of deactivated seller",
+			GQL: `
+			mutation {
+				CreateAnOrder(in: {recipient: "Пётр Иванов", phone: "+7 900 000-00-01", deliveryMethod: pickup}) {
+					orderID
+				}
+			}
+			`,
+			URL:       gqlURL,
+			TokenName: "token2",
+			ExpectedRaw: `
+			{
+				"data": null,
+				"errors": [{"message": "item 15 is no longer sold", "path": ["CreateAnOrder"]}]
+			}
+			`,
+		},
 	}
 
 	for _, item := range testCases {
@@ -1267,6 +4259,9 @@ func TestApp(t *testing.T) {
 			if item.TokenName != "" {
 				req.Header.Add("Authorization", "Token "+tplParams[item.TokenName])
 			}
+			for name, value := range item.Header {
+				req.Header.Add(name, string(replaceRe.ReplaceAllFunc([]byte(value), replacer)))
+			}
 			resp, err := client.Do(req)
 			if err != nil {
 				t.Fatalf("request error: %v", err)
@@ -7,27 +7,45 @@ import (
 	"fmt"
 	"hw11_shopql/graph"
 	"hw11_shopql/graph/model"
+	"hw11_shopql/pkg/address"
 	"hw11_shopql/pkg/cart"
 	"hw11_shopql/pkg/catalog"
 	"hw11_shopql/pkg/comment"
+	"hw11_shopql/pkg/guest"
+	"hw11_shopql/pkg/idempotency"
 	"hw11_shopql/pkg/item"
+	"hw11_shopql/pkg/notify"
 	"hw11_shopql/pkg/order"
+	"hw11_shopql/pkg/outbox"
+	"hw11_shopql/pkg/payment"
+	"hw11_shopql/pkg/payout"
+	"hw11_shopql/pkg/policy"
+	"hw11_shopql/pkg/pubsub"
 	"hw11_shopql/pkg/rate"
+	"hw11_shopql/pkg/rma"
 	"hw11_shopql/pkg/role"
 	"hw11_shopql/pkg/seller"
+	"hw11_shopql/pkg/sellerreview"
 	"hw11_shopql/pkg/session"
 	"hw11_shopql/pkg/user"
+	"hw11_shopql/pkg/utils/ownerutils"
 	"hw11_shopql/pkg/utils/roleutils"
 	"hw11_shopql/pkg/utils/sessionutils"
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/go-chi/chi"
 	_ "github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -39,6 +57,7 @@ const (
 	mongoUsername = "root"
 	mongoPassword = "example"
 	databaseName  = "hz"
+	paymentSecret = "test-payment-secret"
 )
 
 type Resp map[string]map[string]string
@@ -100,11 +119,127 @@ type Seller struct {
 // 	}
 // }
 
-func Middleware(sm session.SessionManager) func(http.Handler) http.Handler {
+// eventRecorder is the outbox sink of the tests, it keeps what was delivered
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []outbox.Event
+}
+
+func (ER *eventRecorder) Name() string {
+	return "recorder"
+}
+
+func (ER *eventRecorder) Deliver(ctx context.Context, event outbox.Event) error {
+	ER.mu.Lock()
+	defer ER.mu.Unlock()
+	ER.events = append(ER.events, event)
+	return nil
+}
+
+// Find returns the delivered events of the type about the aggregate, about any aggregate if it is empty
+func (ER *eventRecorder) Find(eventType, aggregateID string) []outbox.Event {
+	ER.mu.Lock()
+	defer ER.mu.Unlock()
+	found := []outbox.Event{}
+	for _, event := range ER.events {
+		if event.Type == eventType && (aggregateID == "" || event.AggregateID == aggregateID) {
+			found = append(found, event)
+		}
+	}
+	return found
+}
+
+// failingSink fails the next deliveries it was told to, then records like eventRecorder
+type failingSink struct {
+	eventRecorder
+	failures int
+}
+
+func (FS *failingSink) Name() string {
+	return "failing"
+}
+
+// FailNext makes the next n deliveries fail
+func (FS *failingSink) FailNext(n int) {
+	FS.mu.Lock()
+	defer FS.mu.Unlock()
+	FS.failures = n
+}
+
+func (FS *failingSink) Deliver(ctx context.Context, event outbox.Event) error {
+	FS.mu.Lock()
+	if FS.failures > 0 {
+		FS.failures--
+		FS.mu.Unlock()
+		return fmt.Errorf("sink is down")
+	}
+	FS.mu.Unlock()
+	return FS.eventRecorder.Deliver(ctx, event)
+}
+
+// notificationRecorder is the notifier of the tests, it keeps what was sent
+type notificationRecorder struct {
+	mu   sync.Mutex
+	sent []notify.Notification
+}
+
+func (NR *notificationRecorder) Notify(ctx context.Context, n notify.Notification) error {
+	NR.mu.Lock()
+	defer NR.mu.Unlock()
+	NR.sent = append(NR.sent, n)
+	return nil
+}
+
+// Find returns the sent notifications of the kind with the text
+func (NR *notificationRecorder) Find(kind, text string) []notify.Notification {
+	NR.mu.Lock()
+	defer NR.mu.Unlock()
+	found := []notify.Notification{}
+	for _, n := range NR.sent {
+		if n.Kind == kind && n.Text == text {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+var (
+	// outboxDispatcher doesn't run in background, tests call RunOnce
+	outboxDispatcher *outbox.Dispatcher
+	deliveredEvents  = &eventRecorder{}
+	// flakyDispatcher has an outbox of its own, its events are put there by the tests.
+	// It retries without backoff, so one RunOnce goes through every attempt
+	flakyOutbox     *outbox.OutboxRepo
+	flakyDispatcher *outbox.Dispatcher
+	flakySink       = &failingSink{}
+	// cartJob doesn't run in background either
+	cartJob           *cart.AbandonedCartJob
+	sentNotifications = &notificationRecorder{}
+)
+
+// putFlakyEvent stores a new event for flakyDispatcher, its aggregate is the event itself
+func putFlakyEvent(ctx context.Context) (outbox.Event, error) {
+	event := outbox.NewEvent("test.flaky", "", bson.M{})
+	event.AggregateID = event.ID
+	doc, err := outbox.Attach(bson.M{}, event)
+	if err != nil {
+		return event, err
+	}
+	_, err = flakyOutbox.Sources[0].InsertOne(ctx, doc)
+	return event, err
+}
+
+func Middleware(sm session.SessionManager, guests *guest.Signer) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			session, err := sm.Check(r)
 			if err != nil {
+				// anonymous visitor, only a token the client presents again is honored
+				if guestID, err := guests.Verify(r.Header.Get(guest.HeaderName)); err == nil {
+					r = r.WithContext(context.WithValue(r.Context(), guest.ContextKey, guestID))
+				} else if token, err := guests.Issue(); err == nil {
+					w.Header().Set(guest.HeaderName, token)
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -171,17 +306,54 @@ func GetApp() *chi.Mux {
 	collection := db.Collection("Catalogs")
 	item_collection := db.Collection("Items")
 	rateCollection := db.Collection("Rates")
-	rateRepos := *rate.CreateRateRepo(rateCollection)
+	rateRepos := *rate.CreateRateRepo(rateCollection, item_collection)
 	commentCollection := db.Collection("Comments")
 	commRepo := *comment.CreateCommentRepo(commentCollection)
 	itemHandler := item.CreateItemsHandler(item_collection, &rateRepos, &commRepo)
 	catalogHandler := catalog.CreateCatalogHandler(collection, itemHandler)
 	cartCollection := db.Collection("Carts")
 	cartRepos := *cart.CreateCartRepo(cartCollection, itemHandler)
+	cartJob = cart.CreateAbandonedCartJob(&cartRepos, sentNotifications)
 	seller_collection := db.Collection("Sellers")
 	sellerHandler := seller.CreateSellersHandler(seller_collection)
+	if err := sellerHandler.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create seller index:", err)
+	}
 	orderCollection := db.Collection("orders")
-	orderRepo := *order.CreateOrderRepo(orderCollection, &cartRepos, itemHandler)
+	orderRepo := *order.CreateOrderRepo(orderCollection, db.Collection("Counters"), &cartRepos, itemHandler)
+	sellerStats := seller.CreateSellerStatsRepo(db.Collection("SellerStats"), seller_collection, item_collection, orderCollection)
+	orderRepo.Stats = sellerStats
+	payoutRepo := payout.CreatePayoutRepo(db.Collection("Ledger"), db.Collection("CommissionRates"), catalogHandler)
+	orderRepo.Ledger = payoutRepo
+	bus := pubsub.CreateMemoryBus()
+	orderRepo.Events = bus
+	orderRepo.Sellers = sellerHandler
+	if err := orderRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create order indexes:", err)
+	}
+	if err := orderRepo.BackfillTotals(context.Background()); err != nil {
+		log.Println("failed to backfill order totals:", err)
+	}
+	if err := orderRepo.BackfillStatuses(context.Background()); err != nil {
+		log.Println("failed to backfill order statuses:", err)
+	}
+	if err := orderRepo.SeedCounter(context.Background()); err != nil {
+		log.Println("failed to seed order counter:", err)
+	}
+	reviewPolicy := policy.CreateReviewPolicy(&orderRepo, itemHandler, catalogHandler)
+	sellerReviewRepo := sellerreview.CreateSellerReviewRepo(db.Collection("SellerReviews"), seller_collection)
+	if err := sellerReviewRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create seller review index:", err)
+	}
+	addressRepo := address.CreateAddressRepo(db.Collection("Addresses"))
+	paymentProvider := payment.CreateFakeProvider([]byte(paymentSecret), "/payments/fake/confirm")
+	paymentRepo := payment.CreatePaymentRepo(db.Collection("Payments"), db.Collection("PaymentEvents"), paymentProvider, &orderRepo)
+	if err := paymentRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create payment indexes:", err)
+	}
+	orderRepo.Payments = paymentRepo
+	returnRepo := rma.CreateReturnRepo(db.Collection("Returns"), &orderRepo, itemHandler, paymentRepo)
+	returnRepo.Ledger = payoutRepo
 	// Insert test data if available
 	if testData != nil {
 		if err := catalogHandler.AddNewCatalog(context.Background(), testData.Catalog); err != nil {
@@ -194,11 +366,14 @@ func GetApp() *chi.Mux {
 			limit := 5
 			offset := 0
 			items, err := itemHandler.GetItemsBySellerID(context.Background(), seller.ID, &limit, &offset)
-			if err != nil {
+			if err == nil {
 				for _, item := range items {
 					seller.ItemIds = append(seller.ItemIds, item.ID)
 				}
 			}
+			if ok, _ := sellerHandler.SellerExists(context.Background(), seller.ID); !ok {
+				err = sellerHandler.InsertSeller(context.Background(), seller)
+			}
 			if err != nil {
 				log.Printf("Failed to insert seller: %v", err)
 			}
@@ -218,11 +393,21 @@ func GetApp() *chi.Mux {
 	if err != nil {
 		panic(err)
 	}
+	roleRepo := role.CreateRoleRepo(postgre)
 	c := graph.Config{Resolvers: &graph.Resolver{CatalogRepo: catalogHandler,
-		CartRepo:   &cartRepos,
-		ItemRepo:   itemHandler,
-		SellerRepo: sellerHandler,
-		OrderRepo:  &orderRepo,
+		RoleRepo:     roleRepo,
+		CartRepo:     &cartRepos,
+		ItemRepo:     itemHandler,
+		SellerRepo:   sellerHandler,
+		SellerStats:  sellerStats,
+		SellerReview: sellerReviewRepo,
+		PayoutRepo:   payoutRepo,
+		OrderRepo:    &orderRepo,
+		AddressRepo:  addressRepo,
+		PaymentRepo:  paymentRepo,
+		ReturnRepo:   returnRepo,
+		ReviewPolicy: reviewPolicy,
+		Events:       bus,
 	}}
 	c.Directives.Authorized = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
 		if ctx.Value("tokens") == nil {
@@ -231,6 +416,13 @@ func GetApp() *chi.Mux {
 		}
 		return next(ctx)
 	}
+	c.Directives.AuthorizedOrGuest = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
+		if ctx.Value("tokens") == nil && ctx.Value(guest.ContextKey) == nil {
+			graphql.AddError(ctx, fmt.Errorf("User not authorized"))
+			return nil, nil
+		}
+		return next(ctx)
+	}
 	c.Directives.HasRole = func(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (res interface{}, err error) {
 		if id, err := sessionutils.IdFromContex(ctx); err == nil {
 			ok := roleutils.HasRole(postgre, id, role.String())
@@ -243,17 +435,70 @@ func GetApp() *chi.Mux {
 		}
 		return next(ctx)
 	}
-	srv := handler.NewDefaultServer(graph.NewExecutableSchema(c))
+	c.Directives.OwnsSeller = func(ctx context.Context, obj interface{}, next graphql.Resolver) (res interface{}, err error) {
+		id, err := sessionutils.IdFromContex(ctx)
+		if err != nil {
+			graphql.AddError(ctx, fmt.Errorf("User not authorized"))
+			return nil, nil
+		}
+		if roleutils.HasRole(postgre, id, model.RoleAdmin.String()) {
+			return next(ctx)
+		}
+		sellerID, err := ownerutils.SellerIDFromArgs(ctx, itemHandler)
+		if err != nil {
+			return nil, err
+		}
+		owns, err := roleutils.OwnsSeller(postgre, id, sellerID)
+		if err != nil {
+			return nil, err
+		}
+		if !roleutils.HasRole(postgre, id, model.RoleSeller.String()) || !owns {
+			graphql.AddError(ctx, fmt.Errorf("Forbiden"))
+			return nil, nil
+		}
+		return next(ctx)
+	}
+	c.Directives.Idempotent = idempotency.Directive
 	sm := session.NewSessionsDB(postgre)
+	srv := handler.New(graph.NewExecutableSchema(c))
+	// subscriptions authenticate with the session token in the init payload
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		InitFunc:              sessionutils.WebsocketInit(sm),
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+	srv.SetQueryCache(lru.New(1000))
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{Cache: lru.New(100)})
+	idempotencyRepo := idempotency.CreateIdempotencyRepo(db.Collection("IdempotencyKeys"))
+	if err := idempotencyRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create idempotency key index:", err)
+	}
+	srv.Use(idempotency.CreateExtension(idempotencyRepo))
 	router := chi.NewRouter()
-	router.Use(Middleware(sm))
+	router.Use(Middleware(sm, guest.CreateSigner(guest.RandomSecret())))
 	router.Handle("/", playground.Handler("GraphQL playground", "/query"))
 	router.Handle("/query", srv)
-	roleRepo := role.CreateRoleRepo(postgre)
 	ur := user.CreateUserRepo(postgre, roleRepo)
 	uh := user.CreateUserHandler(ur, sm)
+	uh.Carts = &cartRepos
+	outboxRepo := outbox.CreateOutboxRepo(db.Collection("Outbox"), orderCollection, item_collection, commentCollection)
+	if err := outboxRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Println("failed to create outbox index:", err)
+	}
+	outboxDispatcher = outbox.CreateDispatcher(outboxRepo, deliveredEvents)
+	flakyOutbox = outbox.CreateOutboxRepo(db.Collection("FlakyOutbox"), db.Collection("FlakyOutboxSource"))
+	flakyDispatcher = outbox.CreateDispatcher(flakyOutbox, flakySink)
+	flakyDispatcher.MaxAttempts = 3
+	flakyDispatcher.Backoff = 0
+	flakyDispatcher.MaxBackoff = 0
 	router.HandleFunc("/register", uh.Reg)
 	router.HandleFunc("/login", uh.Log)
+	router.Post("/payments/webhook", payment.CreateWebhookHandler(paymentRepo).Webhook)
+	router.Get("/admin/orders.csv", order.CreateExportHandler(&orderRepo, roleRepo).ExportCSV)
 	log.Printf("Connect to http://localhost:%v/ for GraphQL playground", port)
 	return router
 }